@@ -0,0 +1,478 @@
+// Package adv parses and builds BLE advertising data (a sequence of AD structures),
+// as found in advertising and scan response packets.
+//
+// UUIDs are hex strings, most significant byte first (as in goble), i.e. "180d" or "0000180d00001000800000805f9b34fb".
+// In the AD structures they are stored least significant byte first.
+package adv
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxLength is the maximum length of the advertising (or scan response) data
+const MaxLength = 31
+
+// AD types
+const (
+	TypeFlags                    = 0x01
+	TypeIncompleteUUID16         = 0x02
+	TypeCompleteUUID16           = 0x03
+	TypeIncompleteUUID32         = 0x04
+	TypeCompleteUUID32           = 0x05
+	TypeIncompleteUUID128        = 0x06
+	TypeCompleteUUID128          = 0x07
+	TypeShortName                = 0x08
+	TypeCompleteName             = 0x09
+	TypeTxPowerLevel             = 0x0A
+	TypeSlaveConnIntervalRange   = 0x12
+	TypeSolicitationUUID16       = 0x14
+	TypeSolicitationUUID128      = 0x15
+	TypeServiceDataUUID16        = 0x16
+	TypeAppearance               = 0x19
+	TypeLEDeviceAddress          = 0x1B
+	TypeLERole                   = 0x1C
+	TypeSolicitationUUID32       = 0x1F
+	TypeServiceDataUUID32        = 0x20
+	TypeServiceDataUUID128       = 0x21
+	TypeURI                      = 0x24
+	TypeManufacturerSpecificData = 0xFF
+)
+
+// Flags values
+const (
+	FlagLimitedDiscoverable = 0x01
+	FlagGeneralDiscoverable = 0x02
+	FlagBREDRNotSupported   = 0x04
+	FlagLEBREDRController   = 0x08
+	FlagLEBREDRHost         = 0x10
+)
+
+// LE role values
+const (
+	RolePeripheralOnly      = 0x00
+	RoleCentralOnly         = 0x01
+	RolePeripheralPreferred = 0x02
+	RoleCentralPreferred    = 0x03
+)
+
+var (
+	TOO_LONG  = fmt.Errorf("advertising data longer than %v bytes", MaxLength)
+	BAD_UUID  = errors.New("invalid UUID")
+	BAD_FIELD = errors.New("invalid AD structure")
+)
+
+// URI scheme name string prefixes (from the Bluetooth Assigned Numbers)
+var uriSchemes = map[byte]string{
+	0x01: "", // no scheme
+	0x02: "aaa:",
+	0x03: "aaas:",
+	0x04: "about:",
+	0x0F: "data:",
+	0x14: "file:",
+	0x15: "ftp:",
+	0x16: "http:",
+	0x17: "https:",
+	0x31: "mailto:",
+	0x45: "sip:",
+	0x46: "sips:",
+	0x4E: "tel:",
+}
+
+// Field is a raw AD structure
+type Field struct {
+	Type byte
+	Data []byte
+}
+
+// ServiceData is the data associated to a service UUID
+type ServiceData struct {
+	Uuid string
+	Data []byte
+}
+
+// AdvertisingData is the decoded content of the AD structures.
+// Optional values are nil (or empty) if they are not present.
+type AdvertisingData struct {
+	Flags byte
+
+	ServiceUuids           []string // 16, 32 or 128 bit service UUIDs
+	IncompleteServiceUuids bool     // the list of service UUIDs is not complete
+	SolicitedServiceUuids  []string // 16, 32 or 128 bit service solicitation UUIDs
+
+	LocalName string
+	ShortName bool // the local name is shortened
+
+	TxPowerLevel *int8
+	Appearance   *uint16
+	LERole       *byte
+
+	ServiceData      []ServiceData
+	ManufacturerData []byte // the company identifier (little endian) followed by the data
+	URI              string
+
+	Other []Field // the AD structures that are not decoded
+}
+
+// Int8 returns a pointer to v (for TxPowerLevel)
+func Int8(v int8) *int8 { return &v }
+
+// Uint16 returns a pointer to v (for Appearance)
+func Uint16(v uint16) *uint16 { return &v }
+
+// Byte returns a pointer to v (for LERole)
+func Byte(v byte) *byte { return &v }
+
+// ParseFields splits the advertising data in AD structures.
+// Zero length structures (used as padding) are skipped.
+func ParseFields(b []byte) ([]Field, error) {
+	var fields []Field
+
+	for i := 0; i < len(b); {
+		l := int(b[i])
+		if l == 0 {
+			// padding (the rest should be zeroes)
+			i++
+			continue
+		}
+
+		if i+1+l > len(b) {
+			return nil, fmt.Errorf("%v: length %v at offset %v exceeds the data", BAD_FIELD, l, i)
+		}
+
+		fields = append(fields, Field{Type: b[i+1], Data: b[i+2 : i+1+l]})
+		i += 1 + l
+	}
+
+	return fields, nil
+}
+
+// Parse decodes the advertising data
+func Parse(b []byte) (*AdvertisingData, error) {
+	fields, err := ParseFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	ad := &AdvertisingData{}
+
+	for _, f := range fields {
+		if err := ad.decode(f); err != nil {
+			return nil, err
+		}
+	}
+
+	return ad, nil
+}
+
+func (ad *AdvertisingData) decode(f Field) error {
+	invalid := func() error {
+		return fmt.Errorf("%v: type 0x%02x with %v bytes", BAD_FIELD, f.Type, len(f.Data))
+	}
+
+	switch f.Type {
+	case TypeFlags:
+		if len(f.Data) != 1 {
+			return invalid()
+		}
+
+		ad.Flags = f.Data[0]
+
+	case TypeIncompleteUUID16, TypeCompleteUUID16, TypeIncompleteUUID32, TypeCompleteUUID32, TypeIncompleteUUID128, TypeCompleteUUID128:
+		uuids, err := decodeUuids(f.Data, uuidSize(f.Type))
+		if err != nil {
+			return invalid()
+		}
+
+		ad.ServiceUuids = append(ad.ServiceUuids, uuids...)
+		if f.Type == TypeIncompleteUUID16 || f.Type == TypeIncompleteUUID32 || f.Type == TypeIncompleteUUID128 {
+			ad.IncompleteServiceUuids = true
+		}
+
+	case TypeSolicitationUUID16, TypeSolicitationUUID32, TypeSolicitationUUID128:
+		uuids, err := decodeUuids(f.Data, uuidSize(f.Type))
+		if err != nil {
+			return invalid()
+		}
+
+		ad.SolicitedServiceUuids = append(ad.SolicitedServiceUuids, uuids...)
+
+	case TypeShortName, TypeCompleteName:
+		ad.LocalName = string(f.Data)
+		ad.ShortName = f.Type == TypeShortName
+
+	case TypeTxPowerLevel:
+		if len(f.Data) != 1 {
+			return invalid()
+		}
+
+		ad.TxPowerLevel = Int8(int8(f.Data[0]))
+
+	case TypeAppearance:
+		if len(f.Data) != 2 {
+			return invalid()
+		}
+
+		ad.Appearance = Uint16(binary.LittleEndian.Uint16(f.Data))
+
+	case TypeLERole:
+		if len(f.Data) != 1 {
+			return invalid()
+		}
+
+		ad.LERole = Byte(f.Data[0])
+
+	case TypeServiceDataUUID16, TypeServiceDataUUID32, TypeServiceDataUUID128:
+		size := uuidSize(f.Type)
+		if len(f.Data) < size {
+			return invalid()
+		}
+
+		ad.ServiceData = append(ad.ServiceData, ServiceData{
+			Uuid: uuidString(f.Data[:size]),
+			Data: f.Data[size:],
+		})
+
+	case TypeManufacturerSpecificData:
+		if len(f.Data) < 2 {
+			return invalid()
+		}
+
+		ad.ManufacturerData = f.Data
+
+	case TypeURI:
+		if len(f.Data) < 1 {
+			return invalid()
+		}
+
+		scheme, ok := uriSchemes[f.Data[0]]
+		if !ok {
+			// unknown scheme
+			ad.Other = append(ad.Other, f)
+			break
+		}
+
+		ad.URI = scheme + string(f.Data[1:])
+
+	default:
+		ad.Other = append(ad.Other, f)
+	}
+
+	return nil
+}
+
+// Fields returns the AD structures for the advertising data
+func (ad *AdvertisingData) Fields() ([]Field, error) {
+	var fields []Field
+
+	if ad.Flags != 0 {
+		fields = append(fields, Field{Type: TypeFlags, Data: []byte{ad.Flags}})
+	}
+
+	uuidTypes := [][3]byte{
+		{TypeCompleteUUID16, TypeCompleteUUID32, TypeCompleteUUID128},
+		{TypeIncompleteUUID16, TypeIncompleteUUID32, TypeIncompleteUUID128},
+	}
+
+	types := uuidTypes[0]
+	if ad.IncompleteServiceUuids {
+		types = uuidTypes[1]
+	}
+
+	uf, err := uuidFields(ad.ServiceUuids, types)
+	if err != nil {
+		return nil, err
+	}
+
+	fields = append(fields, uf...)
+
+	uf, err = uuidFields(ad.SolicitedServiceUuids, [3]byte{TypeSolicitationUUID16, TypeSolicitationUUID32, TypeSolicitationUUID128})
+	if err != nil {
+		return nil, err
+	}
+
+	fields = append(fields, uf...)
+
+	for _, sd := range ad.ServiceData {
+		uuid, err := uuidBytes(sd.Uuid)
+		if err != nil {
+			return nil, err
+		}
+
+		t := byte(TypeServiceDataUUID16)
+		if len(uuid) == 4 {
+			t = TypeServiceDataUUID32
+		} else if len(uuid) == 16 {
+			t = TypeServiceDataUUID128
+		}
+
+		fields = append(fields, Field{Type: t, Data: append(uuid, sd.Data...)})
+	}
+
+	if ad.TxPowerLevel != nil {
+		fields = append(fields, Field{Type: TypeTxPowerLevel, Data: []byte{byte(*ad.TxPowerLevel)}})
+	}
+
+	if ad.Appearance != nil {
+		data := make([]byte, 2)
+		binary.LittleEndian.PutUint16(data, *ad.Appearance)
+		fields = append(fields, Field{Type: TypeAppearance, Data: data})
+	}
+
+	if ad.LERole != nil {
+		fields = append(fields, Field{Type: TypeLERole, Data: []byte{*ad.LERole}})
+	}
+
+	if ad.URI != "" {
+		fields = append(fields, Field{Type: TypeURI, Data: encodeURI(ad.URI)})
+	}
+
+	if ad.LocalName != "" {
+		t := byte(TypeCompleteName)
+		if ad.ShortName {
+			t = TypeShortName
+		}
+
+		fields = append(fields, Field{Type: t, Data: []byte(ad.LocalName)})
+	}
+
+	if ad.ManufacturerData != nil {
+		if len(ad.ManufacturerData) < 2 {
+			return nil, fmt.Errorf("%v: manufacturer data without company identifier", BAD_FIELD)
+		}
+
+		fields = append(fields, Field{Type: TypeManufacturerSpecificData, Data: ad.ManufacturerData})
+	}
+
+	fields = append(fields, ad.Other...)
+	return fields, nil
+}
+
+// Bytes returns the advertising data, or TOO_LONG if it's longer than MaxLength
+func (ad *AdvertisingData) Bytes() ([]byte, error) {
+	fields, err := ad.Fields()
+	if err != nil {
+		return nil, err
+	}
+
+	return Build(fields...)
+}
+
+// Build serializes the AD structures, and returns TOO_LONG if the result is longer than MaxLength
+func Build(fields ...Field) ([]byte, error) {
+	var b []byte
+
+	for _, f := range fields {
+		if len(f.Data) > 254 {
+			return nil, TOO_LONG
+		}
+
+		b = append(b, byte(len(f.Data)+1), f.Type)
+		b = append(b, f.Data...)
+	}
+
+	if len(b) > MaxLength {
+		return nil, TOO_LONG
+	}
+
+	return b, nil
+}
+
+// the size (in bytes) of the UUIDs for the AD type
+func uuidSize(t byte) int {
+	switch t {
+	case TypeIncompleteUUID32, TypeCompleteUUID32, TypeSolicitationUUID32, TypeServiceDataUUID32:
+		return 4
+
+	case TypeIncompleteUUID128, TypeCompleteUUID128, TypeSolicitationUUID128, TypeServiceDataUUID128:
+		return 16
+	}
+
+	return 2
+}
+
+// decode a list of UUIDs of the specified size
+func decodeUuids(b []byte, size int) ([]string, error) {
+	if len(b)%size != 0 {
+		return nil, BAD_UUID
+	}
+
+	var uuids []string
+	for i := 0; i < len(b); i += size {
+		uuids = append(uuids, uuidString(b[i:i+size]))
+	}
+
+	return uuids, nil
+}
+
+// group the UUIDs by size, in one AD structure per size
+func uuidFields(uuids []string, types [3]byte) ([]Field, error) {
+	var data [3][]byte
+
+	for _, s := range uuids {
+		uuid, err := uuidBytes(s)
+		if err != nil {
+			return nil, err
+		}
+
+		switch len(uuid) {
+		case 2:
+			data[0] = append(data[0], uuid...)
+		case 4:
+			data[1] = append(data[1], uuid...)
+		case 16:
+			data[2] = append(data[2], uuid...)
+		}
+	}
+
+	var fields []Field
+	for i, d := range data {
+		if len(d) > 0 {
+			fields = append(fields, Field{Type: types[i], Data: d})
+		}
+	}
+
+	return fields, nil
+}
+
+// the UUID string for the (little endian) UUID bytes
+func uuidString(b []byte) string {
+	r := make([]byte, len(b))
+	for i, v := range b {
+		r[len(b)-1-i] = v
+	}
+
+	return hex.EncodeToString(r)
+}
+
+// the (little endian) bytes of a 16, 32 or 128 bit UUID string
+func uuidBytes(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || (len(b) != 2 && len(b) != 4 && len(b) != 16) {
+		return nil, fmt.Errorf("%v %q", BAD_UUID, s)
+	}
+
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+
+	return b, nil
+}
+
+// encode the URI, replacing the scheme with its code
+func encodeURI(uri string) []byte {
+	code := byte(0x01)
+
+	for c, scheme := range uriSchemes {
+		if scheme != "" && strings.HasPrefix(uri, scheme) {
+			code = c
+			uri = uri[len(scheme):]
+			break
+		}
+	}
+
+	return append([]byte{code}, uri...)
+}
@@ -0,0 +1,147 @@
+package adv
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	data := []byte{
+		0x02, 0x01, 0x06, // flags
+		0x05, 0x02, 0x0d, 0x18, 0x0f, 0x18, // incomplete 16 bit UUIDs
+		0x02, 0x0a, 0xf4, // tx power (-12)
+		0x03, 0x19, 0x41, 0x03, // appearance (running walking sensor)
+		0x05, 0x16, 0x0f, 0x18, 0x64, 0x01, // service data (battery)
+		0x05, 0x08, 'g', 'o', 'b', 'l', // short name
+		0x05, 0xff, 0x4c, 0x00, 0x02, 0x15, // manufacturer data
+		0x00, 0x00, // padding
+	}
+
+	ad, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &AdvertisingData{
+		Flags:                  FlagGeneralDiscoverable | FlagBREDRNotSupported,
+		ServiceUuids:           []string{"180d", "180f"},
+		IncompleteServiceUuids: true,
+		LocalName:              "gobl",
+		ShortName:              true,
+		TxPowerLevel:           Int8(-12),
+		Appearance:             Uint16(0x0341),
+		ServiceData:            []ServiceData{{Uuid: "180f", Data: []byte{0x64, 0x01}}},
+		ManufacturerData:       []byte{0x4c, 0x00, 0x02, 0x15},
+	}
+
+	if !reflect.DeepEqual(ad, expected) {
+		t.Errorf("expected %#v got %#v\n", expected, ad)
+	}
+}
+
+func TestParseOther(t *testing.T) {
+	data := []byte{
+		0x11, 0x07, 0xfb, 0x34, 0x9b, 0x5f, 0x80, 0x00, 0x00, 0x80, 0x00, 0x10, 0x00, 0x00, 0x0d, 0x18, 0x00, 0x00, // 128 bit UUID
+		0x02, 0x1c, 0x02, // LE role
+		0x05, 0x12, 0x06, 0x00, 0x80, 0x0c, // connection interval range
+	}
+
+	ad, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ad.ServiceUuids, []string{"0000180d00001000800000805f9b34fb"}) || ad.IncompleteServiceUuids {
+		t.Errorf("unexpected service uuids %#v\n", ad.ServiceUuids)
+	}
+
+	if ad.LERole == nil || *ad.LERole != RolePeripheralPreferred {
+		t.Errorf("expected %v got %#v\n", RolePeripheralPreferred, ad.LERole)
+	}
+
+	expected := []Field{{Type: TypeSlaveConnIntervalRange, Data: []byte{0x06, 0x00, 0x80, 0x0c}}}
+	if !reflect.DeepEqual(ad.Other, expected) {
+		t.Errorf("expected %#v got %#v\n", expected, ad.Other)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := [][]byte{
+		{0x05, 0x09, 'a'},              // truncated
+		{0x03, 0x01, 0x06, 0x00},       // flags too long
+		{0x04, 0x03, 0x0d, 0x18, 0x0f}, // partial UUID
+		{0x02, 0x19, 0x41},             // short appearance
+		{0x02, 0x16, 0x0f},             // service data without UUID
+		{0x02, 0xff, 0x4c},             // manufacturer data without company
+	}
+
+	for _, data := range tests {
+		if ad, err := Parse(data); err == nil {
+			t.Errorf("%x: expected error got %#v\n", data, ad)
+		}
+	}
+}
+
+func TestBytes(t *testing.T) {
+	ad := &AdvertisingData{
+		Flags:                 FlagGeneralDiscoverable | FlagBREDRNotSupported,
+		ServiceUuids:          []string{"180d", "0000fe95-0000-1000-8000-00805f9b34fb"},
+		SolicitedServiceUuids: []string{"1812"},
+	}
+
+	b, err := ad.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{
+		0x02, 0x01, 0x06,
+		0x03, 0x03, 0x0d, 0x18,
+		0x11, 0x07, 0xfb, 0x34, 0x9b, 0x5f, 0x80, 0x00, 0x00, 0x80, 0x00, 0x10, 0x00, 0x00, 0x95, 0xfe, 0x00, 0x00,
+		0x03, 0x14, 0x12, 0x18,
+	}
+
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected %x got %x\n", expected, b)
+	}
+
+	ad.LocalName = "too long"
+	if _, err := ad.Bytes(); err != TOO_LONG {
+		t.Errorf("expected %v got %v\n", TOO_LONG, err)
+	}
+
+	ad = &AdvertisingData{ServiceUuids: []string{"18"}}
+	if _, err := ad.Bytes(); err == nil {
+		t.Error("expected invalid UUID error")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ad := &AdvertisingData{
+		Flags:            FlagGeneralDiscoverable,
+		LocalName:        "goble",
+		URI:              "https://a.b",
+		Appearance:       Uint16(0x0040),
+		ServiceData:      []ServiceData{{Uuid: "feaa", Data: []byte{0x10}}},
+		ManufacturerData: []byte{0xff, 0xff},
+	}
+
+	b, err := ad.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ad2, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ad, ad2) {
+		t.Errorf("expected %#v got %#v\n", ad, ad2)
+	}
+
+	if b[14] != 0x17 { // https:
+		t.Errorf("expected https scheme got %x\n", b)
+	}
+}
@@ -0,0 +1,392 @@
+// Package beacon decodes and encodes the iBeacon, Eddystone and AltBeacon frames
+// found in the manufacturer data and service data of BLE advertisements.
+package beacon
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/raff/goble/adv"
+	"github.com/raff/goble/xpc"
+)
+
+var (
+	NOT_A_BEACON  = errors.New("not a beacon")
+	INVALID_FRAME = errors.New("invalid beacon frame")
+)
+
+// the Eddystone service UUID
+const EddystoneUuid = "feaa"
+
+// Eddystone frame types
+const (
+	EddystoneUIDFrame = 0x00
+	EddystoneURLFrame = 0x10
+	EddystoneTLMFrame = 0x20
+	EddystoneEIDFrame = 0x30
+)
+
+// the Apple company identifier (and iBeacon type)
+const appleCompanyId = 0x004C
+const iBeaconType = 0x02
+
+// the AltBeacon beacon code
+const altBeaconCode = 0xBEAC
+
+// Beacon is one of *IBeacon, *EddystoneUID, *EddystoneURL, *EddystoneTLM, *EddystoneEID or *AltBeacon
+type Beacon interface {
+	// Type returns the beacon type (i.e. "iBeacon", "eddystone-uid")
+	Type() string
+
+	// Bytes returns the beacon frame (the manufacturer data for iBeacon and AltBeacon,
+	// the Eddystone service data for Eddystone)
+	Bytes() ([]byte, error)
+}
+
+// IBeacon is an Apple iBeacon
+type IBeacon struct {
+	UUID          xpc.UUID
+	Major         uint16
+	Minor         uint16
+	MeasuredPower int8 // RSSI at 1 meter
+}
+
+func (b *IBeacon) Type() string { return "iBeacon" }
+
+// EddystoneUID is an Eddystone-UID frame
+type EddystoneUID struct {
+	TxPower   int8 // at 0 meters
+	Namespace [10]byte
+	Instance  [6]byte
+}
+
+func (b *EddystoneUID) Type() string { return "eddystone-uid" }
+
+// EddystoneURL is an Eddystone-URL frame
+type EddystoneURL struct {
+	TxPower int8 // at 0 meters
+	URL     string
+}
+
+func (b *EddystoneURL) Type() string { return "eddystone-url" }
+
+// EddystoneTLM is an (unencrypted) Eddystone-TLM frame
+type EddystoneTLM struct {
+	Version     byte
+	Battery     uint16  // battery voltage in mV (0 if not supported)
+	Temperature float64 // in degrees Celsius (-128 if not supported)
+	AdvCount    uint32  // advertising PDUs count since power-up or reboot
+	SecCount    uint32  // time since power-up or reboot, in 0.1 seconds
+}
+
+func (b *EddystoneTLM) Type() string { return "eddystone-tlm" }
+
+// EddystoneEID is an Eddystone-EID frame
+type EddystoneEID struct {
+	TxPower int8 // at 0 meters
+	EID     [8]byte
+}
+
+func (b *EddystoneEID) Type() string { return "eddystone-eid" }
+
+// AltBeacon is an AltBeacon frame
+type AltBeacon struct {
+	CompanyId     uint16
+	ID            [20]byte // usually a 16 bytes UUID followed by 2 bytes major and 2 bytes minor
+	ReferenceRSSI int8     // RSSI at 1 meter
+	Reserved      byte
+}
+
+func (b *AltBeacon) Type() string { return "altBeacon" }
+
+// FromManufacturerData decodes an iBeacon or AltBeacon from the manufacturer data
+// (that starts with the company identifier, as in goble.Advertisement).
+// It returns NOT_A_BEACON if the data doesn't contain a known beacon.
+func FromManufacturerData(data []byte) (Beacon, error) {
+	if len(data) < 4 {
+		return nil, NOT_A_BEACON
+	}
+
+	companyId := binary.LittleEndian.Uint16(data)
+
+	if companyId == appleCompanyId && data[2] == iBeaconType {
+		return ParseIBeacon(data)
+	}
+
+	if binary.BigEndian.Uint16(data[2:]) == altBeaconCode {
+		return ParseAltBeacon(data)
+	}
+
+	return nil, NOT_A_BEACON
+}
+
+// FromServiceData decodes an Eddystone frame from the data for the specified service UUID.
+// It returns NOT_A_BEACON if the service is not the Eddystone service.
+func FromServiceData(uuid string, data []byte) (Beacon, error) {
+	if !isEddystone(uuid) {
+		return nil, NOT_A_BEACON
+	}
+
+	return ParseEddystone(data)
+}
+
+// ParseIBeacon decodes an iBeacon from the manufacturer data
+func ParseIBeacon(data []byte) (*IBeacon, error) {
+	if len(data) != 25 || binary.LittleEndian.Uint16(data) != appleCompanyId || data[2] != iBeaconType || data[3] != 21 {
+		return nil, invalidFrame("iBeacon", data)
+	}
+
+	b := &IBeacon{
+		Major:         binary.BigEndian.Uint16(data[20:]),
+		Minor:         binary.BigEndian.Uint16(data[22:]),
+		MeasuredPower: int8(data[24]),
+	}
+
+	copy(b.UUID[:], data[4:20])
+	return b, nil
+}
+
+// ParseAltBeacon decodes an AltBeacon from the manufacturer data
+func ParseAltBeacon(data []byte) (*AltBeacon, error) {
+	if len(data) != 26 || binary.BigEndian.Uint16(data[2:]) != altBeaconCode {
+		return nil, invalidFrame("AltBeacon", data)
+	}
+
+	b := &AltBeacon{
+		CompanyId:     binary.LittleEndian.Uint16(data),
+		ReferenceRSSI: int8(data[24]),
+		Reserved:      data[25],
+	}
+
+	copy(b.ID[:], data[4:24])
+	return b, nil
+}
+
+// ParseEddystone decodes an Eddystone frame from the Eddystone service data
+func ParseEddystone(data []byte) (Beacon, error) {
+	if len(data) < 1 {
+		return nil, invalidFrame("Eddystone", data)
+	}
+
+	switch data[0] {
+	case EddystoneUIDFrame:
+		// the 2 reserved bytes are optional
+		if len(data) != 18 && len(data) != 20 {
+			return nil, invalidFrame("Eddystone-UID", data)
+		}
+
+		b := &EddystoneUID{TxPower: int8(data[1])}
+		copy(b.Namespace[:], data[2:12])
+		copy(b.Instance[:], data[12:18])
+		return b, nil
+
+	case EddystoneURLFrame:
+		if len(data) < 3 {
+			return nil, invalidFrame("Eddystone-URL", data)
+		}
+
+		url, err := decodeURL(data[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		return &EddystoneURL{TxPower: int8(data[1]), URL: url}, nil
+
+	case EddystoneTLMFrame:
+		if len(data) != 14 || data[1] != 0 {
+			// only the unencrypted (version 0) frame is supported
+			return nil, invalidFrame("Eddystone-TLM", data)
+		}
+
+		return &EddystoneTLM{
+			Version:     data[1],
+			Battery:     binary.BigEndian.Uint16(data[2:]),
+			Temperature: float64(int16(binary.BigEndian.Uint16(data[4:]))) / 256,
+			AdvCount:    binary.BigEndian.Uint32(data[6:]),
+			SecCount:    binary.BigEndian.Uint32(data[10:]),
+		}, nil
+
+	case EddystoneEIDFrame:
+		if len(data) != 10 {
+			return nil, invalidFrame("Eddystone-EID", data)
+		}
+
+		b := &EddystoneEID{TxPower: int8(data[1])}
+		copy(b.EID[:], data[2:])
+		return b, nil
+	}
+
+	return nil, invalidFrame("Eddystone", data)
+}
+
+func (b *IBeacon) Bytes() ([]byte, error) {
+	data := []byte{0x4C, 0x00, iBeaconType, 21}
+	data = append(data, b.UUID[:]...)
+	data = append(data, byte(b.Major>>8), byte(b.Major), byte(b.Minor>>8), byte(b.Minor), byte(b.MeasuredPower))
+	return data, nil
+}
+
+func (b *AltBeacon) Bytes() ([]byte, error) {
+	data := []byte{byte(b.CompanyId), byte(b.CompanyId >> 8), 0xBE, 0xAC}
+	data = append(data, b.ID[:]...)
+	data = append(data, byte(b.ReferenceRSSI), b.Reserved)
+	return data, nil
+}
+
+func (b *EddystoneUID) Bytes() ([]byte, error) {
+	data := []byte{EddystoneUIDFrame, byte(b.TxPower)}
+	data = append(data, b.Namespace[:]...)
+	data = append(data, b.Instance[:]...)
+	data = append(data, 0, 0) // reserved
+	return data, nil
+}
+
+func (b *EddystoneURL) Bytes() ([]byte, error) {
+	url, err := encodeURL(b.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{EddystoneURLFrame, byte(b.TxPower)}, url...), nil
+}
+
+func (b *EddystoneTLM) Bytes() ([]byte, error) {
+	if b.Version != 0 {
+		return nil, fmt.Errorf("%v: unsupported TLM version %v", INVALID_FRAME, b.Version)
+	}
+
+	if b.Temperature < -128 || b.Temperature >= 128 {
+		return nil, fmt.Errorf("%v: temperature %v out of range", INVALID_FRAME, b.Temperature)
+	}
+
+	data := make([]byte, 14)
+	data[0] = EddystoneTLMFrame
+	binary.BigEndian.PutUint16(data[2:], b.Battery)
+	binary.BigEndian.PutUint16(data[4:], uint16(int16(b.Temperature*256)))
+	binary.BigEndian.PutUint32(data[6:], b.AdvCount)
+	binary.BigEndian.PutUint32(data[10:], b.SecCount)
+	return data, nil
+}
+
+func (b *EddystoneEID) Bytes() ([]byte, error) {
+	return append([]byte{EddystoneEIDFrame, byte(b.TxPower)}, b.EID[:]...), nil
+}
+
+// AdvertisingData returns the advertising data for the beacon
+// (flags, plus the manufacturer data or the Eddystone service UUID and service data).
+// It returns adv.TOO_LONG if the beacon frame doesn't fit.
+func AdvertisingData(b Beacon) (*adv.AdvertisingData, error) {
+	data, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	ad := &adv.AdvertisingData{Flags: adv.FlagGeneralDiscoverable | adv.FlagBREDRNotSupported}
+
+	switch b.(type) {
+	case *IBeacon, *AltBeacon:
+		ad.ManufacturerData = data
+
+	default:
+		ad.ServiceUuids = []string{EddystoneUuid}
+		ad.ServiceData = []adv.ServiceData{{Uuid: EddystoneUuid, Data: data}}
+	}
+
+	if _, err := ad.Bytes(); err != nil {
+		return nil, err
+	}
+
+	return ad, nil
+}
+
+// the Eddystone-URL scheme prefixes
+var urlSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+
+// the Eddystone-URL expansions (by code)
+var urlExpansions = []string{
+	".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+	".com", ".org", ".edu", ".net", ".info", ".biz", ".gov",
+}
+
+// decode an Eddystone-URL (scheme code followed by the encoded URL)
+func decodeURL(data []byte) (string, error) {
+	if int(data[0]) >= len(urlSchemes) {
+		return "", fmt.Errorf("%v: unknown URL scheme 0x%02x", INVALID_FRAME, data[0])
+	}
+
+	url := urlSchemes[data[0]]
+
+	for _, c := range data[1:] {
+		switch {
+		case int(c) < len(urlExpansions):
+			url += urlExpansions[c]
+
+		case c > 0x20 && c < 0x7f:
+			url += string(c)
+
+		default:
+			return "", fmt.Errorf("%v: invalid URL character 0x%02x", INVALID_FRAME, c)
+		}
+	}
+
+	return url, nil
+}
+
+// the maximum length of the encoded Eddystone-URL (scheme included)
+const maxURLLength = 18
+
+// encode an Eddystone-URL, compressing the scheme and the expansions
+func encodeURL(url string) ([]byte, error) {
+	var data []byte
+
+	// longest scheme first
+	for _, i := range []int{1, 0, 3, 2} {
+		if strings.HasPrefix(url, urlSchemes[i]) {
+			data = append(data, byte(i))
+			url = url[len(urlSchemes[i]):]
+			break
+		}
+	}
+
+	if data == nil {
+		return nil, fmt.Errorf("%v: unsupported URL scheme %q", INVALID_FRAME, url)
+	}
+
+encode:
+	for len(url) > 0 {
+		// the expansions ending with "/" are longer than the others
+		for c, exp := range urlExpansions {
+			if strings.HasPrefix(url, exp) {
+				data = append(data, byte(c))
+				url = url[len(exp):]
+				continue encode
+			}
+		}
+
+		if url[0] <= 0x20 || url[0] >= 0x7f {
+			return nil, fmt.Errorf("%v: invalid URL character %q", INVALID_FRAME, url[0])
+		}
+
+		data = append(data, url[0])
+		url = url[1:]
+	}
+
+	if len(data) > maxURLLength {
+		return nil, fmt.Errorf("%v: encoded URL is %v bytes (max %v)", INVALID_FRAME, len(data), maxURLLength)
+	}
+
+	return data, nil
+}
+
+// true if the uuid is the Eddystone service (16 or 128 bit)
+func isEddystone(uuid string) bool {
+	uuid = strings.ToLower(strings.Replace(uuid, "-", "", -1))
+	return uuid == EddystoneUuid || uuid == "0000"+EddystoneUuid+"00001000800000805f9b34fb"
+}
+
+func invalidFrame(name string, data []byte) error {
+	return fmt.Errorf("%v: %v %v", INVALID_FRAME, name, hex.EncodeToString(data))
+}
@@ -0,0 +1,166 @@
+package beacon
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/raff/goble/xpc"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func TestFromManufacturerData(t *testing.T) {
+	tests := []struct {
+		data   string
+		beacon Beacon
+	}{
+		{"4c000215e2c56db5dffb48d2b060d0f5a71096e000010002c5",
+			&IBeacon{UUID: xpc.MustUUID("e2c56db5-dffb-48d2-b060-d0f5a71096e0"), Major: 1, Minor: 2, MeasuredPower: -59}},
+		{"1801beac2f234454cf6d4a0fadf2f4911ba9ffa600010002c500",
+			&AltBeacon{CompanyId: 0x0118, ID: [20]byte{0x2f, 0x23, 0x44, 0x54, 0xcf, 0x6d, 0x4a, 0x0f, 0xad, 0xf2, 0xf4, 0x91, 0x1b, 0xa9, 0xff, 0xa6, 0x00, 0x01, 0x00, 0x02}, ReferenceRSSI: -59}},
+	}
+
+	for _, test := range tests {
+		b, err := FromManufacturerData(mustHex(test.data))
+		if err != nil {
+			t.Errorf("%v: %v\n", test.data, err)
+		} else if !reflect.DeepEqual(b, test.beacon) {
+			t.Errorf("expected %#v got %#v\n", test.beacon, b)
+		}
+	}
+}
+
+func TestFromServiceData(t *testing.T) {
+	tests := []struct {
+		uuid   string
+		data   string
+		beacon Beacon
+	}{
+		{"feaa", "00e7edd1ebeac04e5defa0170bdb87539b670000",
+			&EddystoneUID{TxPower: -25, Namespace: [10]byte{0xed, 0xd1, 0xeb, 0xea, 0xc0, 0x4e, 0x5d, 0xef, 0xa0, 0x17}, Instance: [6]byte{0x0b, 0xdb, 0x87, 0x53, 0x9b, 0x67}}},
+		{"feaa", "00e7edd1ebeac04e5defa0170bdb87539b67",
+			&EddystoneUID{TxPower: -25, Namespace: [10]byte{0xed, 0xd1, 0xeb, 0xea, 0xc0, 0x4e, 0x5d, 0xef, 0xa0, 0x17}, Instance: [6]byte{0x0b, 0xdb, 0x87, 0x53, 0x9b, 0x67}}},
+		{"feaa", "10eb03676f6f676c6507",
+			&EddystoneURL{TxPower: -21, URL: "https://google.com"}},
+		{"0000feaa-0000-1000-8000-00805f9b34fb", "10eb00676f6f2e676c2f61626300",
+			&EddystoneURL{TxPower: -21, URL: "http://www.goo.gl/abc.com/"}},
+		{"feaa", "20000bb817800000006400002710",
+			&EddystoneTLM{Battery: 3000, Temperature: 23.5, AdvCount: 100, SecCount: 10000}},
+		{"feaa", "30e70102030405060708",
+			&EddystoneEID{TxPower: -25, EID: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+	}
+
+	for _, test := range tests {
+		b, err := FromServiceData(test.uuid, mustHex(test.data))
+		if err != nil {
+			t.Errorf("%v: %v\n", test.data, err)
+		} else if !reflect.DeepEqual(b, test.beacon) {
+			t.Errorf("expected %#v got %#v\n", test.beacon, b)
+		}
+	}
+}
+
+func TestInvalidFrames(t *testing.T) {
+	tests := []struct {
+		uuid string // empty for manufacturer data
+		data string
+		err  error
+	}{
+		{"", "4c00", NOT_A_BEACON},
+		{"", "4c000215e2c56db5dffb48d2b060d0f5a71096e000010002", INVALID_FRAME}, // truncated iBeacon
+		{"", "4c001005031c", NOT_A_BEACON},                                      // Apple nearby info
+		{"", "1801beac2f234454cf6d4a0fadf2f4911ba9ffa600010002c5", INVALID_FRAME},
+		{"180f", "64", NOT_A_BEACON},
+		{"feaa", "", INVALID_FRAME},
+		{"feaa", "10eb09676f6f676c65", INVALID_FRAME},                 // unknown scheme
+		{"feaa", "10eb03676f6f10676c65", INVALID_FRAME},               // invalid character
+		{"feaa", "20010102030405060708090a0b0c", INVALID_FRAME},       // encrypted TLM
+		{"feaa", "40e70102030405060708", INVALID_FRAME},               // unknown frame
+		{"feaa", "00e7edd1ebeac04e5defa0170bdb87539b", INVALID_FRAME}, // short UID
+	}
+
+	for _, test := range tests {
+		var b Beacon
+		var err error
+
+		if test.uuid == "" {
+			b, err = FromManufacturerData(mustHex(test.data))
+		} else {
+			b, err = FromServiceData(test.uuid, mustHex(test.data))
+		}
+
+		if err == nil {
+			t.Errorf("%v: expected error got %#v\n", test.data, b)
+		} else if err != test.err && !strings.HasPrefix(err.Error(), test.err.Error()) {
+			t.Errorf("%v: expected %v got %v\n", test.data, test.err, err)
+		}
+	}
+}
+
+func TestEncodeURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		encoded string
+	}{
+		{"https://google.com", "03676f6f676c6507"},
+		{"http://www.goo.gl/abc.com/", "00676f6f2e676c2f61626300"},
+		{"https://www.example.info/x", "016578616d706c650478"},
+		{"http://a.b", "02612e62"},
+	}
+
+	for _, test := range tests {
+		data, err := encodeURL(test.url)
+		if err != nil {
+			t.Errorf("%v: %v\n", test.url, err)
+		} else if enc := hex.EncodeToString(data); enc != test.encoded {
+			t.Errorf("expected %v got %v\n", test.encoded, enc)
+		}
+	}
+
+	for _, url := range []string{"ftp://a.b", "https://a b", "https://example.com/1234567890"} {
+		if data, err := encodeURL(url); err == nil {
+			t.Errorf("%v: expected error got %x\n", url, data)
+		}
+	}
+}
+
+func TestBeaconRoundTrip(t *testing.T) {
+	beacons := []Beacon{
+		&IBeacon{UUID: xpc.MustUUID("e2c56db5-dffb-48d2-b060-d0f5a71096e0"), Major: 1, Minor: 2, MeasuredPower: -59},
+		&AltBeacon{CompanyId: 0x0118, ID: [20]byte{1, 2, 3}, ReferenceRSSI: -59, Reserved: 1},
+		&EddystoneUID{TxPower: -25, Namespace: [10]byte{1}, Instance: [6]byte{2}},
+		&EddystoneURL{TxPower: -21, URL: "https://goo.gl/abc"},
+		&EddystoneTLM{Battery: 3000, Temperature: -10.25, AdvCount: 1, SecCount: 2},
+		&EddystoneEID{TxPower: -25, EID: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+
+	for _, b := range beacons {
+		ad, err := AdvertisingData(b)
+		if err != nil {
+			t.Errorf("%v: %v\n", b.Type(), err)
+			continue
+		}
+
+		var decoded Beacon
+		if ad.ManufacturerData != nil {
+			decoded, err = FromManufacturerData(ad.ManufacturerData)
+		} else {
+			decoded, err = FromServiceData(ad.ServiceData[0].Uuid, ad.ServiceData[0].Data)
+		}
+
+		if err != nil {
+			t.Errorf("%v: %v\n", b.Type(), err)
+		} else if !reflect.DeepEqual(b, decoded) {
+			t.Errorf("expected %#v got %#v\n", b, decoded)
+		}
+	}
+}
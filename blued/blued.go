@@ -0,0 +1,459 @@
+// Package blued implements a simulator of the OSX Bluetooth daemon (blued),
+// that can be used as a goble.Transport to test goble applications without radio hardware.
+//
+// The simulator understands the messages sent by goble (for the emulated OS release)
+// and replies with the same events blued would send, based on a description of virtual peripherals:
+//
+//	sim := blued.New("19.6.0", &blued.Peripheral{
+//		UUID: xpc.MustUUID("00112233-4455-6677-8899-aabbccddeeff"),
+//		Name: "thermometer",
+//		Connectable: true,
+//		Services: []*blued.Service{
+//			{UUID: "180f", Characteristics: []*blued.Characteristic{
+//				{UUID: "2a19", Properties: blued.Read, Value: []byte{100}},
+//			}},
+//		},
+//	})
+//
+//	ble := goble.NewWithTransport(sim)
+package blued
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/raff/goble/xpc"
+)
+
+// characteristic properties (as reported by blued)
+const (
+	Broadcast                 = 0x01
+	Read                      = 0x02
+	WriteWithoutResponse      = 0x04
+	Write                     = 0x08
+	Notify                    = 0x10
+	Indicate                  = 0x20
+	AuthenticatedSignedWrites = 0x40
+	ExtendedProperties        = 0x80
+)
+
+// ATT result codes
+const (
+	ResultSuccess           = 0x00
+	ResultInvalidHandle     = 0x01
+	ResultReadNotPermitted  = 0x02
+	ResultWriteNotPermitted = 0x03
+)
+
+// STATE_POWERED_ON is the adapter state reported after "init"
+const STATE_POWERED_ON = 5
+
+// Simulator emulates blued on a specific OS release (it implements goble.Transport)
+type Simulator struct {
+	release     string
+	commands    map[int][]string
+	events      map[string]int
+	peripherals map[xpc.UUID]*Peripheral
+	order       []*Peripheral
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	handler xpc.XpcEventHandler
+	queue   []xpc.Dict
+	sent    []xpc.Dict
+	closed  bool
+}
+
+// New creates a Simulator for the specified OS release (i.e. "19.6.0"), with the specified peripherals
+func New(release string, peripherals ...*Peripheral) *Simulator {
+	sim := &Simulator{
+		release:     release,
+		commands:    commandsFor(release),
+		events:      eventsFor(release),
+		peripherals: map[xpc.UUID]*Peripheral{},
+		order:       peripherals,
+	}
+
+	sim.cond = sync.NewCond(&sim.lock)
+
+	for _, p := range peripherals {
+		p.assignHandles()
+		sim.peripherals[p.UUID] = p
+	}
+
+	return sim
+}
+
+// Release returns the emulated OS release
+func (sim *Simulator) Release() string {
+	return sim.release
+}
+
+// SetEventHandler starts delivering events to eh.
+// As with XPC, events are delivered asynchronously, from a separate goroutine.
+func (sim *Simulator) SetEventHandler(eh xpc.XpcEventHandler) {
+	sim.lock.Lock()
+	sim.handler = eh
+	sim.lock.Unlock()
+
+	go sim.deliver()
+}
+
+// Close stops the delivery of events
+func (sim *Simulator) Close() error {
+	sim.lock.Lock()
+	sim.closed = true
+	sim.cond.Broadcast()
+	sim.lock.Unlock()
+	return nil
+}
+
+// Sent returns the messages received by the simulator so far
+func (sim *Simulator) Sent() []xpc.Dict {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return append([]xpc.Dict{}, sim.sent...)
+}
+
+// Send receives a message from goble and replies with the appropriate events
+func (sim *Simulator) Send(msg xpc.Dict, verbose bool) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	sim.sent = append(sim.sent, msg)
+
+	id, _ := msg["kCBMsgId"].(int)
+	args, _ := msg["kCBMsgArgs"].(xpc.Dict)
+	if args == nil {
+		args = xpc.Dict{}
+	}
+
+	switch sim.command(id, args) {
+	case "init":
+		sim.emit("stateChange", xpc.Dict{"kCBMsgArgState": STATE_POWERED_ON})
+
+	case "addService":
+		sim.emit("serviceAdded", xpc.Dict{"kCBMsgArgAttributeID": args["kCBMsgArgAttributeID"], "kCBMsgArgResult": ResultSuccess})
+
+	case "startScanning":
+		uuids, _ := args["kCBMsgArgUUIDs"].([]string)
+
+		for _, p := range sim.order {
+			if p.advertises(uuids) {
+				sim.emit("discover", p.discoverArgs())
+			}
+		}
+
+	case "connect":
+		if p := sim.peripheral(args); p != nil && p.Connectable {
+			p.connected = true
+			sim.emit("connect", xpc.Dict{"kCBMsgArgDeviceUUID": p.UUID})
+		}
+
+	case "disconnect":
+		if p := sim.peripheral(args); p != nil {
+			p.connected = false
+			sim.emit("disconnect", xpc.Dict{"kCBMsgArgDeviceUUID": p.UUID})
+		}
+
+	case "updateRssi":
+		if p := sim.connected(args); p != nil {
+			sim.emit("rssiUpdate", xpc.Dict{"kCBMsgArgDeviceUUID": p.UUID, "kCBMsgArgData": p.Rssi})
+		}
+
+	case "discoverServices":
+		if p := sim.connected(args); p != nil {
+			services := xpc.Array{}
+
+			for _, s := range p.Services {
+				services = append(services, xpc.Dict{
+					"kCBMsgArgUUID":               uuidBytes(s.UUID),
+					"kCBMsgArgServiceStartHandle": s.startHandle,
+					"kCBMsgArgServiceEndHandle":   s.endHandle,
+				})
+			}
+
+			sim.emit("servicesDiscover", xpc.Dict{"kCBMsgArgDeviceUUID": p.UUID, "kCBMsgArgServices": services, "kCBMsgArgResult": ResultSuccess})
+		}
+
+	case "discoverCharacteristics":
+		if p := sim.connected(args); p != nil {
+			startHandle, _ := args["kCBMsgArgServiceStartHandle"].(int)
+			characteristics := xpc.Array{}
+
+			if s := p.service(startHandle); s != nil {
+				for _, c := range s.Characteristics {
+					characteristics = append(characteristics, xpc.Dict{
+						"kCBMsgArgUUID":                      uuidBytes(c.UUID),
+						"kCBMsgArgCharacteristicHandle":      c.handle,
+						"kCBMsgArgCharacteristicValueHandle": c.valueHandle,
+						"kCBMsgArgCharacteristicProperties":  c.Properties,
+					})
+				}
+			}
+
+			sim.emit("characteristicsDiscover", xpc.Dict{
+				"kCBMsgArgDeviceUUID":         p.UUID,
+				"kCBMsgArgServiceStartHandle": startHandle,
+				"kCBMsgArgCharacteristics":    characteristics,
+				"kCBMsgArgResult":             ResultSuccess,
+			})
+		}
+
+	case "discoverDescriptors":
+		if p := sim.connected(args); p != nil {
+			handle, _ := args["kCBMsgArgCharacteristicHandle"].(int)
+			descriptors := xpc.Array{}
+
+			if c := p.characteristic(handle); c != nil {
+				for _, d := range c.Descriptors {
+					descriptors = append(descriptors, xpc.Dict{
+						"kCBMsgArgUUID":             uuidBytes(d.UUID),
+						"kCBMsgArgDescriptorHandle": d.handle,
+					})
+				}
+			}
+
+			sim.emit("descriptorsDiscover", xpc.Dict{
+				"kCBMsgArgDeviceUUID":           p.UUID,
+				"kCBMsgArgCharacteristicHandle": handle,
+				"kCBMsgArgDescriptors":          descriptors,
+				"kCBMsgArgResult":               ResultSuccess,
+			})
+		}
+
+	case "read":
+		if p := sim.connected(args); p != nil {
+			handle, _ := args["kCBMsgArgCharacteristicHandle"].(int)
+			result, data := ResultInvalidHandle, []byte{}
+
+			if c := p.characteristic(handle); c != nil {
+				if c.Properties&Read != 0 {
+					result, data = ResultSuccess, c.Value
+				} else {
+					result = ResultReadNotPermitted
+				}
+			}
+
+			sim.emit("read", xpc.Dict{
+				"kCBMsgArgDeviceUUID":           p.UUID,
+				"kCBMsgArgCharacteristicHandle": handle,
+				"kCBMsgArgData":                 data,
+				"kCBMsgArgIsNotification":       0,
+				"kCBMsgArgResult":               result,
+			})
+		}
+
+	case "write":
+		if p := sim.connected(args); p != nil {
+			handle, _ := args["kCBMsgArgCharacteristicHandle"].(int)
+			withoutResponse, _ := args["kCBMsgArgType"].(int)
+			data, _ := args["kCBMsgArgData"].([]byte)
+			result := ResultInvalidHandle
+
+			if c := p.characteristic(handle); c != nil {
+				if c.Properties&(Write|WriteWithoutResponse) != 0 {
+					result = ResultSuccess
+					c.Value = append([]byte{}, data...)
+				} else {
+					result = ResultWriteNotPermitted
+				}
+			}
+
+			if withoutResponse == 0 {
+				sim.emit("write", xpc.Dict{
+					"kCBMsgArgDeviceUUID":           p.UUID,
+					"kCBMsgArgCharacteristicHandle": handle,
+					"kCBMsgArgResult":               result,
+				})
+			}
+		}
+
+	case "notify":
+		if p := sim.connected(args); p != nil {
+			handle, _ := args["kCBMsgArgCharacteristicHandle"].(int)
+			state, _ := args["kCBMsgArgState"].(int)
+
+			if c := p.characteristic(handle); c != nil {
+				c.notifying = state != 0
+
+				sim.emit("notify", xpc.Dict{
+					"kCBMsgArgDeviceUUID":           p.UUID,
+					"kCBMsgArgCharacteristicHandle": c.handle,
+					"kCBMsgArgState":                state,
+					"kCBMsgArgResult":               ResultSuccess,
+				})
+			}
+		}
+
+	case "readDescriptor":
+		if p := sim.connected(args); p != nil {
+			handle, _ := args["kCBMsgArgDescriptorHandle"].(int)
+			result, data := ResultInvalidHandle, []byte{}
+
+			if d := p.descriptor(handle); d != nil {
+				result, data = ResultSuccess, d.Value
+			}
+
+			sim.emit("valueRead", xpc.Dict{
+				"kCBMsgArgDeviceUUID":       p.UUID,
+				"kCBMsgArgDescriptorHandle": handle,
+				"kCBMsgArgData":             data,
+				"kCBMsgArgResult":           result,
+			})
+		}
+
+	case "writeDescriptor":
+		if p := sim.connected(args); p != nil {
+			handle, _ := args["kCBMsgArgDescriptorHandle"].(int)
+			data, _ := args["kCBMsgArgData"].([]byte)
+			result := ResultInvalidHandle
+
+			if d := p.descriptor(handle); d != nil {
+				result = ResultSuccess
+				d.Value = append([]byte{}, data...)
+			}
+
+			sim.emit("valueWrite", xpc.Dict{
+				"kCBMsgArgDeviceUUID":       p.UUID,
+				"kCBMsgArgDescriptorHandle": handle,
+				"kCBMsgArgResult":           result,
+			})
+		}
+	}
+}
+
+// Notify sends a notification for the specified characteristic, if notifications have been enabled
+func (sim *Simulator) Notify(deviceUuid xpc.UUID, characteristicUuid string, data []byte) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	p := sim.peripherals[deviceUuid]
+	if p == nil || !p.connected {
+		return
+	}
+
+	for _, s := range p.Services {
+		for _, c := range s.Characteristics {
+			if c.UUID == characteristicUuid && c.notifying {
+				sim.emit("read", xpc.Dict{
+					"kCBMsgArgDeviceUUID":           p.UUID,
+					"kCBMsgArgCharacteristicHandle": c.valueHandle,
+					"kCBMsgArgData":                 data,
+					"kCBMsgArgIsNotification":       1,
+					"kCBMsgArgResult":               ResultSuccess,
+				})
+			}
+		}
+	}
+}
+
+// Disconnect simulates a disconnection initiated by the peripheral
+func (sim *Simulator) Disconnect(deviceUuid xpc.UUID) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	if p := sim.peripherals[deviceUuid]; p != nil && p.connected {
+		p.connected = false
+		sim.emit("disconnect", xpc.Dict{"kCBMsgArgDeviceUUID": p.UUID})
+	}
+}
+
+// command returns the name of the command with the specified id.
+//
+// Some releases use the same id for different commands, in which case
+// the command is selected based on the presence of a device UUID.
+func (sim *Simulator) command(id int, args xpc.Dict) string {
+	names := sim.commands[id]
+	if len(names) == 1 {
+		return names[0]
+	}
+
+	_, hasDevice := args["kCBMsgArgDeviceUUID"]
+
+	for _, name := range names {
+		if deviceCommands[name] == hasDevice {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// peripheral returns the peripheral referenced by the message arguments
+func (sim *Simulator) peripheral(args xpc.Dict) *Peripheral {
+	uuid, _ := args["kCBMsgArgDeviceUUID"].(xpc.UUID)
+	return sim.peripherals[uuid]
+}
+
+// connected returns the peripheral referenced by the message arguments, if connected
+func (sim *Simulator) connected(args xpc.Dict) *Peripheral {
+	if p := sim.peripheral(args); p != nil && p.connected {
+		return p
+	}
+
+	return nil
+}
+
+// emit queues an event (must be called with sim.lock held)
+func (sim *Simulator) emit(name string, args xpc.Dict) {
+	event := xpc.Dict{"kCBMsgId": int64(sim.events[name]), "kCBMsgArgs": toXpc(args)}
+	sim.queue = append(sim.queue, event)
+	sim.cond.Signal()
+}
+
+// deliver sends the queued events to the event handler
+func (sim *Simulator) deliver() {
+	for {
+		sim.lock.Lock()
+		for len(sim.queue) == 0 && !sim.closed {
+			sim.cond.Wait()
+		}
+
+		if sim.closed {
+			sim.lock.Unlock()
+			return
+		}
+
+		event := sim.queue[0]
+		sim.queue = sim.queue[1:]
+		handler := sim.handler
+		sim.lock.Unlock()
+
+		handler.HandleXpcEvent(event, nil)
+	}
+}
+
+// uuidBytes converts an hex encoded UUID to bytes
+func uuidBytes(uuid string) []byte {
+	b, _ := hex.DecodeString(strings.Replace(uuid, "-", "", -1))
+	return b
+}
+
+// toXpc converts a value to what would be received from XPC (ints are int64, byte slices are copied)
+func toXpc(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case int:
+		return int64(tv)
+
+	case []byte:
+		return append([]byte{}, tv...)
+
+	case xpc.Dict:
+		d := xpc.Dict{}
+		for k, v := range tv {
+			d[k] = toXpc(v)
+		}
+		return d
+
+	case xpc.Array:
+		a := make(xpc.Array, len(tv))
+		for i, v := range tv {
+			a[i] = toXpc(v)
+		}
+		return a
+	}
+
+	return v
+}
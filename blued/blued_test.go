@@ -0,0 +1,227 @@
+package blued_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/raff/goble"
+	"github.com/raff/goble/blued"
+	"github.com/raff/goble/xpc"
+)
+
+var releases = []string{"13.4.0", "17.7.0", "18.7.0", "19.0.0", "19.6.0"}
+
+func heartRateMonitor() *blued.Peripheral {
+	return &blued.Peripheral{
+		UUID:            xpc.MustUUID("00112233-4455-6677-8899-aabbccddeeff"),
+		Name:            "HRM",
+		Rssi:            -60,
+		Connectable:     true,
+		AdvertisedUuids: []string{"180d"},
+		Services: []*blued.Service{
+			{UUID: "180d", Characteristics: []*blued.Characteristic{
+				{UUID: "2a37", Properties: blued.Notify, Descriptors: []*blued.Descriptor{
+					{UUID: "2901", Value: []byte("Heart Rate")},
+				}},
+				{UUID: "2a38", Properties: blued.Read, Value: []byte{0x01}},
+				{UUID: "2a39", Properties: blued.Write},
+			}},
+			{UUID: "180f", Characteristics: []*blued.Characteristic{
+				{UUID: "2a19", Properties: blued.Read | blued.Notify, Value: []byte{99}},
+			}},
+		},
+	}
+}
+
+// events collects the goble events into a channel
+func events(ble *goble.BLE, names ...string) chan goble.Event {
+	ch := make(chan goble.Event, 16)
+
+	for _, name := range names {
+		ble.On(name, func(ev goble.Event) bool {
+			ch <- ev
+			return false
+		})
+	}
+
+	return ch
+}
+
+func expect(t *testing.T, release string, ch chan goble.Event, name string) goble.Event {
+	select {
+	case ev := <-ch:
+		if ev.Name != name {
+			t.Fatalf("%v: expected %q event got %#v", release, name, ev)
+		}
+		return ev
+
+	case <-time.After(time.Second):
+		t.Fatalf("%v: timeout waiting for %q", release, name)
+	}
+
+	return goble.Event{}
+}
+
+func TestExplore(t *testing.T) {
+	for _, release := range releases {
+		hrm := heartRateMonitor()
+		sim := blued.New(release, hrm)
+
+		ble := goble.NewWithTransport(sim)
+		ch := events(ble, "stateChange", "discover", "connect", "servicesDiscover",
+			"characteristicsDiscover", "descriptorsDiscover", "read", "valueRead", "disconnect")
+
+		ble.Init()
+		if ev := expect(t, release, ch, "stateChange"); ev.State != "poweredOn" {
+			t.Fatalf("%v: expected poweredOn got %v", release, ev.State)
+		}
+
+		ble.StartScanning(nil, false)
+		ev := expect(t, release, ch, "discover")
+		if ev.DeviceUUID != hrm.UUID || ev.Peripheral.Advertisement.LocalName != "HRM" || !ev.Peripheral.Connectable {
+			t.Errorf("%v: unexpected discover %#v", release, ev)
+		}
+		if uuids := ev.Peripheral.Advertisement.ServiceUuids; len(uuids) != 1 || uuids[0] != "180d" {
+			t.Errorf("%v: unexpected advertised services %v", release, uuids)
+		}
+		ble.StopScanning()
+
+		ble.Connect(hrm.UUID)
+		expect(t, release, ch, "connect")
+
+		ble.DiscoverServices(hrm.UUID, nil)
+		ev = expect(t, release, ch, "servicesDiscover")
+		if _, ok := ev.Peripheral.Services["180f"]; !ok {
+			t.Fatalf("%v: missing battery service %#v", release, ev.Peripheral.Services)
+		}
+
+		ble.DiscoverCharacteristics(hrm.UUID, "180f", nil)
+		ev = expect(t, release, ch, "characteristicsDiscover")
+		c := ev.Peripheral.Services["180f"].Characteristics["2a19"]
+		if c == nil || c.Properties != goble.Read|goble.Notify {
+			t.Fatalf("%v: unexpected battery level characteristic %#v", release, c)
+		}
+
+		ble.Read(hrm.UUID, "180f", "2a19")
+		if ev = expect(t, release, ch, "read"); !bytes.Equal(ev.Data, []byte{99}) {
+			t.Errorf("%v: expected battery level 99 got %v", release, ev.Data)
+		}
+
+		ble.DiscoverCharacteristics(hrm.UUID, "180d", nil)
+		expect(t, release, ch, "characteristicsDiscover")
+
+		ble.DiscoverDescriptors(hrm.UUID, "180d", "2a37")
+		ev = expect(t, release, ch, "descriptorsDiscover")
+		d := ev.Peripheral.Services["180d"].Characteristics["2a37"].Descriptors["2901"]
+		if d == nil {
+			t.Fatalf("%v: missing user description descriptor", release)
+		}
+
+		ble.ReadDescriptor(hrm.UUID, d.Handle)
+		if ev = expect(t, release, ch, "valueRead"); string(ev.Data) != "Heart Rate" {
+			t.Errorf("%v: expected user description got %q", release, ev.Data)
+		}
+
+		ble.Disconnect(hrm.UUID)
+		expect(t, release, ch, "disconnect")
+
+		sim.Close()
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	for _, release := range releases {
+		hrm := heartRateMonitor()
+		sim := blued.New(release, hrm)
+
+		ble := goble.NewWithTransport(sim)
+		ch := events(ble, "discover", "connect", "servicesDiscover", "characteristicsDiscover",
+			"write", "notify", "notification", "disconnect")
+
+		ble.StartScanning(nil, false)
+		expect(t, release, ch, "discover")
+
+		ble.Connect(hrm.UUID)
+		expect(t, release, ch, "connect")
+
+		ble.DiscoverServices(hrm.UUID, nil)
+		expect(t, release, ch, "servicesDiscover")
+
+		ble.DiscoverCharacteristics(hrm.UUID, "180d", nil)
+		expect(t, release, ch, "characteristicsDiscover")
+
+		ble.Write(hrm.UUID, "180d", "2a39", []byte{0x01}, false)
+		if ev := expect(t, release, ch, "write"); ev.Result != blued.ResultSuccess {
+			t.Errorf("%v: expected successful write got %v", release, ev.Result)
+		}
+
+		ble.Notify(hrm.UUID, "180d", "2a37", true)
+		if ev := expect(t, release, ch, "notify"); !ev.Notifying {
+			t.Errorf("%v: expected notifications to be enabled", release)
+		}
+
+		sim.Notify(hrm.UUID, "2a37", []byte{0x00, 0x48})
+		if ev := expect(t, release, ch, "notification"); ev.CharacteristicUuid != "2a37" || !bytes.Equal(ev.Data, []byte{0x00, 0x48}) {
+			t.Errorf("%v: unexpected notification %#v", release, ev)
+		}
+
+		sim.Disconnect(hrm.UUID)
+		expect(t, release, ch, "disconnect")
+
+		sim.Close()
+	}
+}
+
+func TestScanPeripherals(t *testing.T) {
+	hrm := heartRateMonitor()
+	other := &blued.Peripheral{UUID: xpc.MustUUID("ffeeddccbbaa99887766554433221100"), Name: "other", AdvertisedUuids: []string{"1809"}}
+	sim := blued.New("19.6.0", hrm, other)
+	defer sim.Close()
+
+	ble := goble.NewWithTransport(sim)
+	ch := events(ble, "discover")
+
+	ble.StartScanning(nil, false)
+	expect(t, "19.6.0", ch, "discover")
+	if ev := expect(t, "19.6.0", ch, "discover"); ev.DeviceUUID != other.UUID || ev.Peripheral.Connectable {
+		t.Errorf("unexpected discover %#v", ev)
+	}
+
+	sent := sim.Sent()
+	if len(sent) != 1 || sent[0]["kCBMsgId"] != 53 {
+		t.Errorf("expected scan message (53) got %#v", sent)
+	}
+}
+
+func TestServices(t *testing.T) {
+	for _, release := range releases {
+		sim := blued.New(release)
+
+		ble := goble.NewWithTransport(sim)
+		ch := events(ble, "serviceAdded", "servicesSet")
+
+		hrs := goble.NewService("180d")
+		hrs.AddCharacteristic("2a37", goble.Notify, 0)
+
+		bas := goble.NewService("180f")
+		bas.AddCharacteristic("2a19", goble.Read, goble.Readable).SetValue([]byte{99})
+
+		if err := ble.SetServices([]*goble.Service{hrs, bas}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, uuid := range []string{"180d", "180f"} {
+			if ev := expect(t, release, ch, "serviceAdded"); ev.ServiceUuid != uuid || ev.Err != nil {
+				t.Errorf("%v: unexpected serviceAdded %#v", release, ev)
+			}
+		}
+
+		ev := expect(t, release, ch, "servicesSet")
+		if ev.Err != nil || len(ev.ServiceErrors) != 2 {
+			t.Errorf("%v: unexpected servicesSet %#v", release, ev)
+		}
+
+		sim.Close()
+	}
+}
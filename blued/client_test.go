@@ -0,0 +1,188 @@
+package blued_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/raff/goble"
+	"github.com/raff/goble/blued"
+	"github.com/raff/goble/xpc"
+)
+
+const (
+	clientService        = "180d"
+	clientCharacteristic = "2a39"
+	clientDescriptor     = "2901"
+)
+
+var clientDevice = xpc.MakeUUID("00112233445566778899aabbccddeeff")
+
+func newClientSimulator() (*blued.Simulator, *blued.Peripheral) {
+	p := &blued.Peripheral{
+		UUID:        clientDevice,
+		Name:        "HRM",
+		Connectable: true,
+		Services: []*blued.Service{
+			{UUID: clientService, Characteristics: []*blued.Characteristic{
+				{UUID: "2a37", Properties: blued.Notify},
+				{UUID: "2a38", Properties: blued.Read, Value: []byte{0x01}},
+				{UUID: clientCharacteristic, Properties: blued.Write, Descriptors: []*blued.Descriptor{
+					{UUID: clientDescriptor, Value: []byte("Control Point")},
+				}},
+			}},
+		},
+	}
+
+	return blued.New("19.6.0", p), p
+}
+
+func TestClient(t *testing.T) {
+	sim, p := newClientSimulator()
+	defer sim.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := goble.NewClient(goble.NewWithTransport(sim))
+
+	if err := client.Init(ctx); err != nil {
+		t.Fatal("Init:", err)
+	}
+
+	if peripheral, err := client.FindPeripheral(ctx, p.UUID, nil, false); err != nil {
+		t.Fatal("FindPeripheral:", err)
+	} else if peripheral.Advertisement.LocalName != "HRM" {
+		t.Errorf("expected HRM got %#v", peripheral)
+	}
+
+	if err := client.Connect(ctx, p.UUID); err != nil {
+		t.Fatal("Connect:", err)
+	}
+
+	services, err := client.DiscoverServices(ctx, p.UUID, nil)
+	if err != nil {
+		t.Fatal("DiscoverServices:", err)
+	}
+	if len(services) != 1 || services[0].Uuid != clientService {
+		t.Fatalf("unexpected services %#v", services)
+	}
+
+	characteristics, err := client.DiscoverCharacteristics(ctx, p.UUID, clientService, nil)
+	if err != nil {
+		t.Fatal("DiscoverCharacteristics:", err)
+	}
+	if len(characteristics) != 3 || characteristics[0].Uuid != "2a37" || characteristics[2].Uuid != clientCharacteristic {
+		t.Fatalf("unexpected characteristics %#v", characteristics)
+	}
+
+	if data, err := client.Read(ctx, p.UUID, clientService, "2a38"); err != nil {
+		t.Error("Read:", err)
+	} else if !bytes.Equal(data, []byte{0x01}) {
+		t.Errorf("expected 01 got %x", data)
+	}
+
+	if err := client.Write(ctx, p.UUID, clientService, clientCharacteristic, []byte{0x02}, false); err != nil {
+		t.Error("Write:", err)
+	}
+
+	if err := client.Write(ctx, p.UUID, clientService, "2a38", []byte{0x02}, false); err == nil {
+		t.Error("expected write error")
+	} else if err != goble.ATTWriteNotPermitted {
+		t.Errorf("expected write not permitted got %v", err)
+	}
+
+	descriptors, err := client.DiscoverDescriptors(ctx, p.UUID, clientService, clientCharacteristic)
+	if err != nil {
+		t.Fatal("DiscoverDescriptors:", err)
+	}
+	if len(descriptors) != 1 || descriptors[0].Uuid != clientDescriptor {
+		t.Fatalf("unexpected descriptors %#v", descriptors)
+	}
+
+	if data, err := client.ReadDescriptor(ctx, p.UUID, descriptors[0].Handle); err != nil {
+		t.Error("ReadDescriptor:", err)
+	} else if string(data) != "Control Point" {
+		t.Errorf("expected Control Point got %q", data)
+	}
+
+	if err := client.Notify(ctx, p.UUID, clientService, "2a37", true); err != nil {
+		t.Error("Notify:", err)
+	}
+
+	if err := client.Disconnect(ctx, p.UUID); err != nil {
+		t.Error("Disconnect:", err)
+	}
+}
+
+func TestFindPeripheralScanning(t *testing.T) {
+	sim, p := newClientSimulator()
+	defer sim.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ble := goble.NewWithTransport(sim)
+	client := goble.NewClient(ble)
+
+	if err := client.Init(ctx); err != nil {
+		t.Fatal("Init:", err)
+	}
+
+	// the scan started by the caller is left alone
+	ble.StartScanning(nil, true)
+
+	if _, err := client.FindPeripheral(ctx, p.UUID, nil, false); err != nil {
+		t.Fatal("FindPeripheral:", err)
+	}
+
+	if !ble.Scanning() {
+		t.Error("expected scanning")
+	}
+
+	if sent := sim.Sent(); len(sent) != 2 {
+		t.Errorf("expected init and startScanning got %#v", sent)
+	}
+}
+
+func TestClientFromHandler(t *testing.T) {
+	sim, p := newClientSimulator()
+	defer sim.Close()
+
+	ble := goble.NewWithTransport(sim)
+	client := goble.NewClient(ble)
+	result := make(chan error, 1)
+
+	ble.On("discover", func(ev goble.Event) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ble.StopScanning()
+
+		err := client.Connect(ctx, ev.DeviceUUID)
+		if err == nil {
+			_, err = client.DiscoverServices(ctx, ev.DeviceUUID, nil)
+		}
+
+		result <- err
+		return false
+	})
+
+	ble.StartScanning(nil, false)
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout calling Client from handler")
+	}
+
+	if peripheral, ok := ble.Peripheral(p.UUID); !ok {
+		t.Errorf("expected peripheral %v", p.UUID)
+	} else if _, ok := peripheral.Services[clientService]; !ok {
+		t.Errorf("expected service %v", clientService)
+	}
+}
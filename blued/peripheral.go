@@ -0,0 +1,165 @@
+package blued
+
+import (
+	"strings"
+
+	"github.com/raff/goble/xpc"
+)
+
+// Descriptor describes a virtual descriptor
+type Descriptor struct {
+	UUID  string // hex encoded UUID (i.e. "2901")
+	Value []byte
+
+	handle int
+}
+
+// Characteristic describes a virtual characteristic
+type Characteristic struct {
+	UUID        string // hex encoded UUID (i.e. "2a19")
+	Properties  int
+	Value       []byte
+	Descriptors []*Descriptor
+
+	handle      int
+	valueHandle int
+	notifying   bool
+}
+
+// Service describes a virtual service
+type Service struct {
+	UUID            string // hex encoded UUID (i.e. "180f")
+	Characteristics []*Characteristic
+
+	startHandle int
+	endHandle   int
+}
+
+// Peripheral describes a virtual peripheral
+type Peripheral struct {
+	UUID             xpc.UUID
+	Name             string
+	Rssi             int
+	TxPowerLevel     int
+	Connectable      bool
+	ManufacturerData []byte
+	ServiceData      map[string][]byte // service data, keyed by hex encoded service UUID
+	AdvertisedUuids  []string          // advertised service UUIDs (hex encoded)
+	Services         []*Service
+
+	connected bool
+}
+
+// assign the attribute handles, as a GATT server would do
+func (p *Peripheral) assignHandles() {
+	handle := 1
+
+	for _, s := range p.Services {
+		s.startHandle = handle
+		handle++
+
+		for _, c := range s.Characteristics {
+			c.handle = handle
+			c.valueHandle = handle + 1
+			handle += 2
+
+			for _, d := range c.Descriptors {
+				d.handle = handle
+				handle++
+			}
+		}
+
+		s.endHandle = handle - 1
+	}
+}
+
+func (p *Peripheral) service(startHandle int) *Service {
+	for _, s := range p.Services {
+		if s.startHandle == startHandle {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (p *Peripheral) characteristic(handle int) *Characteristic {
+	for _, s := range p.Services {
+		for _, c := range s.Characteristics {
+			if c.handle == handle || c.valueHandle == handle {
+				return c
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Peripheral) descriptor(handle int) *Descriptor {
+	for _, s := range p.Services {
+		for _, c := range s.Characteristics {
+			for _, d := range c.Descriptors {
+				if d.handle == handle {
+					return d
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Peripheral) advertises(uuids []string) bool {
+	if len(uuids) == 0 {
+		return true
+	}
+
+	for _, uuid := range uuids {
+		for _, auuid := range p.AdvertisedUuids {
+			if strings.EqualFold(uuid, auuid) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p *Peripheral) discoverArgs() xpc.Dict {
+	advdata := xpc.Dict{}
+
+	if p.Name != "" {
+		advdata["kCBAdvDataLocalName"] = p.Name
+	}
+	if p.TxPowerLevel != 0 {
+		advdata["kCBAdvDataTxPowerLevel"] = p.TxPowerLevel
+	}
+	if p.ManufacturerData != nil {
+		advdata["kCBAdvDataManufacturerData"] = p.ManufacturerData
+	}
+	if p.Connectable {
+		advdata["kCBAdvDataIsConnectable"] = 1
+	} else {
+		advdata["kCBAdvDataIsConnectable"] = 0
+	}
+	if len(p.AdvertisedUuids) > 0 {
+		uuids := xpc.Array{}
+		for _, uuid := range p.AdvertisedUuids {
+			uuids = append(uuids, uuidBytes(uuid))
+		}
+		advdata["kCBAdvDataServiceUUIDs"] = uuids
+	}
+	if len(p.ServiceData) > 0 {
+		sdata := xpc.Array{}
+		for uuid, data := range p.ServiceData {
+			sdata = append(sdata, uuidBytes(uuid), data)
+		}
+		advdata["kCBAdvDataServiceData"] = sdata
+	}
+
+	return xpc.Dict{
+		"kCBMsgArgDeviceUUID":        p.UUID,
+		"kCBMsgArgAdvertisementData": advdata,
+		"kCBMsgArgRssi":              p.Rssi,
+	}
+}
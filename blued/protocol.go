@@ -0,0 +1,45 @@
+package blued
+
+import (
+	"github.com/raff/goble"
+)
+
+// commands that refer to a peripheral (used to tell apart commands that share the same id)
+var deviceCommands = map[string]bool{
+	"connect":                 true,
+	"disconnect":              true,
+	"updateRssi":              true,
+	"discoverServices":        true,
+	"discoverCharacteristics": true,
+	"discoverDescriptors":     true,
+	"read":                    true,
+	"write":                   true,
+	"notify":                  true,
+	"readDescriptor":          true,
+	"writeDescriptor":         true,
+}
+
+// commandsFor returns the command names (by message id) for the specified release
+func commandsFor(release string) map[int][]string {
+	commands := map[int][]string{}
+
+	for name, id := range goble.ProtocolFor(release).Commands {
+		commands[id] = append(commands[id], name)
+	}
+
+	return commands
+}
+
+// eventsFor returns the event ids (by event name) for the specified release.
+// When an event is accepted with more than one id the lowest one is used.
+func eventsFor(release string) map[string]int {
+	events := map[string]int{}
+
+	for id, name := range goble.ProtocolFor(release).Events {
+		if prev, ok := events[name]; !ok || id < prev {
+			events[name] = id
+		}
+	}
+
+	return events
+}
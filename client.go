@@ -0,0 +1,363 @@
+package goble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/raff/goble/xpc"
+)
+
+var (
+	UNKNOWN_PERIPHERAL     = errors.New("unknown peripheral")
+	UNKNOWN_SERVICE        = errors.New("unknown service")
+	UNKNOWN_CHARACTERISTIC = errors.New("unknown characteristic")
+	UNKNOWN_DESCRIPTOR     = errors.New("unknown descriptor")
+	NOT_POWERED_ON         = errors.New("bluetooth is not powered on")
+	CLOSED                 = errors.New("closed")
+)
+
+// DisconnectedError is returned by the Client methods when the peripheral disconnects
+// before the request completes
+type DisconnectedError struct {
+	DeviceUUID xpc.UUID
+}
+
+func (e *DisconnectedError) Error() string {
+	return fmt.Sprintf("peripheral %v disconnected", e.DeviceUUID)
+}
+
+// Client is a synchronous API on top of BLE.
+//
+// Each method sends a request to blued and waits for the corresponding event,
+// or until the context is done. Client methods can also be called from an event handler,
+// but they block the dispatch of the following events until they return.
+//
+// Failures reported by blued are returned as ATTError or CBError.
+type Client struct {
+	ble *BLE
+}
+
+// NewClient creates a Client for the specified BLE
+func NewClient(ble *BLE) *Client {
+	return &Client{ble: ble}
+}
+
+// request calls send and waits for the first event that matches.
+//
+// A "disconnect" event for deviceUuid terminates the wait with a DisconnectedError,
+// unless it matches.
+func (c *Client) request(ctx context.Context, deviceUuid *xpc.UUID, match func(Event) bool, send func()) (Event, error) {
+	ch, cancel := c.ble.wait(func(ev Event) bool {
+		if match(ev) {
+			return true
+		}
+
+		return deviceUuid != nil && ev.Name == "disconnect" && ev.DeviceUUID == *deviceUuid
+	})
+	defer cancel()
+
+	if c.ble.closed() {
+		return Event{}, CLOSED
+	}
+
+	send()
+
+	select {
+	case ev := <-ch:
+		if !match(ev) {
+			return ev, &DisconnectedError{DeviceUUID: ev.DeviceUUID}
+		}
+
+		return ev, ev.Err
+
+	case <-ctx.Done():
+		return Event{}, ctx.Err()
+
+	case <-c.ble.done:
+		return Event{}, CLOSED
+	}
+}
+
+func (c *Client) peripheral(deviceUuid xpc.UUID) (*Peripheral, error) {
+	if p, ok := c.ble.Peripheral(deviceUuid); ok {
+		return p, nil
+	}
+
+	return nil, UNKNOWN_PERIPHERAL
+}
+
+func (c *Client) characteristic(deviceUuid xpc.UUID, serviceUuid, characteristicUuid string) (*ServiceCharacteristic, error) {
+	p, err := c.peripheral(deviceUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := p.Services[serviceUuid]
+	if !ok {
+		return nil, UNKNOWN_SERVICE
+	}
+
+	ch, ok := s.Characteristics[characteristicUuid]
+	if !ok {
+		return nil, UNKNOWN_CHARACTERISTIC
+	}
+
+	return ch, nil
+}
+
+// Init initializes BLE and waits for the adapter state.
+// It returns NOT_POWERED_ON if the adapter is not powered on.
+func (c *Client) Init(ctx context.Context) error {
+	ev, err := c.request(ctx, nil, func(ev Event) bool {
+		return ev.Name == "stateChange"
+	}, c.ble.Init)
+
+	if err == nil && ev.State != "poweredOn" {
+		err = NOT_POWERED_ON
+	}
+
+	return err
+}
+
+// FindPeripheral waits until the specified peripheral is discovered.
+//
+// If the BLE is not scanning, FindPeripheral starts a scan with the specified options (see BLE.StartScanning)
+// and stops it when done. A scan that is already running is left alone (and its options are not changed).
+func (c *Client) FindPeripheral(ctx context.Context, deviceUuid xpc.UUID, serviceUuids []xpc.UUID, allowDuplicates bool) (Peripheral, error) {
+	started := false
+
+	ev, err := c.request(ctx, nil, func(ev Event) bool {
+		return ev.Name == "discover" && ev.DeviceUUID == deviceUuid
+	}, func() {
+		if !c.ble.Scanning() {
+			c.ble.StartScanning(serviceUuids, allowDuplicates)
+			started = true
+		}
+	})
+
+	if started {
+		c.ble.StopScanning()
+	}
+
+	return ev.Peripheral, err
+}
+
+// Connect connects to the specified peripheral
+func (c *Client) Connect(ctx context.Context, deviceUuid xpc.UUID) error {
+	if _, err := c.peripheral(deviceUuid); err != nil {
+		return err
+	}
+
+	_, err := c.request(ctx, &deviceUuid, func(ev Event) bool {
+		return ev.Name == "connect" && ev.DeviceUUID == deviceUuid
+	}, func() {
+		c.ble.Connect(deviceUuid)
+	})
+
+	return err
+}
+
+// Disconnect disconnects from the specified peripheral
+func (c *Client) Disconnect(ctx context.Context, deviceUuid xpc.UUID) error {
+	if _, err := c.peripheral(deviceUuid); err != nil {
+		return err
+	}
+
+	_, err := c.request(ctx, nil, func(ev Event) bool {
+		return ev.Name == "disconnect" && ev.DeviceUUID == deviceUuid
+	}, func() {
+		c.ble.Disconnect(deviceUuid)
+	})
+
+	return err
+}
+
+// DiscoverServices discovers the services of a connected peripheral (all services if uuids is empty)
+func (c *Client) DiscoverServices(ctx context.Context, deviceUuid xpc.UUID, uuids []xpc.UUID) ([]*ServiceHandle, error) {
+	if _, err := c.peripheral(deviceUuid); err != nil {
+		return nil, err
+	}
+
+	ev, err := c.request(ctx, &deviceUuid, func(ev Event) bool {
+		return ev.Name == "servicesDiscover" && ev.DeviceUUID == deviceUuid
+	}, func() {
+		c.ble.DiscoverServices(deviceUuid, uuids)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	services := []*ServiceHandle{}
+	for k, s := range ev.Peripheral.Services {
+		if _, ok := k.(string); ok {
+			services = append(services, s)
+		}
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].startHandle < services[j].startHandle
+	})
+
+	return services, nil
+}
+
+// DiscoverCharacteristics discovers the characteristics of a service (all characteristics if characteristicUuids is empty)
+func (c *Client) DiscoverCharacteristics(ctx context.Context, deviceUuid xpc.UUID, serviceUuid string, characteristicUuids []string) ([]*ServiceCharacteristic, error) {
+	p, err := c.peripheral(deviceUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.Services[serviceUuid]; !ok {
+		return nil, UNKNOWN_SERVICE
+	}
+
+	ev, err := c.request(ctx, &deviceUuid, func(ev Event) bool {
+		return ev.Name == "characteristicsDiscover" && ev.DeviceUUID == deviceUuid && ev.ServiceUuid == serviceUuid
+	}, func() {
+		c.ble.DiscoverCharacteristics(deviceUuid, serviceUuid, characteristicUuids)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	characteristics := []*ServiceCharacteristic{}
+	for k, ch := range ev.Peripheral.Services[serviceUuid].Characteristics {
+		if _, ok := k.(string); ok {
+			characteristics = append(characteristics, ch)
+		}
+	}
+
+	sort.Slice(characteristics, func(i, j int) bool {
+		return characteristics[i].Handle < characteristics[j].Handle
+	})
+
+	return characteristics, nil
+}
+
+// DiscoverDescriptors discovers the descriptors of a characteristic
+func (c *Client) DiscoverDescriptors(ctx context.Context, deviceUuid xpc.UUID, serviceUuid, characteristicUuid string) ([]*CharacteristicDescriptor, error) {
+	if _, err := c.characteristic(deviceUuid, serviceUuid, characteristicUuid); err != nil {
+		return nil, err
+	}
+
+	ev, err := c.request(ctx, &deviceUuid, func(ev Event) bool {
+		return ev.Name == "descriptorsDiscover" && ev.DeviceUUID == deviceUuid && ev.ServiceUuid == serviceUuid && ev.CharacteristicUuid == characteristicUuid
+	}, func() {
+		c.ble.DiscoverDescriptors(deviceUuid, serviceUuid, characteristicUuid)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	descriptors := []*CharacteristicDescriptor{}
+	for k, d := range ev.Peripheral.Services[serviceUuid].Characteristics[characteristicUuid].Descriptors {
+		if _, ok := k.(string); ok {
+			descriptors = append(descriptors, d)
+		}
+	}
+
+	sort.Slice(descriptors, func(i, j int) bool {
+		return descriptors[i].Handle < descriptors[j].Handle
+	})
+
+	return descriptors, nil
+}
+
+// Read reads the value of a characteristic
+func (c *Client) Read(ctx context.Context, deviceUuid xpc.UUID, serviceUuid, characteristicUuid string) ([]byte, error) {
+	if _, err := c.characteristic(deviceUuid, serviceUuid, characteristicUuid); err != nil {
+		return nil, err
+	}
+
+	ev, err := c.request(ctx, &deviceUuid, func(ev Event) bool {
+		return ev.Name == "read" && ev.DeviceUUID == deviceUuid && ev.ServiceUuid == serviceUuid && ev.CharacteristicUuid == characteristicUuid
+	}, func() {
+		c.ble.Read(deviceUuid, serviceUuid, characteristicUuid)
+	})
+
+	return ev.Data, err
+}
+
+// Write writes the value of a characteristic
+func (c *Client) Write(ctx context.Context, deviceUuid xpc.UUID, serviceUuid, characteristicUuid string, data []byte, withoutResponse bool) error {
+	if _, err := c.characteristic(deviceUuid, serviceUuid, characteristicUuid); err != nil {
+		return err
+	}
+
+	_, err := c.request(ctx, &deviceUuid, func(ev Event) bool {
+		return ev.Name == "write" && ev.DeviceUUID == deviceUuid && ev.ServiceUuid == serviceUuid && ev.CharacteristicUuid == characteristicUuid
+	}, func() {
+		c.ble.Write(deviceUuid, serviceUuid, characteristicUuid, data, withoutResponse)
+	})
+
+	return err
+}
+
+// Notify enables or disables notifications for a characteristic.
+// The notifications are received as "notification" events.
+func (c *Client) Notify(ctx context.Context, deviceUuid xpc.UUID, serviceUuid, characteristicUuid string, enable bool) error {
+	ch, err := c.characteristic(deviceUuid, serviceUuid, characteristicUuid)
+	if err != nil {
+		return err
+	}
+
+	if ch.Properties&(Notify|Indicate) == 0 {
+		return fmt.Errorf("characteristic %v doesn't support notifications", characteristicUuid)
+	}
+
+	_, err = c.request(ctx, &deviceUuid, func(ev Event) bool {
+		return ev.Name == "notify" && ev.DeviceUUID == deviceUuid && ev.ServiceUuid == serviceUuid && ev.CharacteristicUuid == characteristicUuid
+	}, func() {
+		c.ble.Notify(deviceUuid, serviceUuid, characteristicUuid, enable)
+	})
+
+	return err
+}
+
+// ReadDescriptor reads the value of a descriptor
+func (c *Client) ReadDescriptor(ctx context.Context, deviceUuid xpc.UUID, descriptorHandle int) ([]byte, error) {
+	p, err := c.peripheral(deviceUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ch, d := p.findDescriptor(descriptorHandle)
+	if d == nil {
+		return nil, UNKNOWN_DESCRIPTOR
+	}
+
+	ev, err := c.request(ctx, &deviceUuid, func(ev Event) bool {
+		return ev.Name == "valueRead" && ev.DeviceUUID == deviceUuid && ev.ServiceUuid == s.Uuid && ev.CharacteristicUuid == ch.Uuid && ev.DescriptorUuid == d.Uuid
+	}, func() {
+		c.ble.ReadDescriptor(deviceUuid, descriptorHandle)
+	})
+
+	return ev.Data, err
+}
+
+// WriteDescriptor writes the value of a descriptor
+func (c *Client) WriteDescriptor(ctx context.Context, deviceUuid xpc.UUID, descriptorHandle int, data []byte) error {
+	p, err := c.peripheral(deviceUuid)
+	if err != nil {
+		return err
+	}
+
+	s, ch, d := p.findDescriptor(descriptorHandle)
+	if d == nil {
+		return UNKNOWN_DESCRIPTOR
+	}
+
+	_, err = c.request(ctx, &deviceUuid, func(ev Event) bool {
+		return ev.Name == "valueWrite" && ev.DeviceUUID == deviceUuid && ev.ServiceUuid == s.Uuid && ev.CharacteristicUuid == ch.Uuid && ev.DescriptorUuid == d.Uuid
+	}, func() {
+		c.ble.WriteDescriptor(deviceUuid, descriptorHandle, data)
+	})
+
+	return err
+}
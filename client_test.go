@@ -0,0 +1,90 @@
+package goble
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/raff/goble/xpc"
+)
+
+func TestClientUnknown(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	client := NewClient(ble)
+	ctx := context.Background()
+
+	if err := client.Connect(ctx, xpc.MakeUUID("ffff")); err != UNKNOWN_PERIPHERAL {
+		t.Errorf("expected UNKNOWN_PERIPHERAL got %v", err)
+	}
+
+	if _, err := client.Read(ctx, testDevice, "ffff", testCharacteristic); err != UNKNOWN_SERVICE {
+		t.Errorf("expected UNKNOWN_SERVICE got %v", err)
+	}
+
+	if _, err := client.Read(ctx, testDevice, testService, "ffff"); err != UNKNOWN_CHARACTERISTIC {
+		t.Errorf("expected UNKNOWN_CHARACTERISTIC got %v", err)
+	}
+
+	if sent := conn.Sent(); len(sent) != 0 {
+		t.Errorf("expected no messages got %#v", sent)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	ble, _ := newTestBLE("19.6.0")
+	client := NewClient(ble)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.Read(ctx, testDevice, testService, testCharacteristic); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded got %v", err)
+	}
+}
+
+func TestClientDisconnected(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	client := NewClient(ble)
+
+	go func() {
+		for len(conn.Sent()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		conn.Inject(53, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice})
+	}()
+
+	_, err := client.Read(context.Background(), testDevice, testService, testCharacteristic)
+	if derr, ok := err.(*DisconnectedError); !ok || derr.DeviceUUID != testDevice {
+		t.Errorf("expected DisconnectedError got %v", err)
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	client := NewClient(ble)
+
+	go func() {
+		for len(conn.Sent()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		ble.Close()
+	}()
+
+	if _, err := client.Read(context.Background(), testDevice, testService, testCharacteristic); err != CLOSED {
+		t.Errorf("expected CLOSED got %v", err)
+	}
+
+	if !conn.Closed() {
+		t.Error("expected transport to be closed")
+	}
+
+	if _, err := client.Read(context.Background(), testDevice, testService, testCharacteristic); err != CLOSED {
+		t.Errorf("expected CLOSED got %v", err)
+	}
+
+	if sent := conn.Sent(); len(sent) != 1 {
+		t.Errorf("expected no messages after Close got %#v", sent)
+	}
+}
@@ -0,0 +1,14 @@
+package goble
+
+// The Bluetooth SIG company identifiers (knownCompanies) are in company_identifiers.go,
+// generated from the SIG assigned numbers.
+//go:generate go run gen_companies.go -o company_identifiers.go
+
+// CompanyName returns the name of the company with the specified Bluetooth SIG identifier
+// (or an empty string if the company is not known)
+func CompanyName(companyId uint16) string {
+	manufacturersLock.RLock()
+	defer manufacturersLock.RUnlock()
+
+	return knownCompanies[companyId]
+}
@@ -2,6 +2,7 @@ package goble
 
 import (
 	"log"
+	"sync"
 
 	"github.com/raff/goble/xpc"
 )
@@ -17,66 +18,413 @@ type Event struct {
 	DeviceUUID         xpc.UUID
 	ServiceUuid        string
 	CharacteristicUuid string
+	DescriptorUuid     string
 	Peripheral         Peripheral
 	Data               []byte
 	Mtu                int
 	IsNotification     bool
+	Notifying          bool
+	Result             int
+	Err                error            // ATTError or CBError, if the operation failed
+	ServiceErrors      map[string]error // the result of each service, by UUID ("servicesSet")
 }
 
 // The event handler function.
 // Return true to terminate
 type EventHandlerFunc func(Event) bool
 
+// Subscription identifies an handler registered with On, and can be passed to Off to remove it
+type Subscription uint64
+
+type subscriber struct {
+	id Subscription
+	fn EventHandlerFunc
+}
+
+// a waiter receives the first event that matches, directly from Emit
+type waiter struct {
+	match func(Event) bool
+	ch    chan Event
+}
+
 // Emitter is an object to emit and handle Event(s)
 type Emitter struct {
-	handlers map[string]EventHandlerFunc
-	event    chan Event
-	verbose  bool
+	handlers     map[string][]subscriber
+	handlersLock sync.Mutex
+	lastId       Subscription
+	verbose      bool
+
+	// events queued for the event handlers
+	queue     []Event
+	queueCond *sync.Cond
+	stopped   bool
+
+	subscriptions []*subscription
+	done          chan struct{}
+	closeOnce     sync.Once
+
+	waiters     []*waiter
+	waitersLock sync.Mutex
 }
 
 // Init initialize the emitter and start a goroutine to execute the event handlers
 func (e *Emitter) Init() {
-	e.handlers = make(map[string]EventHandlerFunc)
-	e.event = make(chan Event)
+	e.handlers = make(map[string][]subscriber)
+	e.queueCond = sync.NewCond(&sync.Mutex{})
+	e.done = make(chan struct{})
 
 	// event handler
 	go func() {
 		for {
-			ev := <-e.event
+			ev, ok := e.next()
+			if !ok {
+				return
+			}
 
-			if fn, ok := e.handlers[ev.Name]; ok {
-				if fn(ev) {
-					break
-				}
-			} else if fn, ok := e.handlers[ALL]; ok {
-				if fn(ev) {
-					break
-				}
-			} else {
+			handlers := e.handlersFor(ev.Name)
+			if len(handlers) == 0 {
 				if e.verbose {
 					log.Println("unhandled Emit", ev)
 				}
+				continue
 			}
-		}
 
-		close(e.event) // TOFIX: this causes new "emits" to panic.
+			for _, fn := range handlers {
+				if fn(ev) {
+					e.Close()
+					return
+				}
+			}
+		}
 	}()
 }
 
+// next waits for the next queued event. It returns false if the emitter has been closed.
+func (e *Emitter) next() (Event, bool) {
+	e.queueCond.L.Lock()
+	defer e.queueCond.L.Unlock()
+
+	for len(e.queue) == 0 && !e.stopped {
+		e.queueCond.Wait()
+	}
+
+	if e.stopped {
+		return Event{}, false
+	}
+
+	ev := e.queue[0]
+	e.queue[0] = Event{}
+	e.queue = e.queue[1:]
+	return ev, true
+}
+
+// Close stops the dispatch of events: the queued events are discarded, Emit becomes a no-op
+// and the subscription channels are closed.
+//
+// Close can be called more than once, and from an event handler (that is the same as the handler returning true).
+func (e *Emitter) Close() {
+	e.closeOnce.Do(func() {
+		e.queueCond.L.Lock()
+		e.stopped = true
+		e.queue = nil
+		e.queueCond.Broadcast()
+		e.queueCond.L.Unlock()
+
+		close(e.done)
+
+		e.handlersLock.Lock()
+		subscriptions := e.subscriptions
+		e.subscriptions = nil
+		e.handlersLock.Unlock()
+
+		for _, s := range subscriptions {
+			s.close()
+		}
+	})
+}
+
+// closed returns true if Close has been called
+func (e *Emitter) closed() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (e *Emitter) SetVerbose(v bool) {
 	e.verbose = v
 }
 
-// Emit sends the event on the 'event' channel
+// Emit queues the event for the event handlers.
+//
+// Emit never blocks: the handlers are executed (in order) by the dispatch goroutine,
+// so that a slow handler doesn't stall the caller (i.e. the XPC event handler).
 func (e *Emitter) Emit(ev Event) {
-	e.event <- ev
+	if e.closed() {
+		return
+	}
+
+	e.notifyWaiters(ev)
+
+	e.queueCond.L.Lock()
+	if !e.stopped {
+		e.queue = append(e.queue, ev)
+		e.queueCond.Signal()
+	}
+	e.queueCond.L.Unlock()
+}
+
+// wait registers a waiter for the first event that matches.
+// The returned function must be called to remove the waiter (if the event is not received).
+func (e *Emitter) wait(match func(Event) bool) (<-chan Event, func()) {
+	w := &waiter{match: match, ch: make(chan Event, 1)}
+
+	e.waitersLock.Lock()
+	e.waiters = append(e.waiters, w)
+	e.waitersLock.Unlock()
+
+	return w.ch, func() { e.removeWaiter(w) }
+}
+
+func (e *Emitter) removeWaiter(w *waiter) {
+	e.waitersLock.Lock()
+	defer e.waitersLock.Unlock()
+
+	for i, ew := range e.waiters {
+		if ew == w {
+			e.waiters = append(e.waiters[:i], e.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// notifyWaiters delivers the event to the waiters that match it (and removes them).
+//
+// This is done before the event is queued for the event handlers, so that waiters
+// don't depend on (or interfere with) the registered event handlers.
+func (e *Emitter) notifyWaiters(ev Event) {
+	e.waitersLock.Lock()
+	defer e.waitersLock.Unlock()
+
+	waiters := e.waiters[:0]
+
+	for _, w := range e.waiters {
+		if w.match(ev) {
+			w.ch <- ev
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+
+	e.waiters = waiters
+}
+
+// handlersFor returns the handlers for the specified event, followed by the ALL handlers.
+// The list is a copy, so that handlers can call On/Off.
+func (e *Emitter) handlersFor(event string) []EventHandlerFunc {
+	e.handlersLock.Lock()
+	defer e.handlersLock.Unlock()
+
+	var handlers []EventHandlerFunc
+
+	for _, s := range e.handlers[event] {
+		handlers = append(handlers, s.fn)
+	}
+	if event != ALL {
+		for _, s := range e.handlers[ALL] {
+			handlers = append(handlers, s.fn)
+		}
+	}
+
+	return handlers
 }
 
-// On(event, cb) registers an handler for the specified event
-func (e *Emitter) On(event string, fn EventHandlerFunc) {
+// On(event, cb) registers an handler for the specified event, in addition to the ones already registered.
+// Handlers for ALL are called for every event, after the event specific handlers.
+//
+// The returned Subscription can be passed to Off to remove the handler.
+// On(event, nil) removes all the handlers for the specified event.
+func (e *Emitter) On(event string, fn EventHandlerFunc) Subscription {
+	e.handlersLock.Lock()
+	defer e.handlersLock.Unlock()
+
 	if fn == nil {
 		delete(e.handlers, event)
+		return 0
+	}
+
+	e.lastId++
+	e.handlers[event] = append(e.handlers[event], subscriber{id: e.lastId, fn: fn})
+	return e.lastId
+}
+
+// Off removes the handler registered with On
+func (e *Emitter) Off(s Subscription) {
+	e.handlersLock.Lock()
+	defer e.handlersLock.Unlock()
+
+	for event, subscribers := range e.handlers {
+		for i, sub := range subscribers {
+			if sub.id != s {
+				continue
+			}
+
+			if len(subscribers) == 1 {
+				delete(e.handlers, event)
+			} else {
+				e.handlers[event] = append(subscribers[:i:i], subscribers[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// OverflowPolicy specifies what to do when the channel of a subscription is full
+type OverflowPolicy int
+
+const (
+	// Block waits for the subscriber to receive the event (delaying all other handlers).
+	// There is no bound: while a subscriber is blocked the emitted events are queued in memory,
+	// so a Block subscriber must keep receiving (use Drop for slow subscribers).
+	Block OverflowPolicy = iota
+
+	// Drop discards the event
+	Drop
+)
+
+// DefaultBufferSize is the channel buffer size used by Subscribe
+const DefaultBufferSize = 16
+
+// SubscribeOptions configures a subscription created by SubscribeWith
+type SubscribeOptions struct {
+	BufferSize int
+	Overflow   OverflowPolicy
+}
+
+// a subscription delivers events to a channel
+type subscription struct {
+	ch       chan Event
+	done     chan struct{}
+	overflow OverflowPolicy
+
+	lock      sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+func (s *subscription) send(ev Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if s.overflow == Drop {
+		select {
+		case s.ch <- ev:
+		default:
+		}
 	} else {
-		e.handlers[event] = fn
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+		}
 	}
 }
+
+func (s *subscription) close() {
+	s.closeOnce.Do(func() {
+		close(s.done) // unblock a pending send
+
+		s.lock.Lock()
+		s.closed = true
+		close(s.ch)
+		s.lock.Unlock()
+	})
+}
+
+// Subscribe returns a channel that receives the specified events (or all events, if no name is specified),
+// with a buffer of DefaultBufferSize and the Block overflow policy.
+//
+// The returned function cancels the subscription and closes the channel.
+// The channel is also closed when the emitter is closed.
+func (e *Emitter) Subscribe(names ...string) (<-chan Event, func()) {
+	return e.SubscribeWith(SubscribeOptions{BufferSize: DefaultBufferSize, Overflow: Block}, names...)
+}
+
+// SubscribeWith is like Subscribe, with the specified buffer size and overflow policy.
+// Each event is delivered once, even if the names overlap (i.e. ALL and a specific event).
+func (e *Emitter) SubscribeWith(opts SubscribeOptions, names ...string) (<-chan Event, func()) {
+	names = subscriptionNames(names)
+
+	s := &subscription{
+		ch:       make(chan Event, opts.BufferSize),
+		done:     make(chan struct{}),
+		overflow: opts.Overflow,
+	}
+
+	e.handlersLock.Lock()
+	if e.closed() {
+		e.handlersLock.Unlock()
+		s.close()
+		return s.ch, func() {}
+	}
+	e.subscriptions = append(e.subscriptions, s)
+	e.handlersLock.Unlock()
+
+	var subs []Subscription
+
+	for _, name := range names {
+		subs = append(subs, e.On(name, func(ev Event) bool {
+			s.send(ev)
+			return false
+		}))
+	}
+
+	return s.ch, func() {
+		for _, sub := range subs {
+			e.Off(sub)
+		}
+
+		e.removeSubscription(s)
+		s.close()
+	}
+}
+
+func (e *Emitter) removeSubscription(s *subscription) {
+	e.handlersLock.Lock()
+	defer e.handlersLock.Unlock()
+
+	for i, es := range e.subscriptions {
+		if es == s {
+			e.subscriptions = append(e.subscriptions[:i], e.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// subscriptionNames removes the duplicated names (only ALL is left if it's specified, or if there are no names)
+func subscriptionNames(names []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+
+	for _, name := range names {
+		if name == ALL {
+			return []string{ALL}
+		}
+
+		if !seen[name] {
+			unique = append(unique, name)
+			seen[name] = true
+		}
+	}
+
+	if len(unique) == 0 {
+		return []string{ALL}
+	}
+
+	return unique
+}
@@ -0,0 +1,256 @@
+package goble
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestEmitter() *Emitter {
+	e := &Emitter{}
+	e.Init()
+	return e
+}
+
+// collect registers an handler that records the event names (prefixed by tag) on the channel
+func collect(e *Emitter, event, tag string, ch chan string) Subscription {
+	return e.On(event, func(ev Event) bool {
+		ch <- tag + ":" + ev.Name
+		return false
+	})
+}
+
+func expectCalls(t *testing.T, ch chan string, expected ...string) {
+	for _, exp := range expected {
+		select {
+		case got := <-ch:
+			if got != exp {
+				t.Errorf("expected %#v got %#v\n", exp, got)
+			}
+
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %#v", exp)
+		}
+	}
+
+	select {
+	case got := <-ch:
+		t.Errorf("unexpected call %#v", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestEmitterMultipleHandlers(t *testing.T) {
+	e := newTestEmitter()
+	ch := make(chan string, 10)
+
+	collect(e, "discover", "a", ch)
+	collect(e, "discover", "b", ch)
+	collect(e, ALL, "all", ch)
+
+	e.Emit(Event{Name: "discover"})
+	expectCalls(t, ch, "a:discover", "b:discover", "all:discover")
+
+	e.Emit(Event{Name: "connect"})
+	expectCalls(t, ch, "all:connect")
+}
+
+func TestEmitterOff(t *testing.T) {
+	e := newTestEmitter()
+	ch := make(chan string, 10)
+
+	a := collect(e, "discover", "a", ch)
+	collect(e, "discover", "b", ch)
+	all := collect(e, ALL, "all", ch)
+
+	e.Off(a)
+	e.Emit(Event{Name: "discover"})
+	expectCalls(t, ch, "b:discover", "all:discover")
+
+	e.Off(all)
+	e.Off(all) // no-op
+	e.Emit(Event{Name: "discover"})
+	expectCalls(t, ch, "b:discover")
+
+	collect(e, "discover", "c", ch)
+	e.On("discover", nil)
+	e.Emit(Event{Name: "discover"})
+	expectCalls(t, ch)
+}
+
+func TestEmitterOffFromHandler(t *testing.T) {
+	e := newTestEmitter()
+	ch := make(chan string, 10)
+
+	var once Subscription
+	once = e.On("discover", func(ev Event) bool {
+		e.Off(once)
+		ch <- "once:" + ev.Name
+		return false
+	})
+	collect(e, "discover", "a", ch)
+
+	e.Emit(Event{Name: "discover"})
+	e.Emit(Event{Name: "discover"})
+	expectCalls(t, ch, "once:discover", "a:discover", "a:discover")
+}
+
+func TestEmitterSubscribe(t *testing.T) {
+	e := newTestEmitter()
+
+	ch, cancel := e.Subscribe("discover", "connect")
+
+	e.Emit(Event{Name: "discover"})
+	e.Emit(Event{Name: "read"})
+	e.Emit(Event{Name: "connect"})
+
+	for _, name := range []string{"discover", "connect"} {
+		select {
+		case ev := <-ch:
+			if ev.Name != name {
+				t.Errorf("expected %#v got %#v\n", name, ev.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %#v", name)
+		}
+	}
+
+	cancel()
+	cancel() // no-op
+
+	if _, ok := <-ch; ok {
+		t.Error("expected closed channel")
+	}
+
+	e.Emit(Event{Name: "discover"}) // no panic on cancelled subscription
+}
+
+func TestEmitterSubscribeOverlapping(t *testing.T) {
+	e := newTestEmitter()
+
+	ch, cancel := e.Subscribe("discover", ALL, "discover")
+	defer cancel()
+
+	e.Emit(Event{Name: "discover"})
+	e.Emit(Event{Name: "connect"})
+
+	for _, name := range []string{"discover", "connect"} {
+		select {
+		case ev := <-ch:
+			if ev.Name != name {
+				t.Errorf("expected %#v got %#v\n", name, ev.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %#v", name)
+		}
+	}
+
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected duplicate %#v\n", ev)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestEmitterSubscribeDrop(t *testing.T) {
+	e := newTestEmitter()
+	done := make(chan string, 10)
+
+	ch, cancel := e.SubscribeWith(SubscribeOptions{BufferSize: 1, Overflow: Drop})
+	defer cancel()
+	collect(e, "last", "done", done)
+
+	e.Emit(Event{Name: "first"})
+	e.Emit(Event{Name: "second"})
+	e.Emit(Event{Name: "last"})
+	expectCalls(t, done, "done:last")
+
+	if ev := <-ch; ev.Name != "first" {
+		t.Errorf("expected first got %#v\n", ev.Name)
+	}
+
+	select {
+	case ev := <-ch:
+		t.Errorf("expected dropped events got %#v\n", ev.Name)
+	default:
+	}
+}
+
+func TestEmitterSubscribeBlock(t *testing.T) {
+	e := newTestEmitter()
+	done := make(chan string, 10)
+
+	_, cancel := e.SubscribeWith(SubscribeOptions{Overflow: Block})
+	collect(e, "last", "done", done)
+
+	// Emit doesn't block, even if the subscriber doesn't receive
+	e.Emit(Event{Name: "first"})
+	e.Emit(Event{Name: "last"})
+
+	// the pending send is unblocked by cancel
+	cancel()
+	expectCalls(t, done, "done:last")
+}
+
+func TestEmitterClose(t *testing.T) {
+	e := newTestEmitter()
+	ch := make(chan string, 10)
+
+	collect(e, "discover", "a", ch)
+	sub, _ := e.Subscribe()
+
+	e.Close()
+	e.Close() // no-op
+
+	e.Emit(Event{Name: "discover"}) // no-op, doesn't panic
+	expectCalls(t, ch)
+
+	if _, ok := <-sub; ok {
+		t.Error("expected closed subscription")
+	}
+
+	late, cancel := e.Subscribe()
+	defer cancel()
+
+	if _, ok := <-late; ok {
+		t.Error("expected closed subscription")
+	}
+}
+
+func TestEmitterCloseFromHandler(t *testing.T) {
+	e := newTestEmitter()
+	ch := make(chan string, 10)
+
+	e.On("stop", func(ev Event) bool {
+		e.Close()
+		ch <- "stop"
+		return false
+	})
+	collect(e, "discover", "a", ch)
+
+	e.Emit(Event{Name: "stop"})
+	e.Emit(Event{Name: "discover"})
+	expectCalls(t, ch, "stop")
+}
+
+func TestEmitterTerminate(t *testing.T) {
+	e := newTestEmitter()
+	ch := make(chan string, 10)
+
+	e.On("stop", func(ev Event) bool { return true })
+	collect(e, "stop", "b", ch)
+	sub, _ := e.Subscribe()
+
+	e.Emit(Event{Name: "stop"})
+
+	select {
+	case <-e.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected emitter to be closed")
+	}
+
+	e.Emit(Event{Name: "stop"}) // used to panic
+	expectCalls(t, ch)
+
+	for range sub {
+	}
+}
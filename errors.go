@@ -0,0 +1,152 @@
+package goble
+
+import (
+	"fmt"
+
+	"github.com/raff/goble/xpc"
+)
+
+// ATTError is an ATT protocol error, reported by blued (as kCBMsgArgResult) for
+// the GATT operations on characteristics and descriptors
+type ATTError int
+
+const (
+	ATTInvalidHandle                 ATTError = 0x01
+	ATTReadNotPermitted              ATTError = 0x02
+	ATTWriteNotPermitted             ATTError = 0x03
+	ATTInvalidPdu                    ATTError = 0x04
+	ATTInsufficientAuthentication    ATTError = 0x05
+	ATTRequestNotSupported           ATTError = 0x06
+	ATTInvalidOffset                 ATTError = 0x07
+	ATTInsufficientAuthorization     ATTError = 0x08
+	ATTPrepareQueueFull              ATTError = 0x09
+	ATTAttributeNotFound             ATTError = 0x0a
+	ATTAttributeNotLong              ATTError = 0x0b
+	ATTInsufficientEncryptionKeySize ATTError = 0x0c
+	ATTInvalidAttributeValueLength   ATTError = 0x0d
+	ATTUnlikelyError                 ATTError = 0x0e
+	ATTInsufficientEncryption        ATTError = 0x0f
+	ATTUnsupportedGroupType          ATTError = 0x10
+	ATTInsufficientResources         ATTError = 0x11
+)
+
+var attErrors = map[ATTError]string{
+	ATTInvalidHandle:                 "invalid handle",
+	ATTReadNotPermitted:              "read not permitted",
+	ATTWriteNotPermitted:             "write not permitted",
+	ATTInvalidPdu:                    "invalid pdu",
+	ATTInsufficientAuthentication:    "insufficient authentication",
+	ATTRequestNotSupported:           "request not supported",
+	ATTInvalidOffset:                 "invalid offset",
+	ATTInsufficientAuthorization:     "insufficient authorization",
+	ATTPrepareQueueFull:              "prepare queue full",
+	ATTAttributeNotFound:             "attribute not found",
+	ATTAttributeNotLong:              "attribute not long",
+	ATTInsufficientEncryptionKeySize: "insufficient encryption key size",
+	ATTInvalidAttributeValueLength:   "invalid attribute value length",
+	ATTUnlikelyError:                 "unlikely error",
+	ATTInsufficientEncryption:        "insufficient encryption",
+	ATTUnsupportedGroupType:          "unsupported group type",
+	ATTInsufficientResources:         "insufficient resources",
+}
+
+func (e ATTError) Error() string {
+	if s, ok := attErrors[e]; ok {
+		return "att: " + s
+	}
+
+	return fmt.Sprintf("att: error 0x%02x", int(e))
+}
+
+// CBError is a CoreBluetooth error, reported by blued (as kCBMsgArgResult) for
+// connections and advertising
+type CBError int
+
+const (
+	CBUnknown                CBError = 0
+	CBInvalidParameters      CBError = 1
+	CBInvalidHandle          CBError = 2
+	CBNotConnected           CBError = 3
+	CBOutOfSpace             CBError = 4
+	CBOperationCancelled     CBError = 5
+	CBConnectionTimeout      CBError = 6
+	CBPeripheralDisconnected CBError = 7
+	CBUuidNotAllowed         CBError = 8
+	CBAlreadyAdvertising     CBError = 9
+	CBConnectionFailed       CBError = 10
+	CBConnectionLimitReached CBError = 11
+	CBUnknownDevice          CBError = 12
+	CBOperationNotSupported  CBError = 13
+)
+
+var cbErrors = map[CBError]string{
+	CBUnknown:                "unknown error",
+	CBInvalidParameters:      "invalid parameters",
+	CBInvalidHandle:          "invalid handle",
+	CBNotConnected:           "not connected",
+	CBOutOfSpace:             "out of space",
+	CBOperationCancelled:     "operation cancelled",
+	CBConnectionTimeout:      "connection timeout",
+	CBPeripheralDisconnected: "peripheral disconnected",
+	CBUuidNotAllowed:         "uuid not allowed",
+	CBAlreadyAdvertising:     "already advertising",
+	CBConnectionFailed:       "connection failed",
+	CBConnectionLimitReached: "connection limit reached",
+	CBUnknownDevice:          "unknown device",
+	CBOperationNotSupported:  "operation not supported",
+}
+
+func (e CBError) Error() string {
+	if s, ok := cbErrors[e]; ok {
+		return "cb: " + s
+	}
+
+	return fmt.Sprintf("cb: error %d", int(e))
+}
+
+// ProtocolError is reported (in a "protocolError" event) for the blued messages
+// that cannot be decoded or processed
+type ProtocolError struct {
+	Message xpc.Dict // the message, if it was decoded
+	Err     error    // usually an *xpc.ConversionError
+}
+
+func (e *ProtocolError) Error() string {
+	if id, ok := e.Message["kCBMsgId"]; ok {
+		return fmt.Sprintf("protocol error in message %v: %v", id, e.Err)
+	}
+
+	return fmt.Sprintf("protocol error: %v", e.Err)
+}
+
+// attError returns the ATTError for a blued result (nil for success)
+func attError(result int) error {
+	if result == 0 {
+		return nil
+	}
+
+	return ATTError(result)
+}
+
+// attResult returns the ATT result code for an error returned by a GATT server handler
+// (ATTUnlikelyError if it's not an ATTError)
+func attResult(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if e, ok := err.(ATTError); ok {
+		return int(e)
+	}
+
+	return int(ATTUnlikelyError)
+}
+
+// cbError returns the CBError for a blued result (nil for success)
+func cbError(result int) error {
+	if result == 0 {
+		return nil
+	}
+
+	return CBError(result)
+}
@@ -78,12 +78,26 @@ func main() {
 		}
 
 		if len(ev.Peripheral.Advertisement.ManufacturerData) > 0 {
+			companyId, name, _ := ev.Peripheral.Advertisement.Manufacturer()
+			if name == "" {
+				name = "unknown"
+			}
+
 			if *compact {
+				fmt.Printf("  manufacturer: 0x%04x (%v)\n", companyId, name)
 				fmt.Printf("  manufacturer data: %x\n", ev.Peripheral.Advertisement.ManufacturerData)
 			} else {
-				fmt.Println("\there is my manufacturer data:")
+				fmt.Printf("\there is my manufacturer data (from 0x%04x %v):\n", companyId, name)
 				fmt.Println("\t\t", ev.Peripheral.Advertisement.ManufacturerData)
 			}
+
+			if v, err := ev.Peripheral.Advertisement.ManufacturerValue(); err == nil {
+				if *compact {
+					fmt.Printf("  manufacturer value: %+v\n", v)
+				} else {
+					fmt.Printf("\t\t %+v\n", v)
+				}
+			}
 		}
 
 		if ev.Peripheral.Advertisement.TxPowerLevel != 0 {
@@ -14,6 +14,7 @@ var (
 	debug   = flag.Bool("debug", false, "log debug messages")
 	verbose = flag.Bool("verbose", false, "dump all events")
 	dups    = flag.Bool("allow-duplicates", false, "allow duplicates when scanning")
+	descs   = flag.Bool("descriptors", false, "discover characteristic descriptors")
 )
 
 func DebugPrint(params ...interface{}) {
@@ -33,6 +34,11 @@ func explore(ble *goble.BLE, peripheral *goble.Peripheral) {
 	// connect
 	ble.On("connect", func(ev goble.Event) (done bool) {
 		DebugPrint("connected", ev)
+		if ev.Err != nil {
+			log.Println("connect failed:", ev.Err)
+			os.Exit(1)
+		}
+
 		ble.DiscoverServices(ev.DeviceUUID, nil)
 
 		go func() {
@@ -88,7 +94,9 @@ func explore(ble *goble.BLE, peripheral *goble.Peripheral) {
 					ble.Read(ev.DeviceUUID, serviceUuid, characteristic.Uuid)
 				}
 
-				//ble.DiscoverDescriptors(ev.DeviceUUID, serviceUuid, characteristic.Uuid)
+				if *descs {
+					ble.DiscoverDescriptors(ev.DeviceUUID, serviceUuid, characteristic.Uuid)
+				}
 				results[serviceUuid] = serviceResult
 
 				if *verbose {
@@ -103,7 +111,22 @@ func explore(ble *goble.BLE, peripheral *goble.Peripheral) {
 	// discover descriptors
 	ble.On("descriptorsDiscover", func(ev goble.Event) (done bool) {
 		DebugPrint("descriptorsDiscovered", ev)
-		fmt.Println("    descriptors  ", ev.Peripheral.Services[ev.ServiceUuid].Characteristics[ev.CharacteristicUuid].Descriptors)
+		descriptors := ev.Peripheral.Services[ev.ServiceUuid].Characteristics[ev.CharacteristicUuid].Descriptors
+		fmt.Println("    descriptors  ", descriptors)
+
+		// read user description and presentation format
+		for _, id := range []string{"2901", "2904"} {
+			if descriptor, ok := descriptors[id]; ok {
+				ble.ReadDescriptor(ev.DeviceUUID, descriptor.Handle)
+			}
+		}
+		return
+	})
+
+	// read descriptor
+	ble.On("valueRead", func(ev goble.Event) (done bool) {
+		DebugPrint("valueRead", ev)
+		fmt.Printf("    %v %v %v: %x | %q\n", ev.ServiceUuid, ev.CharacteristicUuid, ev.DescriptorUuid, ev.Data, ev.Data)
 		return
 	})
 
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/raff/goble"
+	"github.com/raff/goble/xpc"
+)
+
+func main() {
+	verbose := flag.Bool("verbose", false, "dump all events")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout")
+	flag.Parse()
+
+	if len(flag.Args()) != 3 {
+		fmt.Println("usage:", os.Args[0], "[options] peripheral-uuid service-uuid characteristic-uuid")
+		os.Exit(1)
+	}
+
+	deviceUuid := xpc.MustUUID(flag.Arg(0))
+	serviceUuid := flag.Arg(1)
+	characteristicUuid := flag.Arg(2)
+
+	ble := goble.New()
+	ble.SetVerbose(*verbose)
+
+	client := goble.NewClient(ble)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if err := client.Init(ctx); err != nil {
+		log.Fatal("init: ", err)
+	}
+
+	if _, err := client.FindPeripheral(ctx, deviceUuid, nil, false); err != nil {
+		log.Fatal("scan: ", err)
+	}
+
+	if err := client.Connect(ctx, deviceUuid); err != nil {
+		log.Fatal("connect: ", err)
+	}
+
+	defer client.Disconnect(ctx, deviceUuid)
+
+	if _, err := client.DiscoverServices(ctx, deviceUuid, nil); err != nil {
+		log.Fatal("discover services: ", err)
+	}
+
+	if _, err := client.DiscoverCharacteristics(ctx, deviceUuid, serviceUuid, nil); err != nil {
+		log.Fatal("discover characteristics: ", err)
+	}
+
+	data, err := client.Read(ctx, deviceUuid, serviceUuid, characteristicUuid)
+	if err != nil {
+		log.Fatal("read: ", err)
+	}
+
+	fmt.Printf("%x | %q\n", data, data)
+}
@@ -0,0 +1,310 @@
+package goble
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/raff/goble/xpc"
+)
+
+var (
+	ALREADY_PUBLISHED = errors.New("service already published")
+)
+
+//
+// GATT server (peripheral role) services, characteristics and descriptors
+//
+
+// ReadHandler returns the value of a characteristic, starting at offset (for long reads).
+// A returned ATTError is sent to the central.
+type ReadHandler func(offset int) ([]byte, error)
+
+// WriteHandler receives the value written to a characteristic, at offset (for long writes).
+// A returned ATTError is sent to the central (unless withoutResponse is true).
+type WriteHandler func(data []byte, offset int, withoutResponse bool) error
+
+// Permission is the set of access permissions of a GATT server attribute
+type Permission int
+
+const (
+	Readable Permission = 1 << iota
+	Writeable
+	ReadEncryptionRequired
+	WriteEncryptionRequired
+)
+
+func (p Permission) String() (result string) {
+	if (p & Readable) != 0 {
+		result += "readable "
+	}
+	if (p & Writeable) != 0 {
+		result += "writeable "
+	}
+	if (p & ReadEncryptionRequired) != 0 {
+		result += "readEncryptionRequired "
+	}
+	if (p & WriteEncryptionRequired) != 0 {
+		result += "writeEncryptionRequired "
+	}
+
+	return
+}
+
+// GATT Descriptor
+type Descriptor struct {
+	uuid        string
+	value       []byte
+	permissions Permission
+}
+
+// GATT Characteristic
+type Characteristic struct {
+	uuid        string
+	properties  Property
+	permissions Permission
+	descriptors []*Descriptor
+	value       []byte
+
+	onRead  ReadHandler
+	onWrite WriteHandler
+
+	// set when the service is published (see BLE.SetServices)
+	ble         *BLE
+	attributeId int
+	subscribers map[xpc.UUID]int // negotiated MTU, by central
+}
+
+// GATT Service
+type Service struct {
+	uuid            string
+	characteristics []*Characteristic
+}
+
+// NewService creates a (primary) service.
+// The uuid is a 16, 32 or 128 bit UUID in hex (i.e. "180d" or "0000180d-0000-1000-8000-00805f9b34fb").
+func NewService(uuid string) *Service {
+	return &Service{uuid: normalizeUuid(uuid)}
+}
+
+// AddCharacteristic adds a characteristic to the service.
+// permissions are the access permissions of the characteristic value (Readable, Writeable,
+// or ReadEncryptionRequired and WriteEncryptionRequired to require an encrypted connection).
+// Notifications and indications that require an encrypted connection use the
+// NotifyEncryptionRequired and IndicateEncryptionRequired properties.
+func (s *Service) AddCharacteristic(uuid string, properties Property, permissions Permission) *Characteristic {
+	c := &Characteristic{uuid: normalizeUuid(uuid), properties: properties, permissions: permissions}
+	s.characteristics = append(s.characteristics, c)
+	return c
+}
+
+// UUID returns the service UUID
+func (s *Service) UUID() string {
+	return s.uuid
+}
+
+// Characteristics returns the service characteristics
+func (s *Service) Characteristics() []*Characteristic {
+	return s.characteristics
+}
+
+// Validate checks the service UUID and the properties, values and handlers of the characteristics
+func (s *Service) Validate() error {
+	if !validUuid(s.uuid) {
+		return fmt.Errorf("service %v: invalid UUID", s.uuid)
+	}
+
+	for _, c := range s.characteristics {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("service %v: %v", s.uuid, err)
+		}
+	}
+
+	return nil
+}
+
+// AddDescriptor adds a (readable) descriptor with a static value to the characteristic.
+// Only the Characteristic User Description (0x2901) and Characteristic Presentation Format (0x2904) descriptors
+// are supported (the Client Characteristic Configuration descriptor is managed by blued).
+func (c *Characteristic) AddDescriptor(uuid string, value []byte) *Descriptor {
+	d := &Descriptor{uuid: normalizeUuid(uuid), value: value, permissions: Readable}
+	c.descriptors = append(c.descriptors, d)
+	return d
+}
+
+// SetValue sets the static (cached) value of a read-only characteristic
+func (c *Characteristic) SetValue(value []byte) *Characteristic {
+	c.value = value
+	return c
+}
+
+// OnRead sets the handler that returns the value of the characteristic (if it doesn't have a static value)
+func (c *Characteristic) OnRead(h ReadHandler) *Characteristic {
+	c.onRead = h
+	return c
+}
+
+// OnWrite sets the handler that receives the values written to the characteristic
+func (c *Characteristic) OnWrite(h WriteHandler) *Characteristic {
+	c.onWrite = h
+	return c
+}
+
+// UUID returns the characteristic UUID
+func (c *Characteristic) UUID() string {
+	return c.uuid
+}
+
+// Properties returns the characteristic properties
+func (c *Characteristic) Properties() Property {
+	return c.properties
+}
+
+// Permissions returns the permissions of the characteristic value
+func (c *Characteristic) Permissions() Permission {
+	return c.permissions
+}
+
+// Descriptors returns the characteristic descriptors
+func (c *Characteristic) Descriptors() []*Descriptor {
+	return c.descriptors
+}
+
+// the properties that can be set for a GATT server characteristic
+const serverProperties = Broadcast | Read | WriteWithoutResponse | Write | Notify | Indicate | ExtendedProperties |
+	NotifyEncryptionRequired | IndicateEncryptionRequired
+
+func (c *Characteristic) validate() error {
+	if !validUuid(c.uuid) {
+		return fmt.Errorf("characteristic %v: invalid UUID", c.uuid)
+	}
+
+	if c.properties&serverProperties == 0 {
+		return fmt.Errorf("characteristic %v: no properties", c.uuid)
+	}
+
+	if p := c.properties &^ serverProperties; p != 0 {
+		return fmt.Errorf("characteristic %v: unsupported properties %v", c.uuid, strings.TrimSpace(p.String()))
+	}
+
+	if err := c.validatePermissions(); err != nil {
+		return fmt.Errorf("characteristic %v: %v", c.uuid, err)
+	}
+
+	if c.value != nil {
+		// a characteristic with a static value is cached by blued
+		if c.properties != Read {
+			return fmt.Errorf("characteristic %v: a characteristic with a static value must be read-only", c.uuid)
+		}
+
+		if c.onRead != nil {
+			return fmt.Errorf("characteristic %v: both a static value and a read handler", c.uuid)
+		}
+	} else if c.properties&Read != 0 && c.onRead == nil {
+		return fmt.Errorf("characteristic %v: readable without a value or read handler", c.uuid)
+	}
+
+	if c.properties&(Write|WriteWithoutResponse) != 0 && c.onWrite == nil {
+		return fmt.Errorf("characteristic %v: writable without a write handler", c.uuid)
+	}
+
+	if c.properties&(Write|WriteWithoutResponse) == 0 && c.onWrite != nil {
+		return fmt.Errorf("characteristic %v: write handler for a characteristic that is not writable", c.uuid)
+	}
+
+	for _, d := range c.descriptors {
+		switch d.uuid {
+		case "2901", "2904":
+		default:
+			return fmt.Errorf("characteristic %v: unsupported descriptor %v", c.uuid, d.uuid)
+		}
+
+		if d.value == nil {
+			return fmt.Errorf("characteristic %v: descriptor %v without value", c.uuid, d.uuid)
+		}
+
+		// descriptors have a static value, they can only be read
+		if d.permissions&(Readable|ReadEncryptionRequired) == 0 {
+			return fmt.Errorf("characteristic %v: descriptor %v is not readable", c.uuid, d.uuid)
+		}
+
+		if p := d.permissions &^ (Readable | ReadEncryptionRequired); p != 0 {
+			return fmt.Errorf("characteristic %v: descriptor %v: unsupported permissions %v", c.uuid, d.uuid, strings.TrimSpace(p.String()))
+		}
+	}
+
+	return nil
+}
+
+// the permissions must match the properties
+func (c *Characteristic) validatePermissions() error {
+	const read = Readable | ReadEncryptionRequired
+	const write = Writeable | WriteEncryptionRequired
+
+	if p := c.permissions &^ (read | write); p != 0 {
+		return fmt.Errorf("unsupported permissions %v", strings.TrimSpace(p.String()))
+	}
+
+	if c.permissions&read == read || c.permissions&write == write {
+		return fmt.Errorf("permissions %v both with and without encryption", strings.TrimSpace(c.permissions.String()))
+	}
+
+	switch {
+	case c.properties&Read != 0 && c.permissions&read == 0:
+		return fmt.Errorf("read without the readable or readEncryptionRequired permission")
+
+	case c.properties&Read == 0 && c.permissions&read != 0:
+		return fmt.Errorf("read permission without the read property")
+
+	case c.properties&(Write|WriteWithoutResponse) != 0 && c.permissions&write == 0:
+		return fmt.Errorf("write without the writeable or writeEncryptionRequired permission")
+
+	case c.properties&(Write|WriteWithoutResponse) == 0 && c.permissions&write != 0:
+		return fmt.Errorf("write permission without the write or writeWithoutResponse property")
+
+	case c.properties&NotifyEncryptionRequired != 0 && c.properties&Notify == 0:
+		return fmt.Errorf("notifyEncryptionRequired without the notify property")
+
+	case c.properties&IndicateEncryptionRequired != 0 && c.properties&Indicate == 0:
+		return fmt.Errorf("indicateEncryptionRequired without the indicate property")
+	}
+
+	return nil
+}
+
+// UUID returns the descriptor UUID
+func (d *Descriptor) UUID() string {
+	return d.uuid
+}
+
+// Value returns the descriptor value
+func (d *Descriptor) Value() []byte {
+	return d.value
+}
+
+// SetPermissions sets the descriptor permissions (Readable, or ReadEncryptionRequired to require an encrypted connection)
+func (d *Descriptor) SetPermissions(permissions Permission) *Descriptor {
+	d.permissions = permissions
+	return d
+}
+
+// Permissions returns the descriptor permissions
+func (d *Descriptor) Permissions() Permission {
+	return d.permissions
+}
+
+// lowercase, without dashes
+func normalizeUuid(uuid string) string {
+	return strings.ToLower(strings.Replace(uuid, "-", "", -1))
+}
+
+// a valid (normalized) 16, 32 or 128 bit UUID
+func validUuid(uuid string) bool {
+	if len(uuid) != 4 && len(uuid) != 8 && len(uuid) != 32 {
+		return false
+	}
+
+	_, err := hex.DecodeString(uuid)
+	return err == nil
+}
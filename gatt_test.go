@@ -0,0 +1,201 @@
+package goble
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/raff/goble/xpc"
+)
+
+func readValue(offset int) ([]byte, error) { return []byte{42}, nil }
+
+func writeValue(data []byte, offset int, withoutResponse bool) error { return nil }
+
+func TestServiceBuilder(t *testing.T) {
+	s := NewService("0000180D-0000-1000-8000-00805F9B34FB")
+	c := s.AddCharacteristic("2a37", Notify, 0)
+	c.AddDescriptor("2901", []byte("heart rate"))
+	s.AddCharacteristic("2a38", Read, Readable).SetValue([]byte{1})
+	s.AddCharacteristic("2a39", Write|Read, Readable|WriteEncryptionRequired).OnRead(readValue).OnWrite(writeValue)
+
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.UUID() != "0000180d00001000800000805f9b34fb" {
+		t.Errorf("unexpected uuid %v\n", s.UUID())
+	}
+
+	if len(s.Characteristics()) != 3 || s.Characteristics()[0] != c || len(c.Descriptors()) != 1 {
+		t.Errorf("unexpected characteristics %#v\n", s.Characteristics())
+	}
+
+	ble, conn := newTestBLE("19.6.0")
+	if err := ble.SetServices([]*Service{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := conn.Sent()
+	if len(sent) != 2 || sent[0]["kCBMsgId"] != 12 || sent[1]["kCBMsgId"] != 10 {
+		t.Fatalf("unexpected messages %#v\n", sent)
+	}
+
+	args := sent[1]["kCBMsgArgs"].(xpc.Dict)
+	if args["kCBMsgArgUUID"] != "0000180d00001000800000805f9b34fb" {
+		t.Errorf("unexpected service uuid %#v\n", args["kCBMsgArgUUID"])
+	}
+
+	characteristics := args["kCBMsgArgCharacteristics"].(xpc.Array)
+	if len(characteristics) != 3 {
+		t.Fatalf("expected 3 characteristics got %#v\n", characteristics)
+	}
+
+	first := characteristics[0].(xpc.Dict)
+	if first["kCBMsgArgUUID"] != "2a37" || first["kCBMsgArgAttributeID"] != 2 || len(first["kCBMsgArgDescriptors"].(xpc.Array)) != 1 {
+		t.Errorf("unexpected characteristic %#v\n", first)
+	}
+
+	// read open, write encrypted
+	last := characteristics[2].(xpc.Dict)
+	if last["kCBMsgArgCharacteristicProperties"] != 0x0a || last["kCBMsgArgAttributePermissions"] != 0x09 {
+		t.Errorf("unexpected characteristic %#v\n", last)
+	}
+}
+
+func TestServiceDuplicates(t *testing.T) {
+	s := NewService("180d")
+
+	tests := [][]*Service{
+		{s, s},
+		{s, NewService("180D")},
+	}
+
+	for _, services := range tests {
+		ble, conn := newTestBLE("19.6.0")
+
+		if err := ble.SetServices(services); err != ALREADY_PUBLISHED {
+			t.Errorf("expected %v got %v\n", ALREADY_PUBLISHED, err)
+		}
+
+		if len(conn.Sent()) != 0 {
+			t.Errorf("expected no messages got %#v\n", conn.Sent())
+		}
+	}
+}
+
+func TestServiceValidation(t *testing.T) {
+	tests := []struct {
+		build func() *Service
+		err   string
+	}{
+		{func() *Service { return NewService("18") }, "invalid UUID"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", 0, 0)
+			return s
+		}, "no properties"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Notify|AuthenticatedSignedWrites, 0)
+			return s
+		}, "unsupported properties authenticateSignedWrites"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Notify, Readable)
+			return s
+		}, "read permission without the read property"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Read, 0).OnRead(readValue)
+			return s
+		}, "read without the readable or readEncryptionRequired permission"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Read, Readable|ReadEncryptionRequired).OnRead(readValue)
+			return s
+		}, "permissions readable readEncryptionRequired both with and without encryption"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", WriteWithoutResponse, 0).OnWrite(writeValue)
+			return s
+		}, "write without the writeable or writeEncryptionRequired permission"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Read, Readable|WriteEncryptionRequired).OnRead(readValue)
+			return s
+		}, "write permission without the write or writeWithoutResponse property"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Indicate|NotifyEncryptionRequired, 0)
+			return s
+		}, "notifyEncryptionRequired without the notify property"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Notify|IndicateEncryptionRequired, 0)
+			return s
+		}, "indicateEncryptionRequired without the indicate property"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Notify, 0x10)
+			return s
+		}, "unsupported permissions"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Read|Notify, Readable).SetValue([]byte{1})
+			return s
+		}, "must be read-only"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Read, Readable).SetValue([]byte{1}).OnRead(readValue)
+			return s
+		}, "both a static value and a read handler"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Read, Readable)
+			return s
+		}, "without a value or read handler"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Write, Writeable)
+			return s
+		}, "without a write handler"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Notify, 0).OnWrite(writeValue)
+			return s
+		}, "not writable"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Notify, 0).AddDescriptor("2902", []byte{0, 0})
+			return s
+		}, "unsupported descriptor 2902"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Notify, 0).AddDescriptor("2901", nil)
+			return s
+		}, "descriptor 2901 without value"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Notify, 0).AddDescriptor("2901", []byte("hr")).SetPermissions(0)
+			return s
+		}, "descriptor 2901 is not readable"},
+		{func() *Service {
+			s := NewService("180d")
+			s.AddCharacteristic("2a37", Notify, 0).AddDescriptor("2901", []byte("hr")).SetPermissions(Readable | Writeable)
+			return s
+		}, "descriptor 2901: unsupported permissions writeable"},
+	}
+
+	for _, test := range tests {
+		ble, conn := newTestBLE("19.6.0")
+
+		err := ble.SetServices([]*Service{NewService("180f"), test.build()})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected %#v got %v\n", test.err, err)
+		}
+
+		if len(conn.Sent()) != 0 {
+			t.Errorf("expected no messages got %#v\n", conn.Sent())
+		}
+	}
+}
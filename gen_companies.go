@@ -0,0 +1,154 @@
+//go:build ignore
+// +build ignore
+
+// gen_companies generates company_identifiers.go from the Bluetooth SIG company identifiers
+// (assigned_numbers/company_identifiers/company_identifiers.yaml)
+//
+//	go run gen_companies.go [-i url-or-file] [-o company_identifiers.go]
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const sigCompanies = "https://bitbucket.org/bluetooth-SIG/public/raw/main/assigned_numbers/company_identifiers/company_identifiers.yaml"
+
+type company struct {
+	id   uint16
+	name string
+}
+
+func main() {
+	input := flag.String("i", sigCompanies, "company identifiers YAML (URL or file)")
+	output := flag.String("o", "company_identifiers.go", "output file")
+	flag.Parse()
+
+	r, err := open(*input)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	companies, err := parse(r)
+	r.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(companies) == 0 {
+		log.Fatal("no company identifiers in ", *input)
+	}
+
+	var b bytes.Buffer
+
+	fmt.Fprintln(&b, "// Code generated by gen_companies.go; DO NOT EDIT.")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "package goble")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "// A dictionary of known company names (keyed by Bluetooth SIG company identifier)")
+	fmt.Fprintln(&b, "var knownCompanies = map[uint16]string{")
+	for _, c := range companies {
+		fmt.Fprintf(&b, "\t0x%04x: %q,\n", c.id, c.name)
+	}
+	fmt.Fprintln(&b, "}")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(*output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func open(input string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(input, "http://") && !strings.HasPrefix(input, "https://") {
+		return os.Open(input)
+	}
+
+	resp, err := http.Get(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v: %v", input, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// parse the list of "- value: 0x...\n  name: '...'" entries
+func parse(r io.Reader) ([]company, error) {
+	var companies []company
+	var id uint16
+	hasId := false
+
+	seen := map[uint16]bool{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "-"))
+
+		switch {
+		case strings.HasPrefix(text, "value:"):
+			v, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(text, "value:")), 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", line, err)
+			}
+
+			id, hasId = uint16(v), true
+
+		case strings.HasPrefix(text, "name:"):
+			if !hasId {
+				return nil, fmt.Errorf("line %v: name without value", line)
+			}
+
+			name, err := unquote(strings.TrimSpace(strings.TrimPrefix(text, "name:")))
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", line, err)
+			}
+
+			if !seen[id] {
+				companies = append(companies, company{id: id, name: name})
+				seen[id] = true
+			}
+
+			hasId = false
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(companies, func(i, j int) bool { return companies[i].id < companies[j].id })
+	return companies, nil
+}
+
+// unquote a YAML scalar (plain, 'single' or "double" quoted)
+func unquote(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+
+	default:
+		return s, nil
+	}
+}
@@ -1,14 +1,18 @@
 package goble
 
-import "C"
-
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/raff/goble/adv"
+	"github.com/raff/goble/beacon"
 	"github.com/raff/goble/xpc"
 )
 
@@ -22,14 +26,16 @@ var STATES = []string{"unknown", "resetting", "unsupported", "unauthorized", "po
 type Property int
 
 const (
-	Broadcast                 Property = 1 << iota
-	Read                               = 1 << iota
-	WriteWithoutResponse               = 1 << iota
-	Write                              = 1 << iota
-	Notify                             = 1 << iota
-	Indicate                           = 1 << iota
-	AuthenticatedSignedWrites          = 1 << iota
-	ExtendedProperties                 = 1 << iota
+	Broadcast                  Property = 1 << iota
+	Read                                = 1 << iota
+	WriteWithoutResponse                = 1 << iota
+	Write                               = 1 << iota
+	Notify                              = 1 << iota
+	Indicate                            = 1 << iota
+	AuthenticatedSignedWrites           = 1 << iota
+	ExtendedProperties                  = 1 << iota
+	NotifyEncryptionRequired            = 1 << iota
+	IndicateEncryptionRequired          = 1 << iota
 )
 
 func (p Property) Readable() bool {
@@ -61,6 +67,12 @@ func (p Property) String() (result string) {
 	if (p & ExtendedProperties) != 0 {
 		result += "extendedProperties "
 	}
+	if (p & NotifyEncryptionRequired) != 0 {
+		result += "notifyEncryptionRequired "
+	}
+	if (p & IndicateEncryptionRequired) != 0 {
+		result += "indicateEncryptionRequired "
+	}
 
 	return
 }
@@ -83,6 +95,7 @@ type ServiceCharacteristic struct {
 	Descriptors map[interface{}]*CharacteristicDescriptor
 	Handle      int
 	ValueHandle int
+	Notifying   bool
 }
 
 type ServiceHandle struct {
@@ -102,6 +115,22 @@ type Advertisement struct {
 	ServiceUuids     []string
 }
 
+// Beacon decodes the iBeacon or AltBeacon in the manufacturer data, or the Eddystone frame in the service data.
+// It returns false if the advertisement doesn't contain a (valid) beacon.
+func (a *Advertisement) Beacon() (beacon.Beacon, bool) {
+	if b, err := beacon.FromManufacturerData(a.ManufacturerData); err == nil {
+		return b, true
+	}
+
+	for _, sd := range a.ServiceData {
+		if b, err := beacon.FromServiceData(sd.Uuid, sd.Data); err == nil {
+			return b, true
+		}
+	}
+
+	return nil, false
+}
+
 type Peripheral struct {
 	Uuid          xpc.UUID
 	Address       string
@@ -112,48 +141,181 @@ type Peripheral struct {
 	Services      map[interface{}]*ServiceHandle
 }
 
-// GATT Descriptor
-type Descriptor struct {
-	uuid  xpc.UUID
-	value []byte
+// snapshot returns a deep copy of the peripheral, that can be used without holding the peripherals lock
+func (p *Peripheral) snapshot() *Peripheral {
+	cp := *p
+	cp.Services = make(map[interface{}]*ServiceHandle, len(p.Services))
+
+	// services are indexed by uuid and handle, keep them shared
+	copies := map[*ServiceHandle]*ServiceHandle{}
+
+	for k, s := range p.Services {
+		cs, ok := copies[s]
+		if !ok {
+			cs = s.snapshot()
+			copies[s] = cs
+		}
+
+		cp.Services[k] = cs
+	}
+
+	return &cp
 }
 
-// GATT Characteristic
-type Characteristic struct {
-	uuid        xpc.UUID
-	properties  Property
-	secure      Property
-	descriptors []Descriptor
-	value       []byte
+func (s *ServiceHandle) snapshot() *ServiceHandle {
+	cs := *s
+	cs.Characteristics = make(map[interface{}]*ServiceCharacteristic, len(s.Characteristics))
+
+	copies := map[*ServiceCharacteristic]*ServiceCharacteristic{}
+
+	for k, c := range s.Characteristics {
+		cc, ok := copies[c]
+		if !ok {
+			cc = c.snapshot()
+			copies[c] = cc
+		}
+
+		cs.Characteristics[k] = cc
+	}
+
+	return &cs
+}
+
+func (c *ServiceCharacteristic) snapshot() *ServiceCharacteristic {
+	cc := *c
+	cc.Descriptors = make(map[interface{}]*CharacteristicDescriptor, len(c.Descriptors))
+
+	copies := map[*CharacteristicDescriptor]*CharacteristicDescriptor{}
+
+	for k, d := range c.Descriptors {
+		cd, ok := copies[d]
+		if !ok {
+			dd := *d
+			cd = &dd
+			copies[d] = cd
+		}
+
+		cc.Descriptors[k] = cd
+	}
+
+	return &cc
+}
+
+// find the characteristic with the specified handle (or value handle), and the service it belongs to
+func (p *Peripheral) findCharacteristic(handle int) (*ServiceHandle, *ServiceCharacteristic) {
+	for _, s := range p.Services {
+		if c, ok := s.Characteristics[handle]; ok {
+			return s, c
+		}
+	}
+
+	return nil, nil
 }
 
-// GATT Service
-type Service struct {
-	uuid            xpc.UUID
-	characteristics []Characteristic
+// find the descriptor with the specified handle (and the service and characteristic it belongs to)
+func (p *Peripheral) findDescriptor(handle int) (*ServiceHandle, *ServiceCharacteristic, *CharacteristicDescriptor) {
+	for _, s := range p.Services {
+		for _, c := range s.Characteristics {
+			if d, ok := c.Descriptors[handle]; ok {
+				return s, c, d
+			}
+		}
+	}
+
+	return nil, nil, nil
 }
 
 type BLE struct {
 	Emitter
-	conn    xpc.XPC
+	conn    Transport
 	verbose bool
 
-	peripherals            map[string]*Peripheral
-	attributes             xpc.Array
-	lastServiceAttributeId int
-	allowDuplicates        bool
-
-	utsname xpc.Utsname
+	peripherals     map[string]*Peripheral
+	peripheralsLock sync.RWMutex
+	attributes      xpc.Array        // GATT server attributes (services and characteristics), by attribute id (nil if removed)
+	pendingServices map[int]*Service // services set with SetServices, waiting for blued, by attribute id
+	servicesErrors  map[string]error // results of the services set with SetServices, by service UUID
+	servicesErr     error            // first error of the services set with SetServices
+	attributesLock  sync.Mutex
+	updateQueue     []xpc.Dict // value updates waiting for blued to be ready
+	failedUpdates   []xpc.Dict // value updates not sent because the transmit queue was full
+	sentUpdates     []xpc.Dict // the latest value updates sent
+	queueFull       bool
+	allowDuplicates bool
+	scanning        bool
+
+	protocol *Protocol
 }
 
-func New() *BLE {
-	ble := &BLE{peripherals: map[string]*Peripheral{}, Emitter: Emitter{}}
+// NewWithTransport creates a BLE that talks to blued using the specified Transport
+func NewWithTransport(t Transport) *BLE {
+	ble := &BLE{peripherals: map[string]*Peripheral{}, Emitter: Emitter{}, conn: t}
 	ble.Emitter.Init()
-	ble.conn = xpc.XpcConnect("com.apple.blued", ble)
-	xpc.Uname(&ble.utsname)
+	ble.protocol = ProtocolFor(t.Release())
+	t.SetEventHandler(ble)
 	return ble
 }
 
+// Close stops the dispatch of events (see Emitter.Close) and closes the connection to blued.
+// It's safe to call Close from an event handler.
+func (ble *BLE) Close() error {
+	ble.Emitter.Close()
+	return ble.conn.Close()
+}
+
+// Peripherals returns a snapshot of the discovered peripherals, sorted by UUID
+func (ble *BLE) Peripherals() []*Peripheral {
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
+	peripherals := make([]*Peripheral, 0, len(ble.peripherals))
+	for _, p := range ble.peripherals {
+		peripherals = append(peripherals, p.snapshot())
+	}
+
+	sort.Slice(peripherals, func(i, j int) bool {
+		return peripherals[i].Uuid.String() < peripherals[j].Uuid.String()
+	})
+
+	return peripherals
+}
+
+// Peripheral returns a snapshot of the discovered peripheral with the specified UUID
+func (ble *BLE) Peripheral(deviceUuid xpc.UUID) (*Peripheral, bool) {
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
+	if p, ok := ble.peripherals[deviceUuid.String()]; ok {
+		return p.snapshot(), true
+	}
+
+	return nil, false
+}
+
+// ForgetPeripheral removes the peripheral with the specified UUID from the discovered peripherals,
+// so that it's reported again by the next scan
+func (ble *BLE) ForgetPeripheral(deviceUuid xpc.UUID) {
+	ble.peripheralsLock.Lock()
+	delete(ble.peripherals, deviceUuid.String())
+	ble.peripheralsLock.Unlock()
+}
+
+// Protocol returns the Protocol used to talk to blued (selected by OS release)
+func (ble *BLE) Protocol() *Protocol {
+	return ble.protocol
+}
+
+// SetProtocol overrides the Protocol used to talk to blued (see also RegisterProtocolProfile).
+// It should be called before Init (i.e. before any message is sent or received).
+func (ble *BLE) SetProtocol(p *Protocol) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	ble.protocol = p
+	return nil
+}
+
 func (ble *BLE) SetVerbose(v bool) {
 	ble.verbose = v
 	ble.Emitter.SetVerbose(v)
@@ -161,26 +323,59 @@ func (ble *BLE) SetVerbose(v bool) {
 
 // process BLE events and asynchronous errors
 // (implements XpcEventHandler)
+//
+// Messages that cannot be decoded (or that have unexpected values) are reported
+// as "protocolError" events, with a *ProtocolError.
 func (ble *BLE) HandleXpcEvent(event xpc.Dict, err error) {
 	if err != nil {
 		log.Println("error:", err)
 		if event == nil {
+			if _, ok := err.(*xpc.ConversionError); ok {
+				ble.Emit(Event{Name: "protocolError", Err: &ProtocolError{Err: err}})
+			}
 			return
 		}
 	}
 
+	defer func() {
+		if r := recover(); r != nil {
+			perr := &ProtocolError{Message: event}
+			if err, ok := r.(error); ok {
+				perr.Err = err
+			} else {
+				perr.Err = fmt.Errorf("%v", r)
+			}
+
+			if ble.verbose {
+				log.Println(perr)
+			}
+
+			ble.Emit(Event{Name: "protocolError", Err: perr})
+		}
+	}()
+
 	id := event.MustGetInt("kCBMsgId")
 	args := event.MustGetDict("kCBMsgArgs")
 
-retry_switch:
+	name := ble.protocol.Events[id]
+
 	if ble.verbose {
-		log.Printf("event: %v %#v\n", id, args)
+		log.Printf("event: %v %v %#v\n", id, name, args)
 		defer log.Printf("done event: %v", id)
 	}
 
-	switch id {
-	case 4, 6: // state change
-		if id == 6 && ble.utsname.Release >= "19." {
+	// the GATT server events don't use the peripherals (and call the application handlers)
+	if ble.handleServerEvent(name, args) {
+		return
+	}
+
+	ble.peripheralsLock.Lock()
+	defer ble.peripheralsLock.Unlock()
+
+retry_switch:
+	switch name {
+	case "stateChange":
+		if id == 6 {
 			if _, ok := args["kCBMsgArgState"]; !ok {
 				// this is not a state change event
 				//
@@ -192,23 +387,23 @@ retry_switch:
 		state := args.MustGetInt("kCBMsgArgState")
 		ble.Emit(Event{Name: "stateChange", State: STATES[state]})
 
-	case 16: // advertising start
+	case "advertisingStart":
 		result := args.MustGetInt("kCBMsgArgResult")
 		if result != 0 {
-			log.Printf("event: error in advertisingStart %v\n", result)
+			ble.Emit(Event{Name: "advertisingStartError", Result: result, Err: cbError(result)})
 		} else {
 			ble.Emit(Event{Name: "advertisingStart"})
 		}
 
-	case 17: // advertising stop
+	case "advertisingStop":
 		result := args.MustGetInt("kCBMsgArgResult")
 		if result != 0 {
-			log.Printf("event: error in advertisingStop %v\n", result)
+			ble.Emit(Event{Name: "advertisingStopError", Result: result, Err: cbError(result)})
 		} else {
 			ble.Emit(Event{Name: "advertisingStop"})
 		}
 
-	case 37, 48, 51, 57, 60: // discover
+	case "discover":
 		advdata := args.MustGetDict("kCBMsgArgAdvertisementData")
 		if len(advdata) == 0 {
 			//log.Println("event: discover with no advertisment data")
@@ -269,95 +464,77 @@ retry_switch:
 		}
 
 		if emit {
-			ble.Emit(Event{Name: "discover", DeviceUUID: deviceUuid, Peripheral: *p})
-		}
-
-	case 38, 58, 67, 86: // connect
-		if id == 38 && ble.utsname.Release >= "18." {
-			// this is not a connect (it doesn't have kCBMsgArgDeviceUUID,
-			// but instead has kCBAdvDataDeviceAddress)
-			break
+			ble.Emit(Event{Name: "discover", DeviceUUID: deviceUuid, Peripheral: *p.snapshot()})
 		}
 
+	case "connect":
 		deviceUuid := args.MustGetUUID("kCBMsgArgDeviceUUID")
-		ble.Emit(Event{Name: "connect", DeviceUUID: deviceUuid})
+		result := args.GetInt("kCBMsgArgResult", 0)
+		ble.Emit(Event{Name: "connect", DeviceUUID: deviceUuid, Result: result, Err: cbError(result)})
 
-	case 40: // disconnect (+ 53 see next)
+	case "disconnect":
 		deviceUuid := args.MustGetUUID("kCBMsgArgDeviceUUID")
 		ble.Emit(Event{Name: "disconnect", DeviceUUID: deviceUuid})
 
-	case 53: // mtuChange
-		if ble.utsname.Release >= "14." {
-			// this is actually a disconnect
-			deviceUuid := args.MustGetUUID("kCBMsgArgDeviceUUID")
-			ble.Emit(Event{Name: "disconnect", DeviceUUID: deviceUuid})
-			break
-		}
-
+	case "mtuChange":
 		deviceUuid := args.MustGetUUID("kCBMsgArgDeviceUUID")
 		mtu := args.MustGetInt("kCBMsgArgATTMTU")
 
 		// bleno here converts the deviceUuid to an address
 		if p, ok := ble.peripherals[deviceUuid.String()]; ok {
-			ble.Emit(Event{Name: "mtuChange", DeviceUUID: deviceUuid, Peripheral: *p, Mtu: mtu})
+			ble.Emit(Event{Name: "mtuChange", DeviceUUID: deviceUuid, Peripheral: *p.snapshot(), Mtu: mtu})
 		}
 
-	case 54, 82: // serviceDiscover
-		deviceUuid := args.MustGetUUID("kCBMsgArgDeviceUUID")
-		servicesUuids := []string{}
-		servicesHandles := map[interface{}]*ServiceHandle{}
+	case "servicesDiscover":
+		var a servicesDiscoverArgs
+		mustUnmarshal(args, &a)
 
-		if dservices, ok := args["kCBMsgArgServices"]; ok {
-			for _, s := range dservices.(xpc.Array) {
-				service := s.(xpc.Dict)
-				serviceHandle := ServiceHandle{
-					Uuid:            service.MustGetHexBytes("kCBMsgArgUUID"),
-					startHandle:     service.MustGetInt("kCBMsgArgServiceStartHandle"),
-					endHandle:       service.MustGetInt("kCBMsgArgServiceEndHandle"),
-					Characteristics: map[interface{}]*ServiceCharacteristic{}}
-
-				if nameType, ok := knownServices[serviceHandle.Uuid]; ok {
-					serviceHandle.Name = nameType.Name
-					serviceHandle.Type = nameType.Type
-				}
+		servicesHandles := map[interface{}]*ServiceHandle{}
 
-				servicesHandles[serviceHandle.Uuid] = &serviceHandle
-				servicesHandles[serviceHandle.startHandle] = &serviceHandle
+		for _, s := range a.Services {
+			serviceHandle := &ServiceHandle{
+				Uuid:            s.Uuid,
+				startHandle:     s.StartHandle,
+				endHandle:       s.EndHandle,
+				Characteristics: map[interface{}]*ServiceCharacteristic{}}
 
-				servicesUuids = append(servicesUuids, serviceHandle.Uuid)
+			if nameType, ok := knownServices[serviceHandle.Uuid]; ok {
+				serviceHandle.Name = nameType.Name
+				serviceHandle.Type = nameType.Type
 			}
+
+			servicesHandles[serviceHandle.Uuid] = serviceHandle
+			servicesHandles[serviceHandle.startHandle] = serviceHandle
 		}
 
-		if p, ok := ble.peripherals[deviceUuid.String()]; ok {
-			p.Services = servicesHandles
-			ble.Emit(Event{Name: "servicesDiscover", DeviceUUID: deviceUuid, Peripheral: *p})
+		if p, ok := ble.peripherals[a.DeviceUUID.String()]; ok {
+			if a.Result == 0 {
+				p.Services = servicesHandles
+			}
+			ble.Emit(Event{Name: "servicesDiscover", DeviceUUID: a.DeviceUUID, Peripheral: *p.snapshot(), Result: a.Result, Err: attError(a.Result)})
 		}
 
-	case 55: // rssiUpdate
+	case "rssiUpdate":
 		deviceUuid := args.MustGetUUID("kCBMsgArgDeviceUUID")
 		rssi := args.MustGetInt("kCBMsgArgData")
 
 		if p, ok := ble.peripherals[deviceUuid.String()]; ok {
 			p.Rssi = rssi
-			ble.Emit(Event{Name: "rssiUpdate", DeviceUUID: deviceUuid, Peripheral: *p})
+			ble.Emit(Event{Name: "rssiUpdate", DeviceUUID: deviceUuid, Peripheral: *p.snapshot()})
 		}
 
-	case 63, 89: // characteristicsDiscover
-		deviceUuid := args.MustGetUUID("kCBMsgArgDeviceUUID")
-		serviceStartHandle := args.MustGetInt("kCBMsgArgServiceStartHandle")
-
-		if p, ok := ble.peripherals[deviceUuid.String()]; ok {
-			service := p.Services[serviceStartHandle]
+	case "characteristicsDiscover":
+		var a characteristicsDiscoverArgs
+		mustUnmarshal(args, &a)
 
-			//result := args.MustGetInt("kCBMsgArgResult")
+		if p, ok := ble.peripherals[a.DeviceUUID.String()]; ok {
+			service := p.Services[a.ServiceStartHandle]
 
-			for _, c := range args.MustGetArray("kCBMsgArgCharacteristics") {
-				cDict := c.(xpc.Dict)
-
-				characteristic := ServiceCharacteristic{
-					Uuid:        cDict.MustGetHexBytes("kCBMsgArgUUID"),
-					Handle:      cDict.MustGetInt("kCBMsgArgCharacteristicHandle"),
-					ValueHandle: cDict.MustGetInt("kCBMsgArgCharacteristicValueHandle"),
+			for _, c := range a.Characteristics {
+				characteristic := &ServiceCharacteristic{
+					Uuid:        c.Uuid,
+					Handle:      c.Handle,
+					ValueHandle: c.ValueHandle,
 					Descriptors: map[interface{}]*CharacteristicDescriptor{},
 				}
 
@@ -366,7 +543,7 @@ retry_switch:
 					characteristic.Type = nameType.Type
 				}
 
-				properties := cDict.MustGetInt("kCBMsgArgCharacteristicProperties")
+				properties := c.Properties
 
 				if (properties & 0x01) != 0 {
 					characteristic.Properties |= Broadcast
@@ -401,69 +578,111 @@ retry_switch:
 				}
 
 				if service != nil {
-					service.Characteristics[characteristic.Uuid] = &characteristic
-					service.Characteristics[characteristic.Handle] = &characteristic
-					service.Characteristics[characteristic.ValueHandle] = &characteristic
+					service.Characteristics[characteristic.Uuid] = characteristic
+					service.Characteristics[characteristic.Handle] = characteristic
+					service.Characteristics[characteristic.ValueHandle] = characteristic
 				}
 			}
 
 			if service != nil {
-				ble.Emit(Event{Name: "characteristicsDiscover", DeviceUUID: deviceUuid, ServiceUuid: service.Uuid, Peripheral: *p})
+				ble.Emit(Event{Name: "characteristicsDiscover", DeviceUUID: a.DeviceUUID, ServiceUuid: service.Uuid, Peripheral: *p.snapshot(), Result: a.Result, Err: attError(a.Result)})
 			} else {
-				log.Println("no service", serviceStartHandle)
+				log.Println("no service", a.ServiceStartHandle)
 			}
 		} else {
-			log.Println("no peripheral", deviceUuid)
+			log.Println("no peripheral", a.DeviceUUID)
 		}
 
-	case 75, 99: // descriptorsDiscover
-		if id == 99 && ble.utsname.Release >= "19." {
-			if _, ok := args["kCBMsgArgServiceStartHandle"]; ok {
-				// this is actually a service discover event
-				id = 82
-				goto retry_switch
-			}
+	case "descriptorsDiscover":
+		if _, ok := args["kCBMsgArgServiceStartHandle"]; ok {
+			// this is actually a service discover event (id 99 on 19.x)
+			name = "servicesDiscover"
+			goto retry_switch
 		}
 
-		deviceUuid := args.MustGetUUID("kCBMsgArgDeviceUUID")
-		characteristicsHandle := args.MustGetInt("kCBMsgArgCharacteristicHandle")
-		//result := args.MustGetInt("kCBMsgArgResult")
+		var a descriptorsDiscoverArgs
+		mustUnmarshal(args, &a)
 
-		if p, ok := ble.peripherals[deviceUuid.String()]; ok {
+		if p, ok := ble.peripherals[a.DeviceUUID.String()]; ok {
 			for _, s := range p.Services {
-				if c, ok := s.Characteristics[characteristicsHandle]; ok {
-					for _, d := range args.MustGetArray("kCBMsgArgDescriptors") {
-						dDict := d.(xpc.Dict)
-						descriptor := CharacteristicDescriptor{
-							Uuid:   dDict.MustGetHexBytes("kCBMsgArgUUID"),
-							Handle: dDict.MustGetInt("kCBMsgArgDescriptorHandle"),
+				if c, ok := s.Characteristics[a.CharacteristicHandle]; ok {
+					for _, d := range a.Descriptors {
+						descriptor := &CharacteristicDescriptor{
+							Uuid:   d.Uuid,
+							Handle: d.Handle,
 						}
 
-						c.Descriptors[descriptor.Uuid] = &descriptor
-						c.Descriptors[descriptor.Handle] = &descriptor
+						c.Descriptors[descriptor.Uuid] = descriptor
+						c.Descriptors[descriptor.Handle] = descriptor
 					}
 
-					ble.Emit(Event{Name: "descriptorsDiscover", DeviceUUID: deviceUuid, ServiceUuid: s.Uuid, CharacteristicUuid: c.Uuid, Peripheral: *p})
+					ble.Emit(Event{Name: "descriptorsDiscover", DeviceUUID: a.DeviceUUID, ServiceUuid: s.Uuid, CharacteristicUuid: c.Uuid, Peripheral: *p.snapshot(), Result: a.Result, Err: attError(a.Result)})
 					break
 				}
 			}
 		} else {
-			log.Println("no peripheral", deviceUuid)
+			log.Println("no peripheral", a.DeviceUUID)
 		}
 
-	case 70, 95, 115: // read
-		deviceUuid := args.MustGetUUID("kCBMsgArgDeviceUUID")
-		characteristicsHandle := args.MustGetInt("kCBMsgArgCharacteristicHandle")
-		//result := args.MustGetInt("kCBMsgArgResult")
-		isNotification := args.GetInt("kCBMsgArgIsNotification", 0) != 0
-		data := args.MustGetBytes("kCBMsgArgData")
+	case "read": // (or notification)
+		var a characteristicValueArgs
+		mustUnmarshal(args, &a)
 
-		if p, ok := ble.peripherals[deviceUuid.String()]; ok {
-			for _, s := range p.Services {
-				if c, ok := s.Characteristics[characteristicsHandle]; ok {
-					ble.Emit(Event{Name: "read", DeviceUUID: deviceUuid, ServiceUuid: s.Uuid, CharacteristicUuid: c.Uuid, Peripheral: *p, Data: data, IsNotification: isNotification})
-					break
+		if a.IsNotification {
+			name = "notification"
+		}
+
+		if p, ok := ble.peripherals[a.DeviceUUID.String()]; ok {
+			if s, c := p.findCharacteristic(a.CharacteristicHandle); c != nil {
+				ble.Emit(Event{Name: name, DeviceUUID: a.DeviceUUID, ServiceUuid: s.Uuid, CharacteristicUuid: c.Uuid, Peripheral: *p.snapshot(), Data: a.Data, IsNotification: a.IsNotification, Result: a.Result, Err: attError(a.Result)})
+			}
+		}
+
+	case "write":
+		var a characteristicValueArgs
+		mustUnmarshal(args, &a)
+
+		if p, ok := ble.peripherals[a.DeviceUUID.String()]; ok {
+			if s, c := p.findCharacteristic(a.CharacteristicHandle); c != nil {
+				ble.Emit(Event{Name: "write", DeviceUUID: a.DeviceUUID, ServiceUuid: s.Uuid, CharacteristicUuid: c.Uuid, Peripheral: *p.snapshot(), Result: a.Result, Err: attError(a.Result)})
+			}
+		}
+
+	case "valueRead": // descriptor
+		var a descriptorValueArgs
+		mustUnmarshal(args, &a)
+
+		if p, ok := ble.peripherals[a.DeviceUUID.String()]; ok {
+			if s, c, d := p.findDescriptor(a.DescriptorHandle); d != nil {
+				ble.Emit(Event{Name: "valueRead", DeviceUUID: a.DeviceUUID, ServiceUuid: s.Uuid, CharacteristicUuid: c.Uuid, DescriptorUuid: d.Uuid, Peripheral: *p.snapshot(), Data: a.Data, Result: a.Result, Err: attError(a.Result)})
+			} else {
+				log.Println("no descriptor", a.DescriptorHandle)
+			}
+		}
+
+	case "valueWrite": // descriptor
+		var a descriptorValueArgs
+		mustUnmarshal(args, &a)
+
+		if p, ok := ble.peripherals[a.DeviceUUID.String()]; ok {
+			if s, c, d := p.findDescriptor(a.DescriptorHandle); d != nil {
+				ble.Emit(Event{Name: "valueWrite", DeviceUUID: a.DeviceUUID, ServiceUuid: s.Uuid, CharacteristicUuid: c.Uuid, DescriptorUuid: d.Uuid, Peripheral: *p.snapshot(), Result: a.Result, Err: attError(a.Result)})
+			} else {
+				log.Println("no descriptor", a.DescriptorHandle)
+			}
+		}
+
+	case "notify": // state change
+		var a characteristicValueArgs
+		mustUnmarshal(args, &a)
+
+		if p, ok := ble.peripherals[a.DeviceUUID.String()]; ok {
+			if s, c := p.findCharacteristic(a.CharacteristicHandle); c != nil {
+				if a.Result == 0 {
+					c.Notifying = a.State
 				}
+
+				ble.Emit(Event{Name: "notify", DeviceUUID: a.DeviceUUID, ServiceUuid: s.Uuid, CharacteristicUuid: c.Uuid, Peripheral: *p.snapshot(), Notifying: a.State, Result: a.Result, Err: attError(a.Result)})
 			}
 		}
 	}
@@ -472,6 +691,13 @@ retry_switch:
 // send a message to Blued
 func (ble *BLE) sendCBMsg(id int, args xpc.Dict) {
 	message := xpc.Dict{"kCBMsgId": id, "kCBMsgArgs": args}
+	if ble.closed() {
+		if ble.verbose {
+			log.Printf("sendCBMsg after Close %#v\n", message)
+		}
+		return
+	}
+
 	if ble.verbose {
 		log.Printf("sendCBMsg %#v\n", message)
 	}
@@ -479,9 +705,20 @@ func (ble *BLE) sendCBMsg(id int, args xpc.Dict) {
 	ble.conn.Send(message, ble.verbose)
 }
 
+// send a command to Blued, using the message id for the current protocol
+func (ble *BLE) sendCommand(name string, args xpc.Dict) {
+	id, err := ble.protocol.CommandId(name)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ble.sendCBMsg(id, args)
+}
+
 // initialize BLE
 func (ble *BLE) Init() {
-	ble.sendCBMsg(1, xpc.Dict{"kCBMsgArgName": fmt.Sprintf("goble-%v", time.Now().Unix()),
+	ble.sendCommand("init", xpc.Dict{"kCBMsgArgName": fmt.Sprintf("goble-%v", time.Now().Unix()),
 		"kCBMsgArgOptions": xpc.Dict{"kCBInitOptionShowPowerAlert": 0}, "kCBMsgArgType": 0})
 }
 
@@ -491,18 +728,22 @@ func (ble *BLE) StartAdvertising(name string, serviceUuids []xpc.UUID) {
 	for i, uuid := range serviceUuids {
 		uuids[i] = []byte(uuid[:])
 	}
-	ble.sendCBMsg(8, xpc.Dict{"kCBAdvDataLocalName": name, "kCBAdvDataServiceUUIDs": uuids})
+	ble.sendCommand("startAdvertising", xpc.Dict{"kCBAdvDataLocalName": name, "kCBAdvDataServiceUUIDs": uuids})
 }
 
 // start advertising as IBeacon (raw data)
 func (ble *BLE) StartAdvertisingIBeaconData(data []byte) {
-	if ble.utsname.Release >= "14." {
-		l := len(data)
-		buf := bytes.NewBuffer([]byte{byte(l + 5), 0xFF, 0x4C, 0x00, 0x02, byte(l)})
-		buf.Write(data)
-		ble.sendCBMsg(8, xpc.Dict{"kCBAdvDataAppleMfgData": buf.Bytes()})
+	if ble.protocol.AtLeast("14") {
+		mfgData := append([]byte{0x4C, 0x00, 0x02, byte(len(data))}, data...)
+		b, err := adv.Build(adv.Field{Type: adv.TypeManufacturerSpecificData, Data: mfgData})
+		if err != nil {
+			log.Println("iBeacon data:", err)
+			return
+		}
+
+		ble.sendCommand("startAdvertising", xpc.Dict{"kCBAdvDataAppleMfgData": b})
 	} else {
-		ble.sendCBMsg(8, xpc.Dict{"kCBAdvDataAppleBeaconKey": data})
+		ble.sendCommand("startAdvertising", xpc.Dict{"kCBAdvDataAppleBeaconKey": data})
 	}
 }
 
@@ -517,9 +758,87 @@ func (ble *BLE) StartAdvertisingIBeacon(uuid xpc.UUID, major, minor uint16, meas
 	ble.StartAdvertisingIBeaconData(buf.Bytes())
 }
 
+// start advertising the specified advertising data.
+//
+// The raw advertising data is only supported starting from release 14, before that only the local name,
+// service UUIDs, service data and manufacturer data are advertised.
+func (ble *BLE) StartAdvertisingData(ad *adv.AdvertisingData) error {
+	b, err := ad.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if ble.protocol.AtLeast("14") {
+		ble.sendCommand("startAdvertising", xpc.Dict{"kCBAdvDataAppleMfgData": b})
+		return nil
+	}
+
+	args := xpc.Dict{}
+
+	if ad.LocalName != "" {
+		args["kCBAdvDataLocalName"] = ad.LocalName
+	}
+
+	if len(ad.ServiceUuids) > 0 {
+		uuids := make([][]byte, len(ad.ServiceUuids))
+		for i, uuid := range ad.ServiceUuids {
+			uuids[i], _ = hex.DecodeString(strings.Replace(uuid, "-", "", -1)) // already validated by Bytes
+		}
+		args["kCBAdvDataServiceUUIDs"] = uuids
+	}
+
+	if len(ad.ServiceData) > 0 {
+		sdata := xpc.Array{}
+		for _, sd := range ad.ServiceData {
+			uuid, _ := hex.DecodeString(strings.Replace(sd.Uuid, "-", "", -1))
+			sdata = append(sdata, uuid, sd.Data)
+		}
+		args["kCBAdvDataServiceData"] = sdata
+	}
+
+	if ad.ManufacturerData != nil {
+		args["kCBAdvDataManufacturerData"] = ad.ManufacturerData
+	}
+
+	ble.sendCommand("startAdvertising", args)
+	return nil
+}
+
+// start advertising as a beacon (see the beacon package)
+func (ble *BLE) StartAdvertisingBeacon(b beacon.Beacon) error {
+	ad, err := beacon.AdvertisingData(b)
+	if err != nil {
+		return err
+	}
+
+	return ble.StartAdvertisingData(ad)
+}
+
+// start advertising as Eddystone-URL.
+// The URL is compressed, and must be at most 17 bytes after the scheme.
+func (ble *BLE) StartAdvertisingEddystoneURL(url string, txPower int8) error {
+	return ble.StartAdvertisingBeacon(&beacon.EddystoneURL{URL: url, TxPower: txPower})
+}
+
+// start advertising as Eddystone-UID
+func (ble *BLE) StartAdvertisingEddystoneUID(namespace [10]byte, instance [6]byte, txPower int8) error {
+	return ble.StartAdvertisingBeacon(&beacon.EddystoneUID{Namespace: namespace, Instance: instance, TxPower: txPower})
+}
+
+// start advertising as Eddystone-TLM (battery in mV, temperature in degrees Celsius,
+// advCount and secCount since power-up, with secCount in 0.1 seconds)
+func (ble *BLE) StartAdvertisingEddystoneTLM(battery uint16, temperature float64, advCount, secCount uint32) error {
+	return ble.StartAdvertisingBeacon(&beacon.EddystoneTLM{Battery: battery, Temperature: temperature, AdvCount: advCount, SecCount: secCount})
+}
+
+// start advertising as AltBeacon
+func (ble *BLE) StartAdvertisingAltBeacon(companyId uint16, id [20]byte, referenceRSSI int8) error {
+	return ble.StartAdvertisingBeacon(&beacon.AltBeacon{CompanyId: companyId, ID: id, ReferenceRSSI: referenceRSSI})
+}
+
 // stop advertising
 func (ble *BLE) StopAdvertising() {
-	ble.sendCBMsg(9, nil)
+	ble.sendCommand("stopAdvertising", nil)
 }
 
 // start scanning
@@ -538,41 +857,30 @@ func (ble *BLE) StartScanning(serviceUuids []xpc.UUID, allowDuplicates bool) {
 	}
 
 	ble.allowDuplicates = allowDuplicates
-	msg := 29
-	if ble.utsname.Release >= "19.4" {
-		msg = 53
-	} else if ble.utsname.Release >= "19." {
-		msg = 51
-	} else if ble.utsname.Release >= "18." {
-		msg = 46
-	} else if ble.utsname.Release >= "17." {
-		msg = 44
-	}
-	ble.sendCBMsg(msg, args)
+	ble.scanning = true
+	ble.sendCommand("startScanning", args)
 }
 
 // stop scanning
 func (ble *BLE) StopScanning() {
-	msg := 30
-	if ble.utsname.Release >= "19." {
-		msg = 52
-	} else if ble.utsname.Release >= "18." {
-		msg = 47
-	}
-	ble.sendCBMsg(msg, nil)
+	ble.scanning = false
+
+	ble.sendCommand("stopScanning", nil)
+}
+
+// Scanning returns true if StartScanning has been called (and StopScanning has not)
+func (ble *BLE) Scanning() bool {
+	return ble.scanning
 }
 
 // connect
 func (ble *BLE) Connect(deviceUuid xpc.UUID) {
 	uuid := deviceUuid.String()
-	msg := 31
-	if ble.utsname.Release >= "19." {
-		msg = 53
-	} else if ble.utsname.Release >= "18." {
-		msg = 48
-	}
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
 	if p, ok := ble.peripherals[uuid]; ok {
-		ble.sendCBMsg(msg, xpc.Dict{"kCBMsgArgOptions": xpc.Dict{"kCBConnectOptionNotifyOnDisconnection": 1}, "kCBMsgArgDeviceUUID": p.Uuid})
+		ble.sendCommand("connect", xpc.Dict{"kCBMsgArgOptions": xpc.Dict{"kCBConnectOptionNotifyOnDisconnection": 1}, "kCBMsgArgDeviceUUID": p.Uuid})
 	} else {
 		log.Println("no peripheral", deviceUuid)
 	}
@@ -581,14 +889,11 @@ func (ble *BLE) Connect(deviceUuid xpc.UUID) {
 // disconnect
 func (ble *BLE) Disconnect(deviceUuid xpc.UUID) {
 	uuid := deviceUuid.String()
-	msg := 32
-	if ble.utsname.Release >= "19." {
-		msg = 45
-	} else if ble.utsname.Release >= "18." {
-		msg = 49
-	}
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
 	if p, ok := ble.peripherals[uuid]; ok {
-		ble.sendCBMsg(msg, xpc.Dict{"kCBMsgArgDeviceUUID": p.Uuid})
+		ble.sendCommand("disconnect", xpc.Dict{"kCBMsgArgDeviceUUID": p.Uuid})
 	} else {
 		log.Println("no peripheral", deviceUuid)
 	}
@@ -597,14 +902,11 @@ func (ble *BLE) Disconnect(deviceUuid xpc.UUID) {
 // update rssi
 func (ble *BLE) UpdateRssi(deviceUuid xpc.UUID) {
 	uuid := deviceUuid.String()
-	msg := 43
-	if ble.utsname.Release >= "19." {
-		msg = 76 // or 93 ?
-	} else if ble.utsname.Release >= "18." {
-		msg = 71
-	}
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
 	if p, ok := ble.peripherals[uuid]; ok {
-		ble.sendCBMsg(msg, xpc.Dict{"kCBMsgArgDeviceUUID": p.Uuid})
+		ble.sendCommand("updateRssi", xpc.Dict{"kCBMsgArgDeviceUUID": p.Uuid})
 	} else {
 		log.Println("no peripheral", deviceUuid)
 	}
@@ -613,18 +915,15 @@ func (ble *BLE) UpdateRssi(deviceUuid xpc.UUID) {
 // discover services
 func (ble *BLE) DiscoverServices(deviceUuid xpc.UUID, uuids []xpc.UUID) {
 	sUuid := deviceUuid.String()
-	msg := 44
-	if ble.utsname.Release >= "19." {
-		msg = 77
-	} else if ble.utsname.Release >= "18." {
-		msg = 72
-	}
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
 	if p, ok := ble.peripherals[sUuid]; ok {
 		sUuids := make([]string, len(uuids))
 		for i, uuid := range uuids {
 			sUuids[i] = uuid.String() // uuids may be a list of []byte (2 bytes)
 		}
-		ble.sendCBMsg(msg, xpc.Dict{"kCBMsgArgDeviceUUID": p.Uuid, "kCBMsgArgUUIDs": sUuids})
+		ble.sendCommand("discoverServices", xpc.Dict{"kCBMsgArgDeviceUUID": p.Uuid, "kCBMsgArgUUIDs": sUuids})
 	} else {
 		log.Println("no peripheral", deviceUuid)
 	}
@@ -633,19 +932,16 @@ func (ble *BLE) DiscoverServices(deviceUuid xpc.UUID, uuids []xpc.UUID) {
 // discover characteristics
 func (ble *BLE) DiscoverCharacteristics(deviceUuid xpc.UUID, serviceUuid string, characteristicUuids []string) {
 	sUuid := deviceUuid.String()
-	msg := 61
-	if ble.utsname.Release >= "19." {
-		msg = 92
-	} else if ble.utsname.Release >= "18." {
-		msg = 87
-	}
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
 	if p, ok := ble.peripherals[sUuid]; ok {
 		cUuids := make([]string, len(characteristicUuids))
 		for i, cuuid := range characteristicUuids {
 			cUuids[i] = cuuid // characteristicUuids may be a list of []byte (2 bytes)
 		}
 
-		ble.sendCBMsg(msg, xpc.Dict{
+		ble.sendCommand("discoverCharacteristics", xpc.Dict{
 			"kCBMsgArgDeviceUUID":         p.Uuid,
 			"kCBMsgArgServiceStartHandle": p.Services[serviceUuid].startHandle,
 			"kCBMsgArgServiceEndHandle":   p.Services[serviceUuid].endHandle,
@@ -660,17 +956,14 @@ func (ble *BLE) DiscoverCharacteristics(deviceUuid xpc.UUID, serviceUuid string,
 // discover descriptors
 func (ble *BLE) DiscoverDescriptors(deviceUuid xpc.UUID, serviceUuid, characteristicUuid string) {
 	sUuid := deviceUuid.String()
-	msg := 69
-	if ble.utsname.Release >= "19." {
-		msg = 99
-	} else if ble.utsname.Release >= "18." {
-		msg = 94
-	}
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
 	if p, ok := ble.peripherals[sUuid]; ok {
 		s := p.Services[serviceUuid]
 		c := s.Characteristics[characteristicUuid]
 
-		ble.sendCBMsg(msg, xpc.Dict{
+		ble.sendCommand("discoverDescriptors", xpc.Dict{
 			"kCBMsgArgDeviceUUID":                p.Uuid,
 			"kCBMsgArgCharacteristicHandle":      c.Handle,
 			"kCBMsgArgCharacteristicValueHandle": c.ValueHandle,
@@ -683,22 +976,145 @@ func (ble *BLE) DiscoverDescriptors(deviceUuid xpc.UUID, serviceUuid, characteri
 // read
 func (ble *BLE) Read(deviceUuid xpc.UUID, serviceUuid, characteristicUuid string) {
 	sUuid := deviceUuid.String()
-	msg := 64
-	if ble.utsname.Release >= "19.4" {
-		msg = 90
-	} else if ble.utsname.Release >= "19." {
-		msg = 105
-	} else if ble.utsname.Release >= "18." {
-		msg = 100
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
+	if p, ok := ble.peripherals[sUuid]; ok {
+		s := p.Services[serviceUuid]
+		c := s.Characteristics[characteristicUuid]
+
+		ble.sendCommand("read", xpc.Dict{
+			"kCBMsgArgDeviceUUID":                p.Uuid,
+			"kCBMsgArgCharacteristicHandle":      c.Handle,
+			"kCBMsgArgCharacteristicValueHandle": c.ValueHandle,
+		})
+	} else {
+		log.Println("no peripheral", deviceUuid)
 	}
+}
+
+// write
+//
+// If withoutResponse is true blued doesn't send a confirmation, and the "write" event is emitted right away.
+func (ble *BLE) Write(deviceUuid xpc.UUID, serviceUuid, characteristicUuid string, data []byte, withoutResponse bool) {
+	sUuid := deviceUuid.String()
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
 	if p, ok := ble.peripherals[sUuid]; ok {
 		s := p.Services[serviceUuid]
+		if s == nil {
+			log.Println("no service", serviceUuid)
+			return
+		}
+
 		c := s.Characteristics[characteristicUuid]
+		if c == nil {
+			log.Println("no characteristic", characteristicUuid)
+			return
+		}
 
-		ble.sendCBMsg(msg, xpc.Dict{
+		writeType := 0 // with response
+		if withoutResponse {
+			writeType = 1
+		}
+
+		ble.sendCommand("write", xpc.Dict{
+			"kCBMsgArgDeviceUUID":                p.Uuid,
+			"kCBMsgArgCharacteristicHandle":      c.Handle,
+			"kCBMsgArgCharacteristicValueHandle": c.ValueHandle,
+			"kCBMsgArgData":                      data,
+			"kCBMsgArgType":                      writeType,
+		})
+
+		if withoutResponse {
+			ble.Emit(Event{Name: "write", DeviceUUID: p.Uuid, ServiceUuid: s.Uuid, CharacteristicUuid: c.Uuid, Peripheral: *p.snapshot()})
+		}
+	} else {
+		log.Println("no peripheral", deviceUuid)
+	}
+}
+
+// enable or disable notifications (or indications) for a characteristic
+//
+// blued takes care of writing the Client Characteristic Configuration descriptor (0x2902),
+// and the new state is reported in a "notify" event. Values are then received as "notification" events.
+func (ble *BLE) Notify(deviceUuid xpc.UUID, serviceUuid, characteristicUuid string, enable bool) {
+	sUuid := deviceUuid.String()
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
+	if p, ok := ble.peripherals[sUuid]; ok {
+		s := p.Services[serviceUuid]
+		if s == nil {
+			log.Println("no service", serviceUuid)
+			return
+		}
+
+		c := s.Characteristics[characteristicUuid]
+		if c == nil {
+			log.Println("no characteristic", characteristicUuid)
+			return
+		}
+
+		if c.Properties&(Notify|Indicate) == 0 {
+			log.Println("characteristic doesn't support notifications", characteristicUuid)
+			return
+		}
+
+		state := 0
+		if enable {
+			state = 1
+		}
+
+		ble.sendCommand("notify", xpc.Dict{
 			"kCBMsgArgDeviceUUID":                p.Uuid,
 			"kCBMsgArgCharacteristicHandle":      c.Handle,
 			"kCBMsgArgCharacteristicValueHandle": c.ValueHandle,
+			"kCBMsgArgState":                     state,
+		})
+	} else {
+		log.Println("no peripheral", deviceUuid)
+	}
+}
+
+// read descriptor value
+func (ble *BLE) ReadDescriptor(deviceUuid xpc.UUID, descriptorHandle int) {
+	sUuid := deviceUuid.String()
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
+	if p, ok := ble.peripherals[sUuid]; ok {
+		if _, _, d := p.findDescriptor(descriptorHandle); d == nil {
+			log.Println("no descriptor", descriptorHandle)
+			return
+		}
+
+		ble.sendCommand("readDescriptor", xpc.Dict{
+			"kCBMsgArgDeviceUUID":       p.Uuid,
+			"kCBMsgArgDescriptorHandle": descriptorHandle,
+		})
+	} else {
+		log.Println("no peripheral", deviceUuid)
+	}
+}
+
+// write descriptor value
+func (ble *BLE) WriteDescriptor(deviceUuid xpc.UUID, descriptorHandle int, data []byte) {
+	sUuid := deviceUuid.String()
+	ble.peripheralsLock.RLock()
+	defer ble.peripheralsLock.RUnlock()
+
+	if p, ok := ble.peripherals[sUuid]; ok {
+		if _, _, d := p.findDescriptor(descriptorHandle); d == nil {
+			log.Println("no descriptor", descriptorHandle)
+			return
+		}
+
+		ble.sendCommand("writeDescriptor", xpc.Dict{
+			"kCBMsgArgDeviceUUID":       p.Uuid,
+			"kCBMsgArgDescriptorHandle": descriptorHandle,
+			"kCBMsgArgData":             data,
 		})
 	} else {
 		log.Println("no peripheral", deviceUuid)
@@ -707,102 +1123,207 @@ func (ble *BLE) Read(deviceUuid xpc.UUID, serviceUuid, characteristicUuid string
 
 // remove all services
 func (ble *BLE) RemoveServices() {
-	ble.sendCBMsg(12, nil)
+	ble.attributesLock.Lock()
+	defer ble.attributesLock.Unlock()
+
+	ble.removeAllServices()
 }
 
 // set services
-func (ble *BLE) SetServices(services []Service) {
-	ble.sendCBMsg(12, nil) // remove all services
-	ble.attributes = xpc.Array{nil}
-
-	attributeId := 1
+//
+// The services are validated (see Service.Validate) before sending anything to blued,
+// and ALREADY_PUBLISHED is returned if the same service (or service UUID) is listed twice.
+// A "serviceAdded" event is emitted when blued adds each service, and a "servicesSet" event
+// (with the result of each service in ServiceErrors) when all the services have been added.
+func (ble *BLE) SetServices(services []*Service) error {
+	uuids := map[string]bool{}
 
 	for _, service := range services {
-		arg := xpc.Dict{
-			"kCBMsgArgAttributeID":     attributeId,
-			"kCBMsgArgAttributeIDs":    []int{},
-			"kCBMsgArgCharacteristics": nil,
-			"kCBMsgArgType":            1, // 1 => primary, 0 => excluded
-			"kCBMsgArgUUID":            service.uuid.String(),
+		if err := service.Validate(); err != nil {
+			return err
 		}
 
-		ble.attributes = append(ble.attributes, service)
-		ble.lastServiceAttributeId = attributeId
-		attributeId += 1
+		if uuids[service.uuid] {
+			return ALREADY_PUBLISHED
+		}
 
-		characteristics := xpc.Array{}
+		uuids[service.uuid] = true
+	}
 
-		for _, characteristic := range service.characteristics {
-			properties := 0
-			permissions := 0
+	ble.attributesLock.Lock()
+	defer ble.attributesLock.Unlock()
 
-			if Read&characteristic.properties != 0 {
-				properties |= 0x02
+	ble.removeAllServices()
 
-				if Read&characteristic.secure != 0 {
-					permissions |= 0x04
-				} else {
-					permissions |= 0x01
-				}
-			}
+	ble.pendingServices = map[int]*Service{}
+	ble.servicesErrors = map[string]error{}
+	ble.servicesErr = nil
 
-			if WriteWithoutResponse&characteristic.properties != 0 {
-				properties |= 0x04
+	for _, service := range services {
+		attributeId := ble.addService(service)
+		ble.pendingServices[attributeId] = service
+	}
 
-				if WriteWithoutResponse&characteristic.secure != 0 {
-					permissions |= 0x08
-				} else {
-					permissions |= 0x02
-				}
-			}
+	if len(services) == 0 {
+		ble.Emit(Event{Name: "servicesSet", ServiceErrors: ble.servicesErrors})
+	}
 
-			if Write&characteristic.properties != 0 {
-				properties |= 0x08
+	return nil
+}
 
-				if WriteWithoutResponse&characteristic.secure != 0 {
-					permissions |= 0x08
-				} else {
-					permissions |= 0x02
-				}
-			}
+// add a service to the published services
+//
+// The service is validated (see Service.Validate) before sending anything to blued,
+// ALREADY_PUBLISHED is returned if the service (or a service with the same UUID) is already published,
+// and a "serviceAdded" event is emitted when blued adds the service.
+func (ble *BLE) AddService(service *Service) error {
+	if err := service.Validate(); err != nil {
+		return err
+	}
 
-			if Notify&characteristic.properties != 0 {
-				if Notify&characteristic.secure != 0 {
-					properties |= 0x100
-				} else {
-					properties |= 0x10
-				}
-			}
+	ble.attributesLock.Lock()
+	defer ble.attributesLock.Unlock()
 
-			if Indicate&characteristic.properties != 0 {
-				if Indicate&characteristic.secure != 0 {
-					properties |= 0x200
-				} else {
-					properties |= 0x20
-				}
-			}
+	if ble.serviceUuidPublished(service.uuid) {
+		return ALREADY_PUBLISHED
+	}
 
-			descriptors := xpc.Array{}
-			for _, descriptor := range characteristic.descriptors {
-				descriptors = append(descriptors, xpc.Dict{"kCBMsgArgData": descriptor.value, "kCBMsgArgUUID": descriptor.uuid.String()})
-			}
+	ble.addService(service)
+	return nil
+}
 
-			characteristicArg := xpc.Dict{
-				"kCBMsgArgAttributeID":              attributeId,
-				"kCBMsgArgAttributePermissions":     permissions,
-				"kCBMsgArgCharacteristicProperties": properties,
-				"kCBMsgArgData":                     characteristic.value,
-				"kCBMsgArgDescriptors":              descriptors,
-				"kCBMsgArgUUID":                     characteristic.uuid.String(),
-			}
+// remove a service from the published services
+func (ble *BLE) RemoveService(service *Service) error {
+	ble.attributesLock.Lock()
+	defer ble.attributesLock.Unlock()
 
-			ble.attributes = append(ble.attributes, characteristic)
-			characteristics = append(characteristics, characteristicArg)
+	attributeId := ble.serviceAttributeId(service)
+	if attributeId == 0 {
+		return SERVICE_NOT_PUBLISHED
+	}
+
+	ble.sendCommand("removeService", xpc.Dict{"kCBMsgArgAttributeID": attributeId})
+	ble.removeServiceAttributes(attributeId)
+	return nil
+}
+
+// remove all the services and attributes (must be called with attributesLock held)
+func (ble *BLE) removeAllServices() {
+	ble.sendCommand("removeAllServices", nil)
+	ble.attributes = xpc.Array{nil}
+	ble.pendingServices = nil
+	ble.updateQueue = nil
+	ble.failedUpdates = nil
+	ble.sentUpdates = nil
+	ble.queueFull = false
+}
+
+// the attribute id of a published service, or 0 (must be called with attributesLock held)
+func (ble *BLE) serviceAttributeId(service *Service) int {
+	for id, attribute := range ble.attributes {
+		if s, ok := attribute.(*Service); ok && s == service {
+			return id
+		}
+	}
+
+	return 0
+}
+
+// true if a service with the specified UUID is published (must be called with attributesLock held)
+func (ble *BLE) serviceUuidPublished(uuid string) bool {
+	for _, attribute := range ble.attributes {
+		if s, ok := attribute.(*Service); ok && s.uuid == uuid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// add the service and its characteristics to the attributes, and send the service to blued,
+// returning the service attribute id (must be called with attributesLock held)
+func (ble *BLE) addService(service *Service) int {
+	if len(ble.attributes) == 0 {
+		ble.attributes = xpc.Array{nil} // attribute ids start at 1
+	}
+
+	serviceId := len(ble.attributes)
+	attributeId := serviceId
+
+	arg := xpc.Dict{
+		"kCBMsgArgAttributeID":     attributeId,
+		"kCBMsgArgAttributeIDs":    []int{},
+		"kCBMsgArgCharacteristics": nil,
+		"kCBMsgArgType":            1, // 1 => primary, 0 => excluded
+		"kCBMsgArgUUID":            service.uuid,
+	}
+
+	ble.attributes = append(ble.attributes, service)
+	attributeId += 1
+
+	characteristics := xpc.Array{}
+
+	for _, characteristic := range service.characteristics {
+		descriptors := xpc.Array{}
+		for _, descriptor := range characteristic.descriptors {
+			descriptors = append(descriptors, xpc.Dict{
+				"kCBMsgArgAttributePermissions": cbPermissions(descriptor.permissions),
+				"kCBMsgArgData":                 descriptor.value,
+				"kCBMsgArgUUID":                 descriptor.uuid,
+			})
+		}
 
-			attributeId += 1
+		characteristicArg := xpc.Dict{
+			"kCBMsgArgAttributeID":              attributeId,
+			"kCBMsgArgAttributePermissions":     cbPermissions(characteristic.permissions),
+			"kCBMsgArgCharacteristicProperties": cbProperties(characteristic.properties),
+			"kCBMsgArgData":                     characteristic.value,
+			"kCBMsgArgDescriptors":              descriptors,
+			"kCBMsgArgUUID":                     characteristic.uuid,
 		}
 
-		arg["kCBMsgArgCharacteristics"] = characteristics
-		ble.sendCBMsg(10, arg) // remove all services
+		ble.attributes = append(ble.attributes, characteristic)
+		characteristic.ble = ble
+		characteristic.attributeId = attributeId
+		characteristic.subscribers = map[xpc.UUID]int{}
+		characteristics = append(characteristics, characteristicArg)
+
+		attributeId += 1
+	}
+
+	arg["kCBMsgArgCharacteristics"] = characteristics
+	ble.sendCommand("addService", arg)
+	return serviceId
+}
+
+// remove the service and its characteristics from the attributes (must be called with attributesLock held)
+func (ble *BLE) removeServiceAttributes(serviceId int) {
+	service := ble.attributes[serviceId].(*Service)
+	last := serviceId + len(service.characteristics)
+
+	for id := serviceId; id <= last; id++ {
+		ble.attributes[id] = nil
+	}
+
+	// drop the value updates for the removed characteristics
+	ble.updateQueue = dropUpdates(ble.updateQueue, serviceId, last)
+	ble.failedUpdates = dropUpdates(ble.failedUpdates, serviceId, last)
+	ble.sentUpdates = dropUpdates(ble.sentUpdates, serviceId, last)
+
+	// the ids of the last attributes can be reused (the next service gets id len(ble.attributes))
+	for len(ble.attributes) > 1 && ble.attributes[len(ble.attributes)-1] == nil {
+		ble.attributes = ble.attributes[:len(ble.attributes)-1]
 	}
 }
+
+// remove the value updates for the attribute ids between first and last
+func dropUpdates(updates []xpc.Dict, first, last int) []xpc.Dict {
+	kept := updates[:0]
+	for _, update := range updates {
+		if id, _ := update["kCBMsgArgAttributeID"].(int); id < first || id > last {
+			kept = append(kept, update)
+		}
+	}
+
+	return kept
+}
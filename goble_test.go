@@ -0,0 +1,630 @@
+package goble
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raff/goble/adv"
+	"github.com/raff/goble/beacon"
+	"github.com/raff/goble/xpc"
+)
+
+var (
+	testDevice         = xpc.MakeUUID("00112233445566778899aabbccddeeff")
+	testService        = "180d"
+	testCharacteristic = "2a39"
+	testDescriptor     = "2901"
+)
+
+// newTestBLE returns a BLE connected to a FakeTransport, with a known peripheral
+// that has one service, one characteristic and one descriptor
+func newTestBLE(release string) (*BLE, *FakeTransport) {
+	conn := NewFakeTransport(release)
+	ble := NewWithTransport(conn)
+
+	d := &CharacteristicDescriptor{
+		Uuid:   testDescriptor,
+		Handle: 14,
+	}
+
+	c := &ServiceCharacteristic{
+		Uuid:        testCharacteristic,
+		Properties:  Read | Write | WriteWithoutResponse | Notify,
+		Descriptors: map[interface{}]*CharacteristicDescriptor{d.Uuid: d, d.Handle: d},
+		Handle:      12,
+		ValueHandle: 13,
+	}
+
+	s := &ServiceHandle{
+		Uuid:            testService,
+		Characteristics: map[interface{}]*ServiceCharacteristic{c.Uuid: c, c.Handle: c, c.ValueHandle: c},
+		startHandle:     10,
+		endHandle:       20,
+	}
+
+	ble.peripherals[testDevice.String()] = &Peripheral{
+		Uuid:     testDevice,
+		Services: map[interface{}]*ServiceHandle{s.Uuid: s, s.startHandle: s},
+	}
+
+	return ble, conn
+}
+
+// waitEvent registers an handler for the specified event and returns a channel that receives it
+func waitEvent(ble *BLE, name string) chan Event {
+	ch := make(chan Event, 1)
+
+	ble.On(name, func(ev Event) bool {
+		ch <- ev
+		return false
+	})
+
+	return ch
+}
+
+func expectEvent(t *testing.T, ch chan Event) Event {
+	select {
+	case ev := <-ch:
+		return ev
+
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	return Event{}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		release         string
+		withoutResponse bool
+		msgId           int
+		writeType       int
+	}{
+		{"13.4.0", false, 65, 0},
+		{"17.7.0", true, 65, 1},
+		{"18.7.0", false, 101, 0},
+		{"19.0.0", true, 106, 1},
+		{"19.6.0", false, 91, 0},
+	}
+
+	data := []byte{0x01, 0x02, 0x03}
+
+	for _, test := range tests {
+		ble, conn := newTestBLE(test.release)
+		ble.Write(testDevice, testService, testCharacteristic, data, test.withoutResponse)
+
+		sent := conn.Sent()
+		if len(sent) != 1 {
+			t.Fatalf("%v: expected 1 message got %#v\n", test.release, sent)
+		}
+
+		msg := sent[0]
+		if id := msg["kCBMsgId"]; id != test.msgId {
+			t.Errorf("%v: expected message id %v got %v\n", test.release, test.msgId, id)
+		}
+
+		args := msg["kCBMsgArgs"].(xpc.Dict)
+		if uuid := args["kCBMsgArgDeviceUUID"]; uuid != testDevice {
+			t.Errorf("%v: expected device %v got %v\n", test.release, testDevice, uuid)
+		}
+		if h := args["kCBMsgArgCharacteristicHandle"]; h != 12 {
+			t.Errorf("%v: expected characteristic handle 12 got %v\n", test.release, h)
+		}
+		if h := args["kCBMsgArgCharacteristicValueHandle"]; h != 13 {
+			t.Errorf("%v: expected characteristic value handle 13 got %v\n", test.release, h)
+		}
+		if d := args["kCBMsgArgData"].([]byte); !bytes.Equal(d, data) {
+			t.Errorf("%v: expected data %x got %x\n", test.release, data, d)
+		}
+		if wt := args["kCBMsgArgType"]; wt != test.writeType {
+			t.Errorf("%v: expected write type %v got %v\n", test.release, test.writeType, wt)
+		}
+	}
+}
+
+func TestWriteUnknownCharacteristic(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	ble.Write(testDevice, testService, "ffff", []byte{0x01}, false)
+
+	sent := conn.Sent()
+	if len(sent) != 0 {
+		t.Errorf("expected no messages got %#v\n", sent)
+	}
+}
+
+func TestWriteWithoutResponseEvent(t *testing.T) {
+	ble, _ := newTestBLE("19.6.0")
+	ch := waitEvent(ble, "write")
+
+	ble.Write(testDevice, testService, testCharacteristic, []byte{0x01}, true)
+
+	ev := expectEvent(t, ch)
+	if ev.ServiceUuid != testService || ev.CharacteristicUuid != testCharacteristic || ev.Result != 0 {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	ch := waitEvent(ble, "write")
+
+	conn.Inject(116, xpc.Dict{
+		"kCBMsgArgDeviceUUID":           testDevice,
+		"kCBMsgArgCharacteristicHandle": 12,
+		"kCBMsgArgResult":               3,
+	})
+
+	ev := expectEvent(t, ch)
+	if ev.DeviceUUID != testDevice || ev.ServiceUuid != testService || ev.CharacteristicUuid != testCharacteristic {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+	if ev.Result != 3 || ev.Err != ATTWriteNotPermitted {
+		t.Errorf("expected result 3 got %v %v\n", ev.Result, ev.Err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	tests := []struct {
+		release string
+		enable  bool
+		msgId   int
+		state   int
+	}{
+		{"13.4.0", true, 67, 1},
+		{"18.7.0", false, 103, 0},
+		{"19.0.0", true, 108, 1},
+		{"19.6.0", true, 93, 1},
+	}
+
+	for _, test := range tests {
+		ble, conn := newTestBLE(test.release)
+		ble.Notify(testDevice, testService, testCharacteristic, test.enable)
+
+		sent := conn.Sent()
+		if len(sent) != 1 {
+			t.Fatalf("%v: expected 1 message got %#v\n", test.release, sent)
+		}
+
+		msg := sent[0]
+		if id := msg["kCBMsgId"]; id != test.msgId {
+			t.Errorf("%v: expected message id %v got %v\n", test.release, test.msgId, id)
+		}
+
+		args := msg["kCBMsgArgs"].(xpc.Dict)
+		if h := args["kCBMsgArgCharacteristicHandle"]; h != 12 {
+			t.Errorf("%v: expected characteristic handle 12 got %v\n", test.release, h)
+		}
+		if st := args["kCBMsgArgState"]; st != test.state {
+			t.Errorf("%v: expected state %v got %v\n", test.release, test.state, st)
+		}
+	}
+}
+
+func TestNotifyEvent(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	ch := waitEvent(ble, "notify")
+
+	conn.Inject(118, xpc.Dict{
+		"kCBMsgArgDeviceUUID":           testDevice,
+		"kCBMsgArgCharacteristicHandle": 12,
+		"kCBMsgArgState":                1,
+		"kCBMsgArgResult":               0,
+	})
+
+	ev := expectEvent(t, ch)
+	if ev.CharacteristicUuid != testCharacteristic || !ev.Notifying {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+	if !ev.Peripheral.Services[testService].Characteristics[testCharacteristic].Notifying {
+		t.Error("expected characteristic to be notifying")
+	}
+}
+
+func TestNotificationEvent(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	rch := waitEvent(ble, "read")
+	nch := waitEvent(ble, "notification")
+
+	conn.Inject(115, xpc.Dict{
+		"kCBMsgArgDeviceUUID":           testDevice,
+		"kCBMsgArgCharacteristicHandle": 13,
+		"kCBMsgArgIsNotification":       1,
+		"kCBMsgArgData":                 []byte{0x00, 0x48},
+	})
+
+	ev := expectEvent(t, nch)
+	if ev.CharacteristicUuid != testCharacteristic || !bytes.Equal(ev.Data, []byte{0x00, 0x48}) {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+
+	select {
+	case ev := <-rch:
+		t.Errorf("unexpected read event %#v\n", ev)
+	default:
+	}
+}
+
+func TestReadDescriptor(t *testing.T) {
+	tests := []struct {
+		release string
+		msgId   int
+	}{
+		{"13.4.0", 76},
+		{"18.7.0", 112},
+		{"19.0.0", 117},
+		{"19.6.0", 102},
+	}
+
+	for _, test := range tests {
+		ble, conn := newTestBLE(test.release)
+		ble.ReadDescriptor(testDevice, 14)
+		ble.ReadDescriptor(testDevice, 99) // unknown descriptor
+
+		sent := conn.Sent()
+		if len(sent) != 1 {
+			t.Fatalf("%v: expected 1 message got %#v\n", test.release, sent)
+		}
+
+		msg := sent[0]
+		if id := msg["kCBMsgId"]; id != test.msgId {
+			t.Errorf("%v: expected message id %v got %v\n", test.release, test.msgId, id)
+		}
+
+		args := msg["kCBMsgArgs"].(xpc.Dict)
+		if h := args["kCBMsgArgDescriptorHandle"]; h != 14 {
+			t.Errorf("%v: expected descriptor handle 14 got %v\n", test.release, h)
+		}
+	}
+}
+
+func TestWriteDescriptor(t *testing.T) {
+	tests := []struct {
+		release string
+		msgId   int
+	}{
+		{"13.4.0", 77},
+		{"18.7.0", 113},
+		{"19.0.0", 118},
+		{"19.6.0", 103},
+	}
+
+	data := []byte("hello")
+
+	for _, test := range tests {
+		ble, conn := newTestBLE(test.release)
+		ble.WriteDescriptor(testDevice, 14, data)
+
+		sent := conn.Sent()
+		if len(sent) != 1 {
+			t.Fatalf("%v: expected 1 message got %#v\n", test.release, sent)
+		}
+
+		msg := sent[0]
+		if id := msg["kCBMsgId"]; id != test.msgId {
+			t.Errorf("%v: expected message id %v got %v\n", test.release, test.msgId, id)
+		}
+
+		args := msg["kCBMsgArgs"].(xpc.Dict)
+		if h := args["kCBMsgArgDescriptorHandle"]; h != 14 {
+			t.Errorf("%v: expected descriptor handle 14 got %v\n", test.release, h)
+		}
+		if d := args["kCBMsgArgData"].([]byte); !bytes.Equal(d, data) {
+			t.Errorf("%v: expected data %x got %x\n", test.release, data, d)
+		}
+	}
+}
+
+func TestValueReadEvent(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	ch := waitEvent(ble, "valueRead")
+
+	conn.Inject(123, xpc.Dict{
+		"kCBMsgArgDeviceUUID":       testDevice,
+		"kCBMsgArgDescriptorHandle": 14,
+		"kCBMsgArgData":             []byte("Heart Rate"),
+		"kCBMsgArgResult":           0,
+	})
+
+	ev := expectEvent(t, ch)
+	if ev.ServiceUuid != testService || ev.CharacteristicUuid != testCharacteristic || ev.DescriptorUuid != testDescriptor {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+	if string(ev.Data) != "Heart Rate" {
+		t.Errorf("expected data %q got %q\n", "Heart Rate", ev.Data)
+	}
+}
+
+func TestPeripherals(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+
+	other := xpc.MakeUUID("ffeeddccbbaa99887766554433221100")
+	ch := waitEvent(ble, "discover")
+	conn.Inject(51, xpc.Dict{
+		"kCBMsgArgDeviceUUID":        other,
+		"kCBMsgArgAdvertisementData": xpc.Dict{"kCBAdvDataLocalName": "other"},
+		"kCBMsgArgRssi":              -70,
+	})
+	expectEvent(t, ch)
+
+	peripherals := ble.Peripherals()
+	if len(peripherals) != 2 || peripherals[0].Uuid != testDevice || peripherals[1].Uuid != other {
+		t.Fatalf("unexpected peripherals %#v", peripherals)
+	}
+
+	p, ok := ble.Peripheral(testDevice)
+	if !ok {
+		t.Fatal("expected peripheral", testDevice)
+	}
+
+	// the snapshot keeps the same object for the uuid and handle keys
+	if p.Services[testService] != p.Services[10] || p.Services[testService].Characteristics[testCharacteristic] != p.Services[10].Characteristics[12] {
+		t.Error("expected shared services and characteristics")
+	}
+
+	// and it's not affected by the following events
+	ch = waitEvent(ble, "notify")
+	conn.Inject(118, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgCharacteristicHandle": 12, "kCBMsgArgState": 1})
+	expectEvent(t, ch)
+
+	if p.Services[testService].Characteristics[testCharacteristic].Notifying {
+		t.Error("expected snapshot to be unchanged")
+	}
+	if p, _ := ble.Peripheral(testDevice); !p.Services[testService].Characteristics[testCharacteristic].Notifying {
+		t.Error("expected notifying characteristic")
+	}
+
+	ble.ForgetPeripheral(other)
+	if _, ok := ble.Peripheral(other); ok {
+		t.Error("expected forgotten peripheral")
+	}
+	if peripherals := ble.Peripherals(); len(peripherals) != 1 {
+		t.Errorf("unexpected peripherals %#v", peripherals)
+	}
+}
+
+func TestPeripheralsRace(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	done := make(chan bool)
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			conn.Inject(95, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgCharacteristicHandle": 12, "kCBMsgArgData": []byte{byte(i)}})
+			conn.Inject(118, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgCharacteristicHandle": 12, "kCBMsgArgState": i % 2})
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			ble.Read(testDevice, testService, testCharacteristic)
+			if p, ok := ble.Peripheral(testDevice); ok {
+				_ = p.Services[testService].Characteristics[testCharacteristic].Notifying
+			}
+		}
+	}
+}
+
+func TestEventErrors(t *testing.T) {
+	tests := []struct {
+		event string
+		id    int
+		args  xpc.Dict
+		err   error
+	}{
+		{"read", 115, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgCharacteristicHandle": 12, "kCBMsgArgResult": 5}, ATTInsufficientAuthentication},
+		{"read", 115, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgCharacteristicHandle": 12, "kCBMsgArgData": []byte{1}}, nil},
+		{"notify", 118, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgCharacteristicHandle": 12, "kCBMsgArgResult": 6}, ATTRequestNotSupported},
+		{"valueRead", 123, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgDescriptorHandle": 14, "kCBMsgArgResult": 2}, ATTReadNotPermitted},
+		{"characteristicsDiscover", 89, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgServiceStartHandle": 10, "kCBMsgArgResult": 10}, ATTAttributeNotFound},
+		{"advertisingStart", 16, xpc.Dict{"kCBMsgArgResult": 0}, nil},
+		{"advertisingStartError", 16, xpc.Dict{"kCBMsgArgResult": 9}, CBAlreadyAdvertising},
+		{"advertisingStopError", 17, xpc.Dict{"kCBMsgArgResult": 1}, CBInvalidParameters},
+		{"connect", 67, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgResult": 10}, CBConnectionFailed},
+	}
+
+	for _, test := range tests {
+		ble, conn := newTestBLE("19.6.0")
+		ch := waitEvent(ble, test.event)
+
+		conn.Inject(test.id, test.args)
+
+		if ev := expectEvent(t, ch); ev.Err != test.err {
+			t.Errorf("%v: expected %#v got %#v\n", test.event, test.err, ev.Err)
+		}
+	}
+}
+
+func TestErrorStrings(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{ATTInsufficientAuthentication, "att: insufficient authentication"},
+		{ATTError(0x80), "att: error 0x80"},
+		{CBAlreadyAdvertising, "cb: already advertising"},
+		{CBError(99), "cb: error 99"},
+	}
+
+	for _, test := range tests {
+		if s := test.err.Error(); s != test.expected {
+			t.Errorf("expected %#v got %#v\n", test.expected, s)
+		}
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	tests := []struct {
+		id   int
+		args xpc.Dict
+		path string
+	}{
+		{115, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgCharacteristicHandle": "12"}, "kCBMsgArgCharacteristicHandle"},
+		{6, xpc.Dict{"kCBMsgArgState": []byte{5}}, "kCBMsgArgState"},
+		{67, xpc.Dict{}, "kCBMsgArgDeviceUUID"},
+		{6, xpc.Dict{"kCBMsgArgState": 42}, ""}, // invalid state (index out of range)
+	}
+
+	for _, test := range tests {
+		ble, conn := newTestBLE("19.6.0")
+		ch := waitEvent(ble, "protocolError")
+
+		conn.Inject(test.id, test.args)
+
+		ev := expectEvent(t, ch)
+		perr, ok := ev.Err.(*ProtocolError)
+		if !ok {
+			t.Fatalf("expected ProtocolError got %#v\n", ev.Err)
+		}
+		if id := perr.Message.MustGetInt("kCBMsgId"); id != test.id {
+			t.Errorf("expected %#v got %#v\n", test.id, id)
+		}
+
+		if cerr, ok := perr.Err.(*xpc.ConversionError); ok {
+			if path := strings.Join(cerr.Path, "."); path != test.path {
+				t.Errorf("expected %#v got %#v\n", test.path, path)
+			}
+		} else if test.path != "" {
+			t.Errorf("expected ConversionError got %#v\n", perr.Err)
+		}
+
+		// the handler is still working
+		ch = waitEvent(ble, "stateChange")
+		conn.Inject(6, xpc.Dict{"kCBMsgArgState": 5})
+		expectEvent(t, ch)
+	}
+
+	ble, conn := newTestBLE("19.6.0")
+	ch := waitEvent(ble, "protocolError")
+	conn.InjectError(&xpc.ConversionError{Path: []string{"kCBMsgArgs", "kCBMsgArgData"}, Value: int64(1), Type: "[]byte"})
+	if ev := expectEvent(t, ch); ev.Err.Error() != "protocol error: xpc: kCBMsgArgs.kCBMsgArgData: cannot convert int64 to []byte" {
+		t.Errorf("unexpected error %v", ev.Err)
+	}
+}
+
+func TestStartAdvertisingIBeacon(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+	ble.StartAdvertisingIBeacon(testDevice, 1, 2, -59)
+
+	expected := []byte{0x1a, 0xff, 0x4c, 0x00, 0x02, 0x15}
+	expected = append(expected, testDevice[:]...)
+	expected = append(expected, 0x00, 0x01, 0x00, 0x02, 0xc5)
+
+	args := conn.Sent()[0]["kCBMsgArgs"].(xpc.Dict)
+	if data := args["kCBAdvDataAppleMfgData"].([]byte); !bytes.Equal(data, expected) {
+		t.Errorf("expected %x got %x\n", expected, data)
+	}
+}
+
+func TestAdvertisementBeacon(t *testing.T) {
+	a := Advertisement{
+		ServiceData: []ServiceData{
+			{Uuid: "180f", Data: []byte{0x64}},
+			{Uuid: "feaa", Data: []byte{0x10, 0xeb, 0x03, 'g', 'o', 'b', 'l', 'e', 0x07}},
+		},
+	}
+
+	b, ok := a.Beacon()
+	if url, isURL := b.(*beacon.EddystoneURL); !ok || !isURL || url.URL != "https://goble.com" {
+		t.Errorf("expected eddystone-url got %#v\n", b)
+	}
+
+	a = Advertisement{ManufacturerData: []byte{0x4c, 0x00, 0x10, 0x05, 0x03, 0x1c}}
+	if b, ok := a.Beacon(); ok {
+		t.Errorf("expected no beacon got %#v\n", b)
+	}
+}
+
+func TestStartAdvertisingEddystone(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+
+	if err := ble.StartAdvertisingEddystoneURL("https://www.github.com/raff", -20); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{
+		0x02, 0x01, 0x06,
+		0x03, 0x03, 0xaa, 0xfe,
+		0x11, 0x16, 0xaa, 0xfe, 0x10, 0xec, 0x01, 'g', 'i', 't', 'h', 'u', 'b', 0x00, 'r', 'a', 'f', 'f',
+	}
+
+	args := conn.Sent()[0]["kCBMsgArgs"].(xpc.Dict)
+	if data := args["kCBAdvDataAppleMfgData"].([]byte); !bytes.Equal(data, expected) {
+		t.Errorf("expected %x got %x\n", expected, data)
+	}
+
+	if err := ble.StartAdvertisingEddystoneURL("https://example.com/a/very/long/path", -20); err == nil {
+		t.Error("expected error for long URL")
+	}
+
+	if err := ble.StartAdvertisingEddystoneURL("ftp://example.com", -20); err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+
+	if err := ble.StartAdvertisingEddystoneTLM(3000, 200, 0, 0); err == nil {
+		t.Error("expected error for temperature out of range")
+	}
+
+	if len(conn.Sent()) != 1 {
+		t.Errorf("expected no messages for invalid frames got %#v\n", conn.Sent())
+	}
+}
+
+func TestStartAdvertisingBeacons(t *testing.T) {
+	namespace := [10]byte{0xed, 0xd1, 0xeb, 0xea, 0xc0, 0x4e, 0x5d, 0xef, 0xa0, 0x17}
+	instance := [6]byte{0x0b, 0xdb, 0x87, 0x53, 0x9b, 0x67}
+	id := [20]byte{1, 2, 3}
+
+	tests := []struct {
+		start  func(ble *BLE) error
+		beacon beacon.Beacon
+	}{
+		{func(ble *BLE) error { return ble.StartAdvertisingEddystoneUID(namespace, instance, -25) },
+			&beacon.EddystoneUID{TxPower: -25, Namespace: namespace, Instance: instance}},
+		{func(ble *BLE) error { return ble.StartAdvertisingEddystoneTLM(3000, 23.5, 100, 10000) },
+			&beacon.EddystoneTLM{Battery: 3000, Temperature: 23.5, AdvCount: 100, SecCount: 10000}},
+		{func(ble *BLE) error { return ble.StartAdvertisingAltBeacon(0x0118, id, -59) },
+			&beacon.AltBeacon{CompanyId: 0x0118, ID: id, ReferenceRSSI: -59}},
+	}
+
+	for _, test := range tests {
+		ble, conn := newTestBLE("19.6.0")
+
+		if err := test.start(ble); err != nil {
+			t.Fatal(err)
+		}
+
+		data := conn.Sent()[0]["kCBMsgArgs"].(xpc.Dict)["kCBAdvDataAppleMfgData"].([]byte)
+
+		ad, err := adv.Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := Advertisement{ManufacturerData: ad.ManufacturerData}
+		for _, sd := range ad.ServiceData {
+			a.ServiceData = append(a.ServiceData, ServiceData{Uuid: sd.Uuid, Data: sd.Data})
+		}
+
+		if b, ok := a.Beacon(); !ok || !reflect.DeepEqual(b, test.beacon) {
+			t.Errorf("expected %#v got %#v\n", test.beacon, b)
+		}
+	}
+
+	// before 14 the service data is sent as a dictionary
+	ble, conn := newTestBLE("13.4.0")
+	if err := ble.StartAdvertisingEddystoneUID(namespace, instance, -25); err != nil {
+		t.Fatal(err)
+	}
+
+	args := conn.Sent()[0]["kCBMsgArgs"].(xpc.Dict)
+	if sdata := args["kCBAdvDataServiceData"].(xpc.Array); !bytes.Equal(sdata[0].([]byte), []byte{0xfe, 0xaa}) || len(sdata[1].([]byte)) != 20 {
+		t.Errorf("unexpected service data %#v\n", sdata)
+	}
+}
@@ -0,0 +1,162 @@
+package goble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ManufacturerDecoder decodes the manufacturer specific data of a company (without the company identifier)
+// into a structured value
+type ManufacturerDecoder func(payload []byte) (interface{}, error)
+
+var (
+	NO_DECODER = errors.New("no manufacturer data decoder")
+
+	// there is no Xiaomi (0x038f) decoder: MiBeacon is sent as service data (UUID fe95), not manufacturer data
+	manufacturerDecoders = map[uint16]ManufacturerDecoder{
+		0x004c: decodeAppleContinuity,
+		0x0006: decodeMicrosoftCDP,
+		0x0499: decodeRuuvi,
+	}
+
+	manufacturersLock sync.RWMutex
+)
+
+// RegisterManufacturerDecoder registers (or replaces) the decoder for the manufacturer data of a company.
+// If name is not empty it's also registered as the company name (see CompanyName).
+func RegisterManufacturerDecoder(companyId uint16, name string, decoder ManufacturerDecoder) {
+	manufacturersLock.Lock()
+	defer manufacturersLock.Unlock()
+
+	if name != "" {
+		knownCompanies[companyId] = name
+	}
+
+	if decoder == nil {
+		delete(manufacturerDecoders, companyId)
+	} else {
+		manufacturerDecoders[companyId] = decoder
+	}
+}
+
+// Manufacturer returns the company identifier, the company name (if known) and the payload of the manufacturer data.
+// The payload is nil if there is no manufacturer data.
+func (a *Advertisement) Manufacturer() (companyId uint16, name string, payload []byte) {
+	if len(a.ManufacturerData) < 2 {
+		return 0, "", nil
+	}
+
+	companyId = binary.LittleEndian.Uint16(a.ManufacturerData)
+	return companyId, CompanyName(companyId), a.ManufacturerData[2:]
+}
+
+// ManufacturerValue decodes the manufacturer data with the decoder registered for the company
+// (see RegisterManufacturerDecoder). It returns NO_DECODER if there is no decoder (or no manufacturer data).
+func (a *Advertisement) ManufacturerValue() (interface{}, error) {
+	companyId, _, payload := a.Manufacturer()
+	if payload == nil {
+		return nil, NO_DECODER
+	}
+
+	manufacturersLock.RLock()
+	decoder := manufacturerDecoders[companyId]
+	manufacturersLock.RUnlock()
+
+	if decoder == nil {
+		return nil, NO_DECODER
+	}
+
+	return decoder(payload)
+}
+
+// AppleContinuityMessage is one of the messages in the Apple manufacturer data
+// (i.e. 0x02 iBeacon, 0x07 AirPods, 0x0c Handoff, 0x10 Nearby Info)
+type AppleContinuityMessage struct {
+	Type byte
+	Data []byte
+}
+
+// the Apple continuity messages (type, length and data)
+func decodeAppleContinuity(payload []byte) (interface{}, error) {
+	var messages []AppleContinuityMessage
+
+	for i := 0; i < len(payload); {
+		if i+2 > len(payload) || i+2+int(payload[i+1]) > len(payload) {
+			return nil, fmt.Errorf("apple: truncated message at offset %v", i)
+		}
+
+		l := int(payload[i+1])
+		messages = append(messages, AppleContinuityMessage{Type: payload[i], Data: payload[i+2 : i+2+l]})
+		i += 2 + l
+	}
+
+	return messages, nil
+}
+
+// MicrosoftCDP is a Microsoft Connected Devices Platform beacon
+type MicrosoftCDP struct {
+	ScenarioType byte // 1 for Bluetooth
+	Version      byte
+	DeviceType   byte // i.e. 1 Xbox One, 9 Windows 10 Desktop, 11 Windows 10 Phone
+	Flags        byte
+	Salt         []byte
+	DeviceHash   []byte
+}
+
+func decodeMicrosoftCDP(payload []byte) (interface{}, error) {
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("microsoft: invalid CDP beacon length %v", len(payload))
+	}
+
+	return &MicrosoftCDP{
+		ScenarioType: payload[0],
+		Version:      payload[1] >> 5,
+		DeviceType:   payload[1] & 0x1f,
+		Flags:        payload[2],
+		Salt:         payload[4:8],
+		DeviceHash:   payload[8:],
+	}, nil
+}
+
+// RuuviData is a RuuviTag measurement (data format 5, RAWv2)
+type RuuviData struct {
+	Temperature     float64 // degrees Celsius
+	Humidity        float64 // percent
+	Pressure        int     // Pa
+	AccelerationX   int16   // mG
+	AccelerationY   int16   // mG
+	AccelerationZ   int16   // mG
+	BatteryVoltage  int     // mV
+	TxPower         int     // dBm
+	MovementCounter byte
+	MeasurementSeq  uint16
+	MAC             []byte
+}
+
+func decodeRuuvi(payload []byte) (interface{}, error) {
+	if len(payload) < 1 || payload[0] != 5 {
+		return nil, errors.New("ruuvi: unsupported data format")
+	}
+
+	if len(payload) != 24 {
+		return nil, fmt.Errorf("ruuvi: invalid data length %v", len(payload))
+	}
+
+	power := binary.BigEndian.Uint16(payload[13:])
+
+	return &RuuviData{
+		Temperature:     float64(int16(binary.BigEndian.Uint16(payload[1:]))) * 0.005,
+		Humidity:        float64(binary.BigEndian.Uint16(payload[3:])) * 0.0025,
+		Pressure:        int(binary.BigEndian.Uint16(payload[5:])) + 50000,
+		AccelerationX:   int16(binary.BigEndian.Uint16(payload[7:])),
+		AccelerationY:   int16(binary.BigEndian.Uint16(payload[9:])),
+		AccelerationZ:   int16(binary.BigEndian.Uint16(payload[11:])),
+		BatteryVoltage:  int(power>>5) + 1600,
+		TxPower:         int(power&0x1f)*2 - 40,
+		MovementCounter: payload[15],
+		MeasurementSeq:  binary.BigEndian.Uint16(payload[16:]),
+		MAC:             payload[18:24],
+	}, nil
+}
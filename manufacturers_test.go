@@ -0,0 +1,91 @@
+package goble
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestManufacturer(t *testing.T) {
+	a := Advertisement{ManufacturerData: []byte{0x4c, 0x00, 0x10, 0x05, 0x03, 0x1c, 0x2b, 0x1a, 0x5e}}
+
+	companyId, name, payload := a.Manufacturer()
+	if companyId != 0x004c || name != "Apple, Inc." || len(payload) != 7 {
+		t.Errorf("unexpected manufacturer %x %#v %x\n", companyId, name, payload)
+	}
+
+	v, err := a.ManufacturerValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []AppleContinuityMessage{{Type: 0x10, Data: []byte{0x03, 0x1c, 0x2b, 0x1a, 0x5e}}}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("expected %#v got %#v\n", expected, v)
+	}
+
+	a = Advertisement{}
+	if companyId, name, payload := a.Manufacturer(); companyId != 0 || name != "" || payload != nil {
+		t.Errorf("expected no manufacturer got %x %#v %x\n", companyId, name, payload)
+	}
+
+	if _, err := a.ManufacturerValue(); err != NO_DECODER {
+		t.Errorf("expected %v got %v\n", NO_DECODER, err)
+	}
+}
+
+func TestRuuviDecoder(t *testing.T) {
+	data, _ := hex.DecodeString("990405" + "12fc5394c37c0004fffc040cac364200cdcbb8334c884f")
+	a := Advertisement{ManufacturerData: data}
+
+	v, err := a.ManufacturerValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := v.(*RuuviData)
+	if math.Abs(r.Temperature-24.3) > 0.001 || math.Abs(r.Humidity-53.49) > 0.001 || r.Pressure != 100044 {
+		t.Errorf("unexpected measurements %#v\n", r)
+	}
+
+	if r.AccelerationX != 4 || r.AccelerationY != -4 || r.AccelerationZ != 1036 {
+		t.Errorf("unexpected acceleration %#v\n", r)
+	}
+
+	if r.BatteryVoltage != 2977 || r.TxPower != 4 || r.MovementCounter != 66 || r.MeasurementSeq != 205 {
+		t.Errorf("unexpected power info %#v\n", r)
+	}
+
+	if mac := hex.EncodeToString(r.MAC); mac != "cbb8334c884f" {
+		t.Errorf("expected %v got %v\n", "cbb8334c884f", mac)
+	}
+}
+
+func TestRegisterManufacturerDecoder(t *testing.T) {
+	defer func() {
+		RegisterManufacturerDecoder(0xfff0, "", nil)
+		manufacturersLock.Lock()
+		delete(knownCompanies, 0xfff0)
+		manufacturersLock.Unlock()
+	}()
+
+	RegisterManufacturerDecoder(0xfff0, "Goble Inc.", func(payload []byte) (interface{}, error) {
+		return int(payload[0]), nil
+	})
+
+	a := Advertisement{ManufacturerData: []byte{0xf0, 0xff, 42}}
+
+	if _, name, _ := a.Manufacturer(); name != "Goble Inc." {
+		t.Errorf("expected %#v got %#v\n", "Goble Inc.", name)
+	}
+
+	if v, err := a.ManufacturerValue(); err != nil || v != 42 {
+		t.Errorf("expected 42 got %#v (%v)\n", v, err)
+	}
+
+	RegisterManufacturerDecoder(0xfff0, "", nil)
+	if _, err := a.ManufacturerValue(); err != NO_DECODER {
+		t.Errorf("expected %v got %v\n", NO_DECODER, err)
+	}
+}
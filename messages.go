@@ -0,0 +1,114 @@
+package goble
+
+import (
+	"github.com/raff/goble/xpc"
+)
+
+//
+// payloads (kCBMsgArgs) of the blued events, decoded with xpc.Unmarshal
+//
+
+type serviceArgs struct {
+	Uuid        string `xpc:"kCBMsgArgUUID,hex"`
+	StartHandle int    `xpc:"kCBMsgArgServiceStartHandle"`
+	EndHandle   int    `xpc:"kCBMsgArgServiceEndHandle"`
+}
+
+type servicesDiscoverArgs struct {
+	DeviceUUID xpc.UUID      `xpc:"kCBMsgArgDeviceUUID"`
+	Result     int           `xpc:"kCBMsgArgResult,omitempty"`
+	Services   []serviceArgs `xpc:"kCBMsgArgServices,omitempty"`
+}
+
+type characteristicArgs struct {
+	Uuid        string `xpc:"kCBMsgArgUUID,hex"`
+	Handle      int    `xpc:"kCBMsgArgCharacteristicHandle"`
+	ValueHandle int    `xpc:"kCBMsgArgCharacteristicValueHandle"`
+	Properties  int    `xpc:"kCBMsgArgCharacteristicProperties"`
+}
+
+type characteristicsDiscoverArgs struct {
+	DeviceUUID         xpc.UUID             `xpc:"kCBMsgArgDeviceUUID"`
+	ServiceStartHandle int                  `xpc:"kCBMsgArgServiceStartHandle"`
+	Result             int                  `xpc:"kCBMsgArgResult,omitempty"`
+	Characteristics    []characteristicArgs `xpc:"kCBMsgArgCharacteristics,omitempty"`
+}
+
+type descriptorArgs struct {
+	Uuid   string `xpc:"kCBMsgArgUUID,hex"`
+	Handle int    `xpc:"kCBMsgArgDescriptorHandle"`
+}
+
+type descriptorsDiscoverArgs struct {
+	DeviceUUID           xpc.UUID         `xpc:"kCBMsgArgDeviceUUID"`
+	CharacteristicHandle int              `xpc:"kCBMsgArgCharacteristicHandle"`
+	Result               int              `xpc:"kCBMsgArgResult,omitempty"`
+	Descriptors          []descriptorArgs `xpc:"kCBMsgArgDescriptors,omitempty"`
+}
+
+// read, write and notify (state) events for characteristics
+type characteristicValueArgs struct {
+	DeviceUUID           xpc.UUID `xpc:"kCBMsgArgDeviceUUID"`
+	CharacteristicHandle int      `xpc:"kCBMsgArgCharacteristicHandle"`
+	Result               int      `xpc:"kCBMsgArgResult,omitempty"`
+	IsNotification       bool     `xpc:"kCBMsgArgIsNotification,omitempty"`
+	State                bool     `xpc:"kCBMsgArgState,omitempty"`
+	Data                 []byte   `xpc:"kCBMsgArgData,omitempty"`
+}
+
+// read and write events for descriptors
+type descriptorValueArgs struct {
+	DeviceUUID       xpc.UUID `xpc:"kCBMsgArgDeviceUUID"`
+	DescriptorHandle int      `xpc:"kCBMsgArgDescriptorHandle"`
+	Result           int      `xpc:"kCBMsgArgResult,omitempty"`
+	Data             []byte   `xpc:"kCBMsgArgData,omitempty"`
+}
+
+// result of adding a service (GATT server)
+type serviceAddedArgs struct {
+	AttributeID int `xpc:"kCBMsgArgAttributeID"`
+	Result      int `xpc:"kCBMsgArgResult"`
+}
+
+// read request from a central (GATT server)
+type readRequestArgs struct {
+	DeviceUUID    xpc.UUID `xpc:"kCBMsgArgDeviceUUID,omitempty"`
+	TransactionID int      `xpc:"kCBMsgArgTransactionID"`
+	AttributeID   int      `xpc:"kCBMsgArgAttributeID"`
+	Offset        int      `xpc:"kCBMsgArgOffset,omitempty"`
+}
+
+type attWriteArgs struct {
+	AttributeID    int    `xpc:"kCBMsgArgAttributeID"`
+	Data           []byte `xpc:"kCBMsgArgData,omitempty"`
+	Offset         int    `xpc:"kCBMsgArgOffset,omitempty"`
+	IgnoreResponse bool   `xpc:"kCBMsgArgIgnoreResponse,omitempty"`
+}
+
+// write request from a central (GATT server), with one or more (queued) writes
+type writeRequestArgs struct {
+	DeviceUUID    xpc.UUID       `xpc:"kCBMsgArgDeviceUUID,omitempty"`
+	TransactionID int            `xpc:"kCBMsgArgTransactionID"`
+	Writes        []attWriteArgs `xpc:"kCBMsgArgATTWrites"`
+}
+
+// subscribe (or unsubscribe) from a central (GATT server)
+type subscribeArgs struct {
+	DeviceUUID  xpc.UUID `xpc:"kCBMsgArgDeviceUUID"`
+	AttributeID int      `xpc:"kCBMsgArgAttributeID"`
+	Mtu         int      `xpc:"kCBMsgArgATTMTU,omitempty"`
+}
+
+// the value update that didn't fit in the blued transmit queue (if reported)
+type transmitQueueFullArgs struct {
+	AttributeID int    `xpc:"kCBMsgArgAttributeID,omitempty"`
+	Data        []byte `xpc:"kCBMsgArgData,omitempty"`
+}
+
+// mustUnmarshal decodes the event arguments, and panics with the *xpc.ConversionError
+// if they are invalid (HandleXpcEvent reports it as a "protocolError" event)
+func mustUnmarshal(args xpc.Dict, v interface{}) {
+	if err := xpc.Unmarshal(args, v); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,77 @@
+package goble
+
+//
+// GATT server (peripheral role) mapping of properties and permissions to CoreBluetooth
+//
+
+// CBCharacteristicProperties
+const (
+	cbBroadcast                  = 0x01
+	cbRead                       = 0x02
+	cbWriteWithoutResponse       = 0x04
+	cbWrite                      = 0x08
+	cbNotify                     = 0x10
+	cbIndicate                   = 0x20
+	cbAuthenticatedSignedWrites  = 0x40
+	cbExtendedProperties         = 0x80
+	cbNotifyEncryptionRequired   = 0x100
+	cbIndicateEncryptionRequired = 0x200
+)
+
+// CBAttributePermissions
+const (
+	cbReadable                = 0x01
+	cbWriteable               = 0x02
+	cbReadEncryptionRequired  = 0x04
+	cbWriteEncryptionRequired = 0x08
+)
+
+// the CoreBluetooth property for each goble property
+var cbPropertyMap = []struct {
+	property Property
+	cb       int
+}{
+	{Broadcast, cbBroadcast},
+	{Read, cbRead},
+	{WriteWithoutResponse, cbWriteWithoutResponse},
+	{Write, cbWrite},
+	{Notify, cbNotify},
+	{Indicate, cbIndicate},
+	{AuthenticatedSignedWrites, cbAuthenticatedSignedWrites},
+	{ExtendedProperties, cbExtendedProperties},
+	{NotifyEncryptionRequired, cbNotifyEncryptionRequired},
+	{IndicateEncryptionRequired, cbIndicateEncryptionRequired},
+}
+
+// the CoreBluetooth permission for each goble permission
+var cbPermissionMap = []struct {
+	permission Permission
+	cb         int
+}{
+	{Readable, cbReadable},
+	{Writeable, cbWriteable},
+	{ReadEncryptionRequired, cbReadEncryptionRequired},
+	{WriteEncryptionRequired, cbWriteEncryptionRequired},
+}
+
+// cbProperties returns the CoreBluetooth characteristic properties
+func cbProperties(properties Property) (cb int) {
+	for _, m := range cbPropertyMap {
+		if properties&m.property != 0 {
+			cb |= m.cb
+		}
+	}
+
+	return
+}
+
+// cbPermissions returns the CoreBluetooth attribute permissions
+func cbPermissions(permissions Permission) (cb int) {
+	for _, m := range cbPermissionMap {
+		if permissions&m.permission != 0 {
+			cb |= m.cb
+		}
+	}
+
+	return
+}
@@ -0,0 +1,123 @@
+package goble
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/raff/goble/xpc"
+)
+
+func TestCBProperties(t *testing.T) {
+	tests := []struct {
+		properties Property
+		expected   int
+	}{
+		{0, 0},
+		{Broadcast, 0x01},
+		{Read, 0x02},
+		{WriteWithoutResponse, 0x04},
+		{Write, 0x08},
+		{Notify, 0x10},
+		{Indicate, 0x20},
+		{AuthenticatedSignedWrites, 0x40},
+		{ExtendedProperties, 0x80},
+		{NotifyEncryptionRequired, 0x100},
+		{IndicateEncryptionRequired, 0x200},
+		{Read | Write | Notify, 0x1a},
+		{Broadcast | Read | ExtendedProperties, 0x83},
+		{Notify | NotifyEncryptionRequired | Indicate | IndicateEncryptionRequired, 0x330},
+	}
+
+	for _, test := range tests {
+		if cb := cbProperties(test.properties); cb != test.expected {
+			t.Errorf("%v: expected %#x got %#x\n", test.properties, test.expected, cb)
+		}
+	}
+}
+
+func TestCBPermissions(t *testing.T) {
+	tests := []struct {
+		permissions Permission
+		expected    int
+	}{
+		{0, 0},
+		{Readable, 0x01},
+		{Writeable, 0x02},
+		{ReadEncryptionRequired, 0x04},
+		{WriteEncryptionRequired, 0x08},
+		{Readable | Writeable, 0x03},
+		{ReadEncryptionRequired | Writeable, 0x06},
+		{Readable | WriteEncryptionRequired, 0x09},
+		{ReadEncryptionRequired | WriteEncryptionRequired, 0x0c},
+	}
+
+	for _, test := range tests {
+		if cb := cbPermissions(test.permissions); cb != test.expected {
+			t.Errorf("%v: expected %#x got %#x\n", test.permissions, test.expected, cb)
+		}
+	}
+}
+
+func TestSetServicesPermissions(t *testing.T) {
+	tests := []struct {
+		properties  Property
+		permissions Permission
+		cbProps     int
+		cbPerms     int
+	}{
+		{Read, Readable, 0x02, 0x01},
+		{Read, ReadEncryptionRequired, 0x02, 0x04},
+		{Write, Writeable, 0x08, 0x02},
+		{WriteWithoutResponse, WriteEncryptionRequired, 0x04, 0x08},
+		{Read | Write, ReadEncryptionRequired | Writeable, 0x0a, 0x06},
+		{Read | Write | WriteWithoutResponse, Readable | WriteEncryptionRequired, 0x0e, 0x09},
+		{Notify | NotifyEncryptionRequired, 0, 0x110, 0},
+		{Read | Indicate | IndicateEncryptionRequired, ReadEncryptionRequired, 0x222, 0x04},
+		{Broadcast | Read | ExtendedProperties, Readable, 0x83, 0x01},
+	}
+
+	s := NewService("180d")
+	for i, test := range tests {
+		c := s.AddCharacteristic(fmt.Sprintf("2a%02x", i), test.properties, test.permissions)
+		if test.properties&Read != 0 {
+			c.OnRead(readValue)
+		}
+		if test.properties&(Write|WriteWithoutResponse) != 0 {
+			c.OnWrite(writeValue)
+		}
+	}
+
+	first := s.Characteristics()[0]
+	first.AddDescriptor("2901", []byte("control")).SetPermissions(ReadEncryptionRequired)
+	first.AddDescriptor("2904", []byte{4, 0, 0, 0x27, 1, 0, 0})
+
+	ble, conn := newTestBLE("19.6.0")
+	if err := ble.SetServices([]*Service{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := conn.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("unexpected messages %#v\n", sent)
+	}
+
+	characteristics := sent[1]["kCBMsgArgs"].(xpc.Dict)["kCBMsgArgCharacteristics"].(xpc.Array)
+	for i, test := range tests {
+		characteristic := characteristics[i].(xpc.Dict)
+
+		if p := characteristic["kCBMsgArgCharacteristicProperties"]; p != test.cbProps {
+			t.Errorf("%v: expected properties %#x got %#v\n", test.properties, test.cbProps, p)
+		}
+
+		if p := characteristic["kCBMsgArgAttributePermissions"]; p != test.cbPerms {
+			t.Errorf("%v: expected permissions %#x got %#v\n", test.permissions, test.cbPerms, p)
+		}
+	}
+
+	descriptors := characteristics[0].(xpc.Dict)["kCBMsgArgDescriptors"].(xpc.Array)
+	for i, expected := range []int{0x04, 0x01} {
+		if p := descriptors[i].(xpc.Dict)["kCBMsgArgAttributePermissions"]; p != expected {
+			t.Errorf("descriptor %v: expected permissions %#x got %#v\n", i, expected, p)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package goble
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/raff/goble/xpc"
+)
+
+// Protocol maps the commands sent to blued and the events received from blued
+// to their message ids, for a specific OS release
+//
+// A Protocol can also be loaded from a JSON profile (see LoadProtocolProfile), i.e.:
+//
+//	{
+//	  "release": "21",
+//	  "commands": {"init": 1, "startScanning": 53, ...},
+//	  "events": {"4": "stateChange", "51": "discover", ...}
+//	}
+type Protocol struct {
+	Release  string         `json:"release"`  // the OS release (as in `uname -r`) the protocol is valid for
+	Commands map[string]int `json:"commands"` // message id by command name
+	Events   map[int]string `json:"events"`   // event name by message id
+}
+
+// the changes to the message ids introduced by an OS release
+type protocolDelta struct {
+	release  string
+	commands map[string]int
+	events   map[int]string // an empty name removes the event
+}
+
+// the message ids, by OS release (oldest first).
+// Each release only lists the ids that changed from the previous one.
+//
+// Event ids that have been seen in different releases are accepted by all of them,
+// unless they have been reused for a different event.
+var protocolDeltas = []protocolDelta{
+	{
+		release: "",
+		commands: map[string]int{
+			"init":                    1,
+			"startAdvertising":        8,
+			"stopAdvertising":         9,
+			"addService":              10,
+			"removeService":           11,
+			"removeAllServices":       12,
+			"respond":                 13,
+			"updateValue":             15,
+			"startScanning":           29,
+			"stopScanning":            30,
+			"connect":                 31,
+			"disconnect":              32,
+			"updateRssi":              43,
+			"discoverServices":        44,
+			"discoverCharacteristics": 61,
+			"read":                    64,
+			"write":                   65,
+			"notify":                  67,
+			"discoverDescriptors":     69,
+			"readDescriptor":          76,
+			"writeDescriptor":         77,
+		},
+		events: map[int]string{
+			4:   "stateChange",
+			6:   "stateChange",
+			10:  "serviceAdded",
+			16:  "advertisingStart",
+			17:  "advertisingStop",
+			18:  "readRequest",
+			19:  "writeRequest",
+			20:  "subscribe",
+			21:  "unsubscribe",
+			22:  "readyToUpdate",
+			23:  "transmitQueueFull",
+			37:  "discover",
+			48:  "discover",
+			51:  "discover",
+			57:  "discover",
+			60:  "discover",
+			38:  "connect",
+			58:  "connect",
+			67:  "connect",
+			86:  "connect",
+			40:  "disconnect",
+			53:  "mtuChange",
+			54:  "servicesDiscover",
+			82:  "servicesDiscover",
+			55:  "rssiUpdate",
+			63:  "characteristicsDiscover",
+			89:  "characteristicsDiscover",
+			75:  "descriptorsDiscover",
+			99:  "descriptorsDiscover",
+			70:  "read",
+			95:  "read",
+			115: "read",
+			71:  "write",
+			96:  "write",
+			116: "write",
+			73:  "notify",
+			98:  "notify",
+			118: "notify",
+			78:  "valueRead",
+			103: "valueRead",
+			123: "valueRead",
+			79:  "valueWrite",
+			104: "valueWrite",
+			124: "valueWrite",
+		},
+	},
+	{
+		release: "14",
+		events: map[int]string{
+			53: "disconnect",
+		},
+	},
+	{
+		release: "17",
+		commands: map[string]int{
+			"startScanning": 44,
+		},
+	},
+	{
+		release: "18",
+		commands: map[string]int{
+			"startScanning":           46,
+			"stopScanning":            47,
+			"connect":                 48,
+			"disconnect":              49,
+			"updateRssi":              71,
+			"discoverServices":        72,
+			"discoverCharacteristics": 87,
+			"discoverDescriptors":     94,
+			"read":                    100,
+			"write":                   101,
+			"notify":                  103,
+			"readDescriptor":          112,
+			"writeDescriptor":         113,
+		},
+		events: map[int]string{
+			38: "", // this is not a connect (it has kCBAdvDataDeviceAddress instead of kCBMsgArgDeviceUUID)
+		},
+	},
+	{
+		release: "19",
+		commands: map[string]int{
+			"startScanning":           51,
+			"stopScanning":            52,
+			"connect":                 53,
+			"disconnect":              45,
+			"updateRssi":              76, // or 93 ?
+			"discoverServices":        77,
+			"discoverCharacteristics": 92,
+			"discoverDescriptors":     99,
+			"read":                    105,
+			"write":                   106,
+			"notify":                  108,
+			"readDescriptor":          117,
+			"writeDescriptor":         118,
+		},
+	},
+	{
+		release: "19.4",
+		commands: map[string]int{
+			"startScanning":   53,
+			"read":            90,
+			"write":           91,
+			"notify":          93,
+			"readDescriptor":  102,
+			"writeDescriptor": 103,
+		},
+	},
+}
+
+var (
+	profiles     []*Protocol // registered profiles
+	profilesLock sync.Mutex
+)
+
+// RegisterProtocolProfile registers a Protocol for the OS releases starting from p.Release,
+// to support releases that goble doesn't know about (or to patch the built-in message ids).
+//
+// ProtocolFor selects the registered profile with the newest release that is not newer than the OS release,
+// unless the built-in message ids have been updated for a newer release. The profile is validated (see Protocol.Validate).
+func RegisterProtocolProfile(p *Protocol) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+
+	for i, profile := range profiles {
+		if xpc.CompareReleases(profile.Release, p.Release) == 0 {
+			profiles[i] = p
+			return nil
+		}
+	}
+
+	profiles = append(profiles, p)
+	return nil
+}
+
+// LoadProtocolProfile reads a Protocol from a JSON profile and registers it (see RegisterProtocolProfile)
+func LoadProtocolProfile(r io.Reader) (*Protocol, error) {
+	var p Protocol
+
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid protocol profile: %v", err)
+	}
+
+	if err := RegisterProtocolProfile(&p); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// registeredProfile returns the registered profile that applies to the release (if any)
+func registeredProfile(release string) *Protocol {
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+
+	var best *Protocol
+
+	for _, p := range profiles {
+		if xpc.CompareReleases(release, p.Release) < 0 {
+			continue
+		}
+
+		if best == nil || xpc.CompareReleases(p.Release, best.Release) > 0 {
+			best = p
+		}
+	}
+
+	return best
+}
+
+// ProtocolFor returns the Protocol for the specified OS release
+// (a copy of the registered profile for the release, or the built-in message ids)
+func ProtocolFor(release string) *Protocol {
+	p := &Protocol{Release: release, Commands: map[string]int{}, Events: map[int]string{}}
+
+	var deltas []protocolDelta
+	for _, delta := range protocolDeltas {
+		if xpc.CompareReleases(release, delta.release) < 0 {
+			break
+		}
+
+		deltas = append(deltas, delta)
+	}
+
+	// the profile is used unless the built-in message ids are for a newer release
+	if profile := registeredProfile(release); profile != nil &&
+		xpc.CompareReleases(profile.Release, deltas[len(deltas)-1].release) >= 0 {
+		for name, id := range profile.Commands {
+			p.Commands[name] = id
+		}
+
+		for id, name := range profile.Events {
+			p.Events[id] = name
+		}
+
+		return p
+	}
+
+	for _, delta := range deltas {
+		for name, id := range delta.commands {
+			p.Commands[name] = id
+		}
+
+		for id, name := range delta.events {
+			if name == "" {
+				delete(p.Events, id)
+			} else {
+				p.Events[id] = name
+			}
+		}
+	}
+
+	return p
+}
+
+// Validate checks that the protocol has a message id for every command sent by goble,
+// and that the event names are known
+func (p *Protocol) Validate() error {
+	var problems []string
+
+	for name := range protocolDeltas[0].commands {
+		if _, ok := p.Commands[name]; !ok {
+			problems = append(problems, fmt.Sprintf("missing id for command %q", name))
+		}
+	}
+
+	for name := range p.Commands {
+		if _, ok := protocolDeltas[0].commands[name]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown command %q", name))
+		}
+	}
+
+	events := map[string]bool{}
+	for _, name := range protocolDeltas[0].events {
+		events[name] = true
+	}
+
+	for id, name := range p.Events {
+		if !events[name] {
+			problems = append(problems, fmt.Sprintf("unknown event %q (id %v)", name, id))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid protocol for release %q: %v", p.Release, strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// AtLeast returns true if the protocol release is the same or newer than the specified release
+func (p *Protocol) AtLeast(release string) bool {
+	return xpc.CompareReleases(p.Release, release) >= 0
+}
+
+// CommandId returns the message id for the specified command
+func (p *Protocol) CommandId(name string) (int, error) {
+	if id, ok := p.Commands[name]; ok {
+		return id, nil
+	}
+
+	return 0, fmt.Errorf("no message id for command %q (release %q)", name, p.Release)
+}
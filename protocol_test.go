@@ -0,0 +1,203 @@
+package goble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/raff/goble/xpc"
+)
+
+func TestProtocolFor(t *testing.T) {
+	tests := []struct {
+		release string
+		command string
+		id      int
+	}{
+		{"", "startScanning", 29},
+		{"9.8.0", "startScanning", 29}, // "9." > "19." lexically
+		{"13.4.0", "read", 64},
+		{"17.7.0", "startScanning", 44},
+		{"18.7.0", "read", 100},
+		{"19.0.0", "read", 105},
+		{"19.3.0", "startScanning", 51},
+		{"19.4.0", "startScanning", 53},
+		{"19.6.0", "read", 90},
+		{"20.1.0", "writeDescriptor", 103},
+		{"19.6.0", "init", 1},
+	}
+
+	for _, test := range tests {
+		if id := ProtocolFor(test.release).Commands[test.command]; id != test.id {
+			t.Errorf("%v %v: expected %v got %v\n", test.release, test.command, test.id, id)
+		}
+	}
+
+	if name := ProtocolFor("13.4.0").Events[53]; name != "mtuChange" {
+		t.Errorf("expected %#v got %#v\n", "mtuChange", name)
+	}
+
+	if name := ProtocolFor("14.5.0").Events[53]; name != "disconnect" {
+		t.Errorf("expected %#v got %#v\n", "disconnect", name)
+	}
+
+	if name, ok := ProtocolFor("18.7.0").Events[38]; ok {
+		t.Errorf("expected no event for 38 got %#v\n", name)
+	}
+
+	if _, err := ProtocolFor("19.6.0").CommandId("unknown"); err == nil {
+		t.Error("expected error for unknown command")
+	}
+}
+
+func TestCompareReleases(t *testing.T) {
+	tests := []struct {
+		a, b string
+		cmp  int
+	}{
+		{"9.8.0", "19", -1},
+		{"19.6.0", "19.4", 1},
+		{"19.4", "19.4.0", 0},
+		{"20", "19.4", 1},
+		{"14.0.0", "", 1},
+	}
+
+	for _, test := range tests {
+		if cmp := xpc.CompareReleases(test.a, test.b); cmp != test.cmp {
+			t.Errorf("%v %v: expected %v got %v\n", test.a, test.b, test.cmp, cmp)
+		}
+	}
+}
+
+func TestSetProtocol(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+
+	p := ProtocolFor("19.6.0")
+	p.Commands["connect"] = 200
+	p.Events[201] = "disconnect"
+	if err := ble.SetProtocol(p); err != nil {
+		t.Fatal(err)
+	}
+
+	ble.Connect(testDevice)
+
+	if id := conn.Sent()[0]["kCBMsgId"]; id != 200 {
+		t.Errorf("expected 200 got %v\n", id)
+	}
+
+	ch := waitEvent(ble, "disconnect")
+	conn.Inject(201, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice})
+
+	if ev := expectEvent(t, ch); ev.DeviceUUID != testDevice {
+		t.Errorf("expected %v got %v\n", testDevice, ev.DeviceUUID)
+	}
+}
+
+func TestMtuChangeByRelease(t *testing.T) {
+	ble, conn := newTestBLE("13.4.0")
+	ch := waitEvent(ble, "mtuChange")
+	conn.Inject(53, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgATTMTU": 185})
+
+	if ev := expectEvent(t, ch); ev.Mtu != 185 {
+		t.Errorf("expected 185 got %v\n", ev.Mtu)
+	}
+
+	ble, conn = newTestBLE("19.6.0")
+	ch = waitEvent(ble, "disconnect")
+	conn.Inject(53, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice})
+
+	if ev := expectEvent(t, ch); ev.DeviceUUID != testDevice {
+		t.Errorf("expected %v got %v\n", testDevice, ev.DeviceUUID)
+	}
+}
+
+func TestRegisterProtocolProfile(t *testing.T) {
+	defer func() { profiles = nil }()
+
+	p := ProtocolFor("19.6.0")
+	p.Release = "21"
+	p.Commands["startScanning"] = 60
+	delete(p.Commands, "connect")
+
+	if err := RegisterProtocolProfile(p); err == nil || !strings.Contains(err.Error(), `missing id for command "connect"`) {
+		t.Errorf("expected missing command error got %v\n", err)
+	}
+
+	p.Commands["connect"] = 61
+	if err := RegisterProtocolProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		release string
+		id      int
+	}{
+		{"19.6.0", 53},
+		{"21.0.0", 60},
+		{"22.1.0", 60},
+	}
+
+	for _, test := range tests {
+		if id := ProtocolFor(test.release).Commands["startScanning"]; id != test.id {
+			t.Errorf("%v: expected %v got %v\n", test.release, test.id, id)
+		}
+	}
+
+	if release := ProtocolFor("22.1.0").Release; release != "22.1.0" {
+		t.Errorf("expected %#v got %#v\n", "22.1.0", release)
+	}
+
+	// a profile for an older release doesn't override newer built-in ids
+	old := ProtocolFor("18.0.0")
+	old.Release = "18.2"
+	old.Commands["read"] = 7
+	if err := RegisterProtocolProfile(old); err != nil {
+		t.Fatal(err)
+	}
+
+	if id := ProtocolFor("18.5.0").Commands["read"]; id != 7 {
+		t.Errorf("expected 7 got %v\n", id)
+	}
+
+	if id := ProtocolFor("19.6.0").Commands["read"]; id != 90 {
+		t.Errorf("expected 90 got %v\n", id)
+	}
+}
+
+func TestLoadProtocolProfile(t *testing.T) {
+	defer func() { profiles = nil }()
+
+	base := ProtocolFor("19.6.0")
+
+	var commands []string
+	for name, id := range base.Commands {
+		commands = append(commands, fmt.Sprintf("%q: %v", name, id))
+	}
+
+	profile := `{"release": "21", "commands": {` + strings.Join(commands, ", ") + `}, "events": {"4": "stateChange", "201": "discover"}}`
+
+	p, err := LoadProtocolProfile(strings.NewReader(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Events[201] != "discover" {
+		t.Errorf("expected discover got %#v\n", p.Events)
+	}
+
+	ble, conn := newTestBLE("21.1.0")
+	ch := waitEvent(ble, "discover")
+	conn.Inject(201, xpc.Dict{"kCBMsgArgDeviceUUID": xpc.MustUUID("ffeeddccbbaa99887766554433221100"), "kCBMsgArgAdvertisementData": xpc.Dict{"kCBAdvDataLocalName": "test"}})
+
+	if ev := expectEvent(t, ch); ev.Peripheral.Advertisement.LocalName != "test" {
+		t.Errorf("expected %#v got %#v\n", "test", ev.Peripheral.Advertisement.LocalName)
+	}
+
+	if _, err := LoadProtocolProfile(strings.NewReader(`{"release": "22", "commands": {"fly": 1}}`)); err == nil {
+		t.Error("expected validation error")
+	}
+
+	if _, err := LoadProtocolProfile(strings.NewReader(`{"release": `)); err == nil {
+		t.Error("expected json error")
+	}
+}
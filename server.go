@@ -0,0 +1,442 @@
+package goble
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sort"
+
+	"github.com/raff/goble/xpc"
+)
+
+//
+// GATT server (peripheral role) requests from remote centrals, and notifications
+//
+
+var (
+	NOT_PUBLISHED  = errors.New("characteristic not published")
+	NOT_NOTIFIABLE = errors.New("characteristic doesn't support notifications")
+
+	SERVICE_NOT_PUBLISHED = errors.New("service not published")
+)
+
+// the default ATT MTU (if not negotiated), that is also the minimum ATT MTU
+const defaultMtu = 23
+
+// the number of sent value updates that are kept, to resend them if blued reports the transmit queue full
+const maxSentUpdates = 32
+
+// Subscriber is a central subscribed to the notifications (or indications) of a characteristic
+type Subscriber struct {
+	Central xpc.UUID
+	Mtu     int
+}
+
+// handle the GATT server events, returning false for the other events
+func (ble *BLE) handleServerEvent(name string, args xpc.Dict) bool {
+	switch name {
+	case "serviceAdded":
+		var a serviceAddedArgs
+		mustUnmarshal(args, &a)
+		ble.handleServiceAdded(a)
+
+	case "readRequest":
+		var a readRequestArgs
+		mustUnmarshal(args, &a)
+		ble.handleReadRequest(a)
+
+	case "writeRequest":
+		var a writeRequestArgs
+		mustUnmarshal(args, &a)
+		ble.handleWriteRequest(a)
+
+	case "subscribe", "unsubscribe":
+		var a subscribeArgs
+		mustUnmarshal(args, &a)
+		ble.handleSubscribe(name, a)
+
+	case "transmitQueueFull":
+		var a transmitQueueFullArgs
+		mustUnmarshal(args, &a)
+
+		ble.attributesLock.Lock()
+		ble.queueFull = true
+		if update := ble.takeSentUpdate(a.AttributeID, a.Data); update != nil {
+			// the update was not sent, try again (with the same centrals) when blued is ready
+			ble.failedUpdates = append(ble.failedUpdates, update)
+		} else if ble.verbose {
+			log.Println("transmit queue full for unknown update", a.AttributeID)
+		}
+		ble.attributesLock.Unlock()
+
+	case "readyToUpdate":
+		ble.attributesLock.Lock()
+		queue := append(ble.failedUpdates, ble.updateQueue...)
+		ble.failedUpdates = nil
+		ble.updateQueue = nil
+		ble.queueFull = false
+
+		for _, update := range queue {
+			ble.sendUpdate(update)
+		}
+		ble.attributesLock.Unlock()
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+// track the result of adding a service, and emit "servicesSet" when all the services set with SetServices have been added
+func (ble *BLE) handleServiceAdded(a serviceAddedArgs) {
+	err := cbError(a.Result)
+
+	ble.attributesLock.Lock()
+
+	var service *Service
+	if a.AttributeID > 0 && a.AttributeID < len(ble.attributes) {
+		service, _ = ble.attributes[a.AttributeID].(*Service)
+	}
+
+	if service != nil && err != nil {
+		// the service was not published
+		ble.removeServiceAttributes(a.AttributeID)
+	}
+
+	var servicesSet *Event
+
+	if pending, ok := ble.pendingServices[a.AttributeID]; ok {
+		delete(ble.pendingServices, a.AttributeID)
+		ble.servicesErrors[pending.uuid] = err
+		if err != nil && ble.servicesErr == nil {
+			ble.servicesErr = err
+		}
+
+		if len(ble.pendingServices) == 0 {
+			servicesSet = &Event{Name: "servicesSet", ServiceErrors: ble.servicesErrors, Err: ble.servicesErr}
+		}
+	}
+
+	ble.attributesLock.Unlock()
+
+	if service == nil && ble.verbose {
+		log.Println("service added for unknown attribute", a.AttributeID)
+	}
+
+	ble.Emit(Event{Name: "serviceAdded", ServiceUuid: serviceUuid(service), Result: a.Result, Err: err})
+
+	if servicesSet != nil {
+		ble.Emit(*servicesSet)
+	}
+}
+
+// find the characteristic (and its service) with the specified attribute id
+func (ble *BLE) findAttribute(attributeId int) (*Service, *Characteristic) {
+	ble.attributesLock.Lock()
+	defer ble.attributesLock.Unlock()
+
+	if attributeId <= 0 || attributeId >= len(ble.attributes) {
+		return nil, nil
+	}
+
+	c, ok := ble.attributes[attributeId].(*Characteristic)
+	if !ok {
+		return nil, nil
+	}
+
+	// the characteristics follow their service
+	for i := attributeId - 1; i > 0; i-- {
+		if s, ok := ble.attributes[i].(*Service); ok {
+			return s, c
+		}
+	}
+
+	return nil, c
+}
+
+// read the characteristic value, from the static value or the read handler
+func (c *Characteristic) read(offset int) (data []byte, err error) {
+	if c.properties&Read == 0 {
+		return nil, ATTReadNotPermitted
+	}
+
+	if c.value != nil {
+		if offset > len(c.value) {
+			return nil, ATTInvalidOffset
+		}
+
+		return c.value[offset:], nil
+	}
+
+	if c.onRead == nil {
+		return nil, ATTReadNotPermitted
+	}
+
+	defer c.recoverHandler("read", &err)
+	return c.onRead(offset)
+}
+
+// write the characteristic value, with the write handler
+// (a write without response requires WriteWithoutResponse, a write with response requires Write)
+func (c *Characteristic) write(data []byte, offset int, withoutResponse bool) (err error) {
+	var property Property = Write
+	if withoutResponse {
+		property = WriteWithoutResponse
+	}
+
+	if c.properties&property == 0 || c.onWrite == nil {
+		return ATTWriteNotPermitted
+	}
+
+	defer c.recoverHandler("write", &err)
+	return c.onWrite(data, offset, withoutResponse)
+}
+
+// turn a panic in a read or write handler into ATTUnlikelyError, so that the central still gets a response
+// (the panic is always logged, as it's a bug in the handler)
+func (c *Characteristic) recoverHandler(op string, err *error) {
+	if r := recover(); r != nil {
+		log.Println(op, "handler for characteristic", c.uuid, "panic:", r)
+
+		*err = ATTUnlikelyError
+	}
+}
+
+// answer a read request with the characteristic value
+func (ble *BLE) handleReadRequest(a readRequestArgs) {
+	var data []byte
+	var err error
+
+	s, c := ble.findAttribute(a.AttributeID)
+	if c == nil {
+		err = ATTInvalidHandle
+	} else {
+		data, err = c.read(a.Offset)
+	}
+
+	if err != nil {
+		data = nil
+	}
+
+	result := attResult(err)
+	ble.respond(a.AttributeID, a.TransactionID, data, result)
+
+	if c != nil {
+		ble.Emit(Event{Name: "readRequest", DeviceUUID: a.DeviceUUID, ServiceUuid: serviceUuid(s), CharacteristicUuid: c.uuid, Data: data, Result: result, Err: attError(result)})
+	} else if ble.verbose {
+		log.Println("read request for unknown attribute", a.AttributeID)
+	}
+}
+
+// call the write handlers and answer the write request (unless all the writes ignore the response)
+func (ble *BLE) handleWriteRequest(a writeRequestArgs) {
+	if len(a.Writes) == 0 {
+		return
+	}
+
+	result := 0
+	respond := false
+
+	for _, w := range a.Writes {
+		if !w.IgnoreResponse {
+			respond = true
+		}
+
+		if result != 0 {
+			// the request already failed
+			continue
+		}
+
+		s, c := ble.findAttribute(w.AttributeID)
+		if c == nil {
+			result = int(ATTInvalidHandle)
+
+			if ble.verbose {
+				log.Println("write request for unknown attribute", w.AttributeID)
+			}
+			continue
+		}
+
+		result = attResult(c.write(w.Data, w.Offset, w.IgnoreResponse))
+		ble.Emit(Event{Name: "writeRequest", DeviceUUID: a.DeviceUUID, ServiceUuid: serviceUuid(s), CharacteristicUuid: c.uuid, Data: w.Data, Result: result, Err: attError(result)})
+	}
+
+	if respond {
+		ble.respond(a.Writes[0].AttributeID, a.TransactionID, nil, result)
+	}
+}
+
+// send the response to a read or write request
+func (ble *BLE) respond(attributeId, transactionId int, data []byte, result int) {
+	ble.sendCommand("respond", xpc.Dict{
+		"kCBMsgArgAttributeID":   attributeId,
+		"kCBMsgArgData":          data,
+		"kCBMsgArgTransactionID": transactionId,
+		"kCBMsgArgResult":        result,
+	})
+}
+
+func serviceUuid(s *Service) string {
+	if s == nil {
+		return ""
+	}
+
+	return s.uuid
+}
+
+// track the centrals subscribed to a characteristic
+func (ble *BLE) handleSubscribe(name string, a subscribeArgs) {
+	s, c := ble.findAttribute(a.AttributeID)
+	if c == nil {
+		if ble.verbose {
+			log.Println(name, "for unknown attribute", a.AttributeID)
+		}
+		return
+	}
+
+	mtu := a.Mtu
+	if mtu < defaultMtu {
+		mtu = defaultMtu
+	}
+
+	ble.attributesLock.Lock()
+	if name == "subscribe" {
+		c.subscribers[a.DeviceUUID] = mtu
+	} else {
+		delete(c.subscribers, a.DeviceUUID)
+	}
+	ble.attributesLock.Unlock()
+
+	ble.Emit(Event{Name: name, DeviceUUID: a.DeviceUUID, ServiceUuid: serviceUuid(s), CharacteristicUuid: c.uuid, Mtu: mtu})
+}
+
+// send a value update, or queue it if the blued transmit queue is full
+// (must be called with attributesLock held)
+func (ble *BLE) sendUpdate(update xpc.Dict) {
+	if ble.queueFull {
+		ble.updateQueue = append(ble.updateQueue, update)
+		return
+	}
+
+	ble.sentUpdates = append(ble.sentUpdates, update)
+	if len(ble.sentUpdates) > maxSentUpdates {
+		ble.sentUpdates = ble.sentUpdates[1:]
+	}
+
+	ble.sendCommand("updateValue", update)
+}
+
+// remove and return the (oldest) sent update with the specified attribute id and data, or nil if not found
+// (must be called with attributesLock held)
+func (ble *BLE) takeSentUpdate(attributeId int, data []byte) xpc.Dict {
+	for i, update := range ble.sentUpdates {
+		if update["kCBMsgArgAttributeID"] == attributeId && bytes.Equal(update["kCBMsgArgData"].([]byte), data) {
+			ble.sentUpdates = append(ble.sentUpdates[:i:i], ble.sentUpdates[i+1:]...)
+			return update
+		}
+	}
+
+	return nil
+}
+
+// Subscribers returns the centrals subscribed to the characteristic, sorted by UUID
+func (c *Characteristic) Subscribers() []Subscriber {
+	if c.ble == nil {
+		return nil
+	}
+
+	c.ble.attributesLock.Lock()
+	defer c.ble.attributesLock.Unlock()
+
+	subscribers := make([]Subscriber, 0, len(c.subscribers))
+	for central, mtu := range c.subscribers {
+		subscribers = append(subscribers, Subscriber{Central: central, Mtu: mtu})
+	}
+
+	sort.Slice(subscribers, func(i, j int) bool {
+		return subscribers[i].Central.String() < subscribers[j].Central.String()
+	})
+
+	return subscribers
+}
+
+// Notify sends the value to all the subscribed centrals (see UpdateValue)
+func (c *Characteristic) Notify(data []byte) error {
+	return c.UpdateValue(data)
+}
+
+// UpdateValue sends the value to the specified subscribed centrals (or to all the subscribed centrals if none is specified),
+// as a notification or indication. The value is split in chunks that fit the smallest MTU (an empty value is sent as
+// a single empty update), and the updates are queued (and sent in order) if the blued transmit queue is full.
+//
+// It returns NOT_PUBLISHED if the characteristic is not in the services set with BLE.SetServices,
+// and NOT_NOTIFIABLE if the characteristic doesn't have the Notify or Indicate property.
+func (c *Characteristic) UpdateValue(data []byte, centrals ...xpc.UUID) error {
+	ble := c.ble
+	if ble == nil {
+		return NOT_PUBLISHED
+	}
+
+	if c.properties&(Notify|Indicate) == 0 {
+		return NOT_NOTIFIABLE
+	}
+
+	ble.attributesLock.Lock()
+	defer ble.attributesLock.Unlock()
+
+	if c.attributeId >= len(ble.attributes) || ble.attributes[c.attributeId] != c {
+		return NOT_PUBLISHED
+	}
+
+	targets := []xpc.UUID{}
+	mtu := 0
+
+	for central, cmtu := range c.subscribers {
+		if len(centrals) > 0 && !containsUuid(centrals, central) {
+			continue
+		}
+
+		targets = append(targets, central)
+		if mtu == 0 || cmtu < mtu {
+			mtu = cmtu
+		}
+	}
+
+	if len(targets) == 0 {
+		// no subscribers
+		return nil
+	}
+
+	if len(centrals) == 0 {
+		targets = []xpc.UUID{} // all subscribed centrals
+	}
+
+	chunk := mtu - 3 // ATT opcode and handle (the subscribers MTU is at least defaultMtu)
+
+	for {
+		n := chunk
+		if n > len(data) {
+			n = len(data)
+		}
+
+		ble.sendUpdate(xpc.Dict{"kCBMsgArgAttributeID": c.attributeId, "kCBMsgArgData": data[:n], "kCBMsgArgUUIDs": targets})
+		data = data[n:]
+
+		if len(data) == 0 {
+			break
+		}
+	}
+
+	return nil
+}
+
+func containsUuid(uuids []xpc.UUID, uuid xpc.UUID) bool {
+	for _, u := range uuids {
+		if u == uuid {
+			return true
+		}
+	}
+
+	return false
+}
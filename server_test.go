@@ -0,0 +1,495 @@
+package goble
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/raff/goble/xpc"
+)
+
+// newTestServer returns a BLE with a GATT service:
+//
+//	attribute 1: service 180d
+//	attribute 2: characteristic 2a38 (read-only, static value)
+//	attribute 3: characteristic 2a39 (read, write)
+//	attribute 4: characteristic 2a37 (notify)
+func newTestServer(t *testing.T, onRead ReadHandler, onWrite WriteHandler) (*BLE, *FakeTransport) {
+	s := NewService("180d")
+	s.AddCharacteristic("2a38", Read, Readable).SetValue([]byte{1, 2, 3})
+	s.AddCharacteristic("2a39", Read|Write|WriteWithoutResponse, Readable|Writeable).OnRead(onRead).OnWrite(onWrite)
+	s.AddCharacteristic("2a37", Notify, 0)
+
+	ble, conn := newTestBLE("19.6.0")
+	if err := ble.SetServices([]*Service{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Reset()
+	return ble, conn
+}
+
+func expectResponse(t *testing.T, conn *FakeTransport, attributeId, transactionId int, data []byte, result int) {
+	sent := conn.Sent()
+	if len(sent) != 1 || sent[0]["kCBMsgId"] != 13 {
+		t.Fatalf("expected response got %#v\n", sent)
+	}
+
+	args := sent[0]["kCBMsgArgs"].(xpc.Dict)
+	if args["kCBMsgArgAttributeID"] != attributeId || args["kCBMsgArgTransactionID"] != transactionId || args["kCBMsgArgResult"] != result {
+		t.Errorf("unexpected response %#v\n", args)
+	}
+
+	if d := args["kCBMsgArgData"].([]byte); !bytes.Equal(d, data) {
+		t.Errorf("expected %x got %x\n", data, d)
+	}
+
+	conn.Reset()
+}
+
+func TestReadRequest(t *testing.T) {
+	var offsets []int
+
+	ble, conn := newTestServer(t, func(offset int) ([]byte, error) {
+		offsets = append(offsets, offset)
+		if offset > 0 {
+			return nil, ATTInvalidOffset
+		}
+		return []byte("dynamic"), nil
+	}, writeValue)
+
+	ch := waitEvent(ble, "readRequest")
+
+	conn.Inject(18, xpc.Dict{"kCBMsgArgAttributeID": 2, "kCBMsgArgTransactionID": 7, "kCBMsgArgOffset": 1})
+	expectResponse(t, conn, 2, 7, []byte{2, 3}, 0)
+
+	if ev := expectEvent(t, ch); ev.ServiceUuid != "180d" || ev.CharacteristicUuid != "2a38" || !bytes.Equal(ev.Data, []byte{2, 3}) {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+
+	conn.Inject(18, xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgTransactionID": 8})
+	expectResponse(t, conn, 3, 8, []byte("dynamic"), 0)
+
+	conn.Inject(18, xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgTransactionID": 9, "kCBMsgArgOffset": 5})
+	expectResponse(t, conn, 3, 9, nil, int(ATTInvalidOffset))
+
+	if ev := expectEvent(t, ch); ev.Err != nil {
+		t.Errorf("expected no error got %v\n", ev.Err)
+	}
+
+	if ev := expectEvent(t, ch); ev.Err != ATTInvalidOffset {
+		t.Errorf("expected %v got %v\n", ATTInvalidOffset, ev.Err)
+	}
+
+	if len(offsets) != 2 || offsets[1] != 5 {
+		t.Errorf("unexpected offsets %v\n", offsets)
+	}
+
+	conn.Inject(18, xpc.Dict{"kCBMsgArgAttributeID": 2, "kCBMsgArgTransactionID": 10, "kCBMsgArgOffset": 4})
+	expectResponse(t, conn, 2, 10, nil, int(ATTInvalidOffset))
+
+	conn.Inject(18, xpc.Dict{"kCBMsgArgAttributeID": 4, "kCBMsgArgTransactionID": 11})
+	expectResponse(t, conn, 4, 11, nil, int(ATTReadNotPermitted))
+
+	conn.Inject(18, xpc.Dict{"kCBMsgArgAttributeID": 1, "kCBMsgArgTransactionID": 12})
+	expectResponse(t, conn, 1, 12, nil, int(ATTInvalidHandle))
+
+	conn.Inject(18, xpc.Dict{"kCBMsgArgAttributeID": 99, "kCBMsgArgTransactionID": 13})
+	expectResponse(t, conn, 99, 13, nil, int(ATTInvalidHandle))
+}
+
+func TestWriteRequest(t *testing.T) {
+	type write struct {
+		data            string
+		offset          int
+		withoutResponse bool
+	}
+
+	var writes []write
+
+	ble, conn := newTestServer(t, readValue, func(data []byte, offset int, withoutResponse bool) error {
+		writes = append(writes, write{string(data), offset, withoutResponse})
+		if string(data) == "bad" {
+			return errors.New("bad value")
+		}
+		if string(data) == "long" {
+			return ATTInvalidAttributeValueLength
+		}
+		return nil
+	})
+
+	ch := waitEvent(ble, "writeRequest")
+
+	conn.Inject(19, xpc.Dict{"kCBMsgArgTransactionID": 1, "kCBMsgArgATTWrites": xpc.Array{
+		xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgData": []byte("hello")},
+	}})
+	expectResponse(t, conn, 3, 1, nil, 0)
+
+	if ev := expectEvent(t, ch); ev.CharacteristicUuid != "2a39" || string(ev.Data) != "hello" {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+
+	// queued (long) write
+	conn.Inject(19, xpc.Dict{"kCBMsgArgTransactionID": 2, "kCBMsgArgATTWrites": xpc.Array{
+		xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgData": []byte("abc")},
+		xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgData": []byte("def"), "kCBMsgArgOffset": 3},
+	}})
+	expectResponse(t, conn, 3, 2, nil, 0)
+
+	// write without response
+	conn.Inject(19, xpc.Dict{"kCBMsgArgTransactionID": 3, "kCBMsgArgATTWrites": xpc.Array{
+		xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgData": []byte("cmd"), "kCBMsgArgIgnoreResponse": 1},
+	}})
+
+	if sent := conn.Sent(); len(sent) != 0 {
+		t.Errorf("expected no response got %#v\n", sent)
+	}
+
+	expected := []write{{"hello", 0, false}, {"abc", 0, false}, {"def", 3, false}, {"cmd", 0, true}}
+	if len(writes) != len(expected) {
+		t.Fatalf("expected %v got %v\n", expected, writes)
+	}
+
+	for i, w := range expected {
+		if writes[i] != w {
+			t.Errorf("expected %v got %v\n", w, writes[i])
+		}
+	}
+
+	conn.Inject(19, xpc.Dict{"kCBMsgArgTransactionID": 4, "kCBMsgArgATTWrites": xpc.Array{
+		xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgData": []byte("long")},
+	}})
+	expectResponse(t, conn, 3, 4, nil, int(ATTInvalidAttributeValueLength))
+
+	conn.Inject(19, xpc.Dict{"kCBMsgArgTransactionID": 5, "kCBMsgArgATTWrites": xpc.Array{
+		xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgData": []byte("bad")},
+	}})
+	expectResponse(t, conn, 3, 5, nil, int(ATTUnlikelyError))
+
+	conn.Inject(19, xpc.Dict{"kCBMsgArgTransactionID": 6, "kCBMsgArgATTWrites": xpc.Array{
+		xpc.Dict{"kCBMsgArgAttributeID": 2, "kCBMsgArgData": []byte("x")},
+	}})
+	expectResponse(t, conn, 2, 6, nil, int(ATTWriteNotPermitted))
+}
+
+func TestHandlerPanic(t *testing.T) {
+	ble, conn := newTestServer(t, func(offset int) ([]byte, error) {
+		panic("read")
+	}, func(data []byte, offset int, withoutResponse bool) error {
+		panic("write")
+	})
+
+	ch := waitEvent(ble, "readRequest")
+
+	conn.Inject(18, xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgTransactionID": 1})
+	expectResponse(t, conn, 3, 1, nil, int(ATTUnlikelyError))
+
+	if ev := expectEvent(t, ch); ev.Err != ATTUnlikelyError {
+		t.Errorf("expected %v got %v\n", ATTUnlikelyError, ev.Err)
+	}
+
+	conn.Inject(19, xpc.Dict{"kCBMsgArgTransactionID": 2, "kCBMsgArgATTWrites": xpc.Array{
+		xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgData": []byte("x")},
+	}})
+	expectResponse(t, conn, 3, 2, nil, int(ATTUnlikelyError))
+}
+
+func TestWriteProperties(t *testing.T) {
+	var writes int
+
+	onWrite := func(data []byte, offset int, withoutResponse bool) error {
+		writes++
+		return nil
+	}
+
+	s := NewService("180d")
+	s.AddCharacteristic("2a39", Write, Writeable).OnWrite(onWrite)
+	s.AddCharacteristic("2a3a", WriteWithoutResponse, Writeable).OnWrite(onWrite)
+
+	ble, conn := newTestBLE("19.6.0")
+	if err := ble.SetServices([]*Service{s}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Reset()
+
+	ch := waitEvent(ble, "writeRequest")
+
+	// write without response to a Write characteristic
+	conn.Inject(19, xpc.Dict{"kCBMsgArgTransactionID": 1, "kCBMsgArgATTWrites": xpc.Array{
+		xpc.Dict{"kCBMsgArgAttributeID": 2, "kCBMsgArgData": []byte("x"), "kCBMsgArgIgnoreResponse": 1},
+	}})
+
+	if ev := expectEvent(t, ch); ev.Err != ATTWriteNotPermitted {
+		t.Errorf("expected %v got %v\n", ATTWriteNotPermitted, ev.Err)
+	}
+
+	// write with response to a WriteWithoutResponse characteristic
+	conn.Inject(19, xpc.Dict{"kCBMsgArgTransactionID": 2, "kCBMsgArgATTWrites": xpc.Array{
+		xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgData": []byte("x")},
+	}})
+	expectResponse(t, conn, 3, 2, nil, int(ATTWriteNotPermitted))
+
+	if writes != 0 {
+		t.Errorf("expected no writes got %v\n", writes)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ble, conn := newTestServer(t, readValue, writeValue)
+	c := ble.attributes[4].(*Characteristic)
+	other := xpc.MakeUUID("ffeeddccbbaa99887766554433221100")
+
+	if err := c.Notify([]byte{1}); err != nil || len(conn.Sent()) != 0 {
+		t.Errorf("expected no updates without subscribers got %v %#v\n", err, conn.Sent())
+	}
+
+	ch := waitEvent(ble, "subscribe")
+
+	conn.Inject(20, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgAttributeID": 4, "kCBMsgArgATTMTU": 185})
+	if ev := expectEvent(t, ch); ev.DeviceUUID != testDevice || ev.ServiceUuid != "180d" || ev.CharacteristicUuid != "2a37" || ev.Mtu != 185 {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+
+	conn.Inject(20, xpc.Dict{"kCBMsgArgDeviceUUID": other, "kCBMsgArgAttributeID": 4})
+	if ev := expectEvent(t, ch); ev.DeviceUUID != other || ev.Mtu != defaultMtu {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+
+	expected := []Subscriber{{Central: testDevice, Mtu: 185}, {Central: other, Mtu: defaultMtu}}
+	if subscribers := c.Subscribers(); !reflect.DeepEqual(subscribers, expected) {
+		t.Errorf("expected %#v got %#v\n", expected, subscribers)
+	}
+
+	ch = waitEvent(ble, "unsubscribe")
+
+	conn.Inject(21, xpc.Dict{"kCBMsgArgDeviceUUID": other, "kCBMsgArgAttributeID": 4})
+	if ev := expectEvent(t, ch); ev.DeviceUUID != other || ev.CharacteristicUuid != "2a37" {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+
+	if subscribers := c.Subscribers(); len(subscribers) != 1 || subscribers[0].Central != testDevice {
+		t.Errorf("unexpected subscribers %#v\n", subscribers)
+	}
+}
+
+func expectUpdates(t *testing.T, conn *FakeTransport, attributeId int, centrals []xpc.UUID, chunks ...[]byte) {
+	sent := conn.Sent()
+	if len(sent) != len(chunks) {
+		t.Fatalf("expected %v updates got %#v\n", len(chunks), sent)
+	}
+
+	for i, m := range sent {
+		if m["kCBMsgId"] != 15 {
+			t.Fatalf("expected update got %#v\n", m)
+		}
+
+		args := m["kCBMsgArgs"].(xpc.Dict)
+		if args["kCBMsgArgAttributeID"] != attributeId || !reflect.DeepEqual(args["kCBMsgArgUUIDs"], centrals) {
+			t.Errorf("unexpected update %#v\n", args)
+		}
+
+		if d := args["kCBMsgArgData"].([]byte); !bytes.Equal(d, chunks[i]) {
+			t.Errorf("expected %x got %x\n", chunks[i], d)
+		}
+	}
+
+	conn.Reset()
+}
+
+func TestUpdateValue(t *testing.T) {
+	ble, conn := newTestServer(t, readValue, writeValue)
+	c := ble.attributes[4].(*Characteristic)
+	other := xpc.MakeUUID("ffeeddccbbaa99887766554433221100")
+
+	if err := ble.attributes[3].(*Characteristic).Notify([]byte{1}); err != NOT_NOTIFIABLE {
+		t.Errorf("expected %v got %v\n", NOT_NOTIFIABLE, err)
+	}
+
+	if err := NewService("180d").AddCharacteristic("2a37", Notify, 0).Notify([]byte{1}); err != NOT_PUBLISHED {
+		t.Errorf("expected %v got %v\n", NOT_PUBLISHED, err)
+	}
+
+	conn.Inject(20, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgAttributeID": 4, "kCBMsgArgATTMTU": 30})
+	conn.Inject(20, xpc.Dict{"kCBMsgArgDeviceUUID": other, "kCBMsgArgAttributeID": 4, "kCBMsgArgATTMTU": 26})
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz0123456789")
+
+	// chunked to the smallest MTU
+	if err := c.Notify(data); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdates(t, conn, 4, []xpc.UUID{}, data[:23], data[23:])
+
+	// only to the specified central
+	if err := c.UpdateValue(data, testDevice); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdates(t, conn, 4, []xpc.UUID{testDevice}, data[:27], data[27:])
+
+	// an empty value is sent as a single update
+	if err := c.Notify(nil); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdates(t, conn, 4, []xpc.UUID{}, []byte{})
+
+	// resent (to the same centrals) and queued while the transmit queue is full
+	if err := c.UpdateValue(data[:4], testDevice); err != nil {
+		t.Fatal(err)
+	}
+	conn.Reset()
+
+	conn.Inject(23, xpc.Dict{"kCBMsgArgAttributeID": 4, "kCBMsgArgData": data[:4]})
+	if err := c.UpdateValue(data, testDevice); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdates(t, conn, 4, nil)
+
+	conn.Inject(22, xpc.Dict{})
+	expectUpdates(t, conn, 4, []xpc.UUID{testDevice}, data[:4], data[:27], data[27:])
+
+	if err := c.Notify(data[:2]); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdates(t, conn, 4, []xpc.UUID{}, data[:2])
+}
+
+func TestSubscribeMtu(t *testing.T) {
+	ble, conn := newTestServer(t, readValue, writeValue)
+	c := ble.attributes[4].(*Characteristic)
+
+	// an invalid MTU is replaced by the default (minimum) MTU
+	conn.Inject(20, xpc.Dict{"kCBMsgArgDeviceUUID": testDevice, "kCBMsgArgAttributeID": 4, "kCBMsgArgATTMTU": 3})
+	if subscribers := c.Subscribers(); len(subscribers) != 1 || subscribers[0].Mtu != defaultMtu {
+		t.Errorf("unexpected subscribers %#v\n", subscribers)
+	}
+
+	data := make([]byte, 30)
+	if err := c.Notify(data); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdates(t, conn, 4, []xpc.UUID{}, data[:20], data[20:])
+}
+
+func TestServicesSet(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+
+	hrs := NewService("180d")
+	hrs.AddCharacteristic("2a37", Notify, 0)
+	bas := NewService("180f")
+	c := bas.AddCharacteristic("2a19", Read|Notify, Readable).OnRead(readValue)
+
+	if err := ble.SetServices([]*Service{hrs, bas}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Reset()
+
+	added := waitEvent(ble, "serviceAdded")
+	set := waitEvent(ble, "servicesSet")
+
+	conn.Inject(10, xpc.Dict{"kCBMsgArgAttributeID": 1, "kCBMsgArgResult": 0})
+	if ev := expectEvent(t, added); ev.ServiceUuid != "180d" || ev.Err != nil {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+
+	added = waitEvent(ble, "serviceAdded")
+
+	conn.Inject(10, xpc.Dict{"kCBMsgArgAttributeID": 3, "kCBMsgArgResult": int(CBUuidNotAllowed)})
+	if ev := expectEvent(t, added); ev.ServiceUuid != "180f" || ev.Err != CBUuidNotAllowed {
+		t.Errorf("unexpected event %#v\n", ev)
+	}
+
+	ev := expectEvent(t, set)
+	expected := map[string]error{"180d": nil, "180f": CBUuidNotAllowed}
+	if ev.Err != CBUuidNotAllowed || !reflect.DeepEqual(ev.ServiceErrors, expected) {
+		t.Errorf("expected %#v got %#v\n", expected, ev)
+	}
+
+	// the service that failed is not published
+	if len(ble.attributes) != 3 || ble.attributes[1] != hrs {
+		t.Errorf("unexpected attributes %#v\n", ble.attributes)
+	}
+
+	if err := c.Notify([]byte{1}); err != NOT_PUBLISHED {
+		t.Errorf("expected %v got %v\n", NOT_PUBLISHED, err)
+	}
+}
+
+func TestAddRemoveService(t *testing.T) {
+	ble, conn := newTestBLE("19.6.0")
+
+	hrs := NewService("180d")
+	hrs.AddCharacteristic("2a37", Notify, 0)
+	bas := NewService("180f")
+	c := bas.AddCharacteristic("2a19", Read|Notify, Readable).OnRead(readValue)
+
+	if err := ble.AddService(hrs); err != nil {
+		t.Fatal(err)
+	}
+	if err := ble.AddService(bas); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := conn.Sent()
+	if len(sent) != 2 || sent[1]["kCBMsgId"] != 10 || sent[1]["kCBMsgArgs"].(xpc.Dict)["kCBMsgArgAttributeID"] != 3 {
+		t.Fatalf("unexpected messages %#v\n", sent)
+	}
+	conn.Reset()
+
+	if ble.attributes[3] != bas || c.attributeId != 4 {
+		t.Errorf("unexpected attributes %#v\n", ble.attributes)
+	}
+
+	if err := ble.AddService(bas); err != ALREADY_PUBLISHED {
+		t.Errorf("expected %v got %v\n", ALREADY_PUBLISHED, err)
+	}
+
+	if err := ble.AddService(NewService("180F")); err != ALREADY_PUBLISHED {
+		t.Errorf("expected %v got %v\n", ALREADY_PUBLISHED, err)
+	}
+
+	if len(conn.Sent()) != 0 {
+		t.Errorf("expected no messages got %#v\n", conn.Sent())
+	}
+
+	// removing the first service leaves the ids of the others unchanged
+	if err := ble.RemoveService(hrs); err != nil {
+		t.Fatal(err)
+	}
+
+	sent = conn.Sent()
+	if len(sent) != 1 || sent[0]["kCBMsgId"] != 11 || sent[0]["kCBMsgArgs"].(xpc.Dict)["kCBMsgArgAttributeID"] != 1 {
+		t.Fatalf("unexpected messages %#v\n", sent)
+	}
+	conn.Reset()
+
+	if len(ble.attributes) != 5 || ble.attributes[1] != nil || ble.attributes[3] != bas {
+		t.Errorf("unexpected attributes %#v\n", ble.attributes)
+	}
+
+	if err := ble.RemoveService(hrs); err != SERVICE_NOT_PUBLISHED {
+		t.Errorf("expected %v got %v\n", SERVICE_NOT_PUBLISHED, err)
+	}
+
+	// removing the last service frees its ids
+	if err := ble.RemoveService(bas); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ble.attributes) != 1 {
+		t.Errorf("unexpected attributes %#v\n", ble.attributes)
+	}
+
+	if err := c.Notify([]byte{1}); err != NOT_PUBLISHED {
+		t.Errorf("expected %v got %v\n", NOT_PUBLISHED, err)
+	}
+
+	if err := ble.AddService(hrs); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ids are reused
+	if sent := conn.Sent(); len(sent) != 2 || sent[1]["kCBMsgArgs"].(xpc.Dict)["kCBMsgArgAttributeID"] != 1 || ble.attributes[1] != hrs {
+		t.Errorf("expected service id 1 got %#v\n", sent)
+	}
+}
@@ -0,0 +1,131 @@
+package goble
+
+import (
+	"sync"
+
+	"github.com/raff/goble/xpc"
+)
+
+// Transport is the connection between BLE and blued
+type Transport interface {
+	// Send sends a message to blued
+	Send(msg xpc.Dict, verbose bool)
+
+	// SetEventHandler starts delivering blued events (and connection errors) to eh
+	SetEventHandler(eh xpc.XpcEventHandler)
+
+	// Release returns the OS release blued is running on (as in `uname -r`),
+	// used to select the message ids
+	Release() string
+
+	// Close closes the connection
+	Close() error
+}
+
+// FakeTransport is an in-memory Transport that records the messages sent to blued
+// and can inject scripted blued events. It can be used to test BLE applications
+// without a blued connection (or on a different OS).
+type FakeTransport struct {
+	release string
+
+	lock    sync.Mutex
+	sent    []xpc.Dict
+	handler xpc.XpcEventHandler
+	closed  bool
+}
+
+// NewFakeTransport creates a FakeTransport that emulates blued on the specified OS release
+func NewFakeTransport(release string) *FakeTransport {
+	return &FakeTransport{release: release}
+}
+
+func (t *FakeTransport) Send(msg xpc.Dict, verbose bool) {
+	t.lock.Lock()
+	t.sent = append(t.sent, msg)
+	t.lock.Unlock()
+}
+
+func (t *FakeTransport) SetEventHandler(eh xpc.XpcEventHandler) {
+	t.lock.Lock()
+	t.handler = eh
+	t.lock.Unlock()
+}
+
+func (t *FakeTransport) Release() string {
+	return t.release
+}
+
+func (t *FakeTransport) Close() error {
+	t.lock.Lock()
+	t.closed = true
+	t.lock.Unlock()
+	return nil
+}
+
+// Closed returns true if the transport has been closed
+func (t *FakeTransport) Closed() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closed
+}
+
+// Sent returns the messages sent so far
+func (t *FakeTransport) Sent() []xpc.Dict {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]xpc.Dict{}, t.sent...)
+}
+
+// Reset clears the list of sent messages
+func (t *FakeTransport) Reset() {
+	t.lock.Lock()
+	t.sent = nil
+	t.lock.Unlock()
+}
+
+// Inject delivers a blued event with the specified id and arguments to the event handler.
+//
+// As for real XPC events, integer values in args (at any level) are converted to int64.
+func (t *FakeTransport) Inject(id int, args xpc.Dict) {
+	t.deliver(xpc.Dict{"kCBMsgId": int64(id), "kCBMsgArgs": toXpcValue(args)}, nil)
+}
+
+// InjectError delivers a connection error (i.e. xpc.CONNECTION_INTERRUPTED) to the event handler
+func (t *FakeTransport) InjectError(err error) {
+	t.deliver(nil, err)
+}
+
+func (t *FakeTransport) deliver(event xpc.Dict, err error) {
+	t.lock.Lock()
+	eh := t.handler
+	closed := t.closed
+	t.lock.Unlock()
+
+	if eh != nil && !closed {
+		eh.HandleXpcEvent(event, err)
+	}
+}
+
+// toXpcValue converts a value to what would be received from XPC
+func toXpcValue(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case int:
+		return int64(tv)
+
+	case xpc.Dict:
+		d := xpc.Dict{}
+		for k, v := range tv {
+			d[k] = toXpcValue(v)
+		}
+		return d
+
+	case xpc.Array:
+		a := make(xpc.Array, len(tv))
+		for i, v := range tv {
+			a[i] = toXpcValue(v)
+		}
+		return a
+	}
+
+	return v
+}
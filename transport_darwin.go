@@ -0,0 +1,57 @@
+package goble
+
+import (
+	"log"
+	"sync"
+
+	"github.com/raff/goble/xpc"
+)
+
+// xpcTransport is the Transport that connects to blued via XPC
+type xpcTransport struct {
+	service string
+	utsname xpc.Utsname
+	conn    xpc.XPC
+
+	lock   sync.RWMutex
+	closed bool
+}
+
+func (t *xpcTransport) Send(msg xpc.Dict, verbose bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.closed {
+		return
+	}
+
+	if err := t.conn.Send(msg, verbose); err != nil {
+		log.Println("send:", err)
+	}
+}
+
+func (t *xpcTransport) SetEventHandler(eh xpc.XpcEventHandler) {
+	t.conn = xpc.XpcConnect(t.service, eh)
+}
+
+func (t *xpcTransport) Release() string {
+	return t.utsname.Release
+}
+
+func (t *xpcTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		t.conn.Close()
+	}
+	return nil
+}
+
+// New creates a BLE connected to the local blued
+func New() *BLE {
+	t := &xpcTransport{service: "com.apple.blued"}
+	xpc.Uname(&t.utsname)
+	return NewWithTransport(t)
+}
@@ -0,0 +1,76 @@
+package goble
+
+import (
+	"testing"
+
+	"github.com/raff/goble/xpc"
+)
+
+type recordHandler struct {
+	events []xpc.Dict
+	errors []error
+}
+
+func (h *recordHandler) HandleXpcEvent(event xpc.Dict, err error) {
+	h.events = append(h.events, event)
+	h.errors = append(h.errors, err)
+}
+
+func TestFakeTransportInject(t *testing.T) {
+	var h recordHandler
+
+	ft := NewFakeTransport("19.6.0")
+	ft.SetEventHandler(&h)
+
+	ft.Inject(54, xpc.Dict{
+		"kCBMsgArgServices": xpc.Array{
+			xpc.Dict{"kCBMsgArgServiceStartHandle": 1},
+		},
+	})
+
+	if len(h.events) != 1 {
+		t.Fatalf("expected 1 event got %#v\n", h.events)
+	}
+
+	ev := h.events[0]
+	if id := ev.MustGetInt("kCBMsgId"); id != 54 {
+		t.Errorf("expected id 54 got %v\n", id)
+	}
+
+	service := ev.MustGetDict("kCBMsgArgs").MustGetArray("kCBMsgArgServices")[0].(xpc.Dict)
+	if v, ok := service["kCBMsgArgServiceStartHandle"].(int64); !ok || v != 1 {
+		t.Errorf("expected int64 start handle got %#v\n", service["kCBMsgArgServiceStartHandle"])
+	}
+
+	ft.InjectError(xpc.CONNECTION_INTERRUPTED)
+	if len(h.errors) != 2 || h.errors[1] != xpc.CONNECTION_INTERRUPTED {
+		t.Errorf("expected connection interrupted got %#v\n", h.errors)
+	}
+
+	ft.Close()
+	ft.Inject(54, nil)
+
+	if len(h.events) != 2 {
+		t.Errorf("expected no events after Close got %#v\n", h.events)
+	}
+}
+
+func TestFakeTransportSent(t *testing.T) {
+	ft := NewFakeTransport("19.6.0")
+	ble := NewWithTransport(ft)
+
+	ble.StartScanning(nil, false)
+
+	sent := ft.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 message got %#v\n", sent)
+	}
+	if id := sent[0]["kCBMsgId"]; id != 53 {
+		t.Errorf("expected message id 53 got %v\n", id)
+	}
+
+	ft.Reset()
+	if sent := ft.Sent(); len(sent) != 0 {
+		t.Errorf("expected no messages got %#v\n", sent)
+	}
+}
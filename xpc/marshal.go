@@ -0,0 +1,488 @@
+package xpc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Marshal/Unmarshal convert between Dict and Go structs, using the field tags:
+//
+//   DeviceUUID UUID   `xpc:"kCBMsgArgDeviceUUID"`
+//   Result     int    `xpc:"kCBMsgArgResult,omitempty"`
+//   State      int    `xpc:"kCBMsgArgState,default=5"`
+//   Uuid       string `xpc:"kCBMsgArgUUID,hex"`
+//   Ignored    int    `xpc:"-"`
+//
+// Fields without a tag use the field name as key. Unexported fields are ignored.
+//
+// Options:
+//   omitempty  Marshal skips the field if it has the zero value, Unmarshal doesn't require it
+//   default=v  Unmarshal sets the field to v if the key is missing
+//   hex        the field is a string, with the hex representation of a data ([]byte) value
+//
+// Supported field types are bool, ints, uints, floats, string, []byte, Shmem, UUID, time.Time,
+// Dict, Array, interface{}, structs, pointers and slices of the supported types.
+//
+
+var (
+	typeOfDict  = reflect.TypeOf(Dict{})
+	typeOfArray = reflect.TypeOf(Array{})
+	typeOfUUID  = reflect.TypeOf(UUID{})
+	typeOfTime  = reflect.TypeOf(time.Time{})
+	typeOfNull  = reflect.TypeOf(Null)
+)
+
+type fieldInfo struct {
+	index     int
+	key       string
+	omitempty bool
+	hex       bool
+	def       *string
+}
+
+// fields returns the (tagged) fields of a struct type
+func fields(t reflect.Type) []fieldInfo {
+	var info []fieldInfo
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+
+		tag := f.Tag.Get("xpc")
+		if tag == "-" {
+			continue
+		}
+
+		fi := fieldInfo{index: i, key: f.Name}
+
+		parts := strings.Split(tag, ",")
+		if parts[0] != "" {
+			fi.key = parts[0]
+		}
+
+		for _, opt := range parts[1:] {
+			switch {
+			case opt == "omitempty":
+				fi.omitempty = true
+
+			case opt == "hex":
+				fi.hex = true
+
+			case strings.HasPrefix(opt, "default="):
+				def := strings.TrimPrefix(opt, "default=")
+				fi.def = &def
+			}
+		}
+
+		info = append(info, fi)
+	}
+
+	return info
+}
+
+// Unmarshal decodes the dictionary into the struct pointed by v.
+//
+// A missing key is an error, unless the field is tagged omitempty or has a default.
+// Conversion errors are returned as *ConversionError, with the path of the invalid value.
+func Unmarshal(d Dict, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("xpc: Unmarshal expects a pointer to a struct, got %T", v)
+	}
+
+	if err := decodeStruct(d, rv.Elem()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func decodeStruct(d Dict, dst reflect.Value) *ConversionError {
+	for _, f := range fields(dst.Type()) {
+		fv := dst.Field(f.index)
+
+		src, ok := d[f.key]
+		if !ok {
+			if f.def != nil {
+				if err := decodeDefault(*f.def, fv); err != nil {
+					return err.In(f.key)
+				}
+			} else if !f.omitempty {
+				return &ConversionError{Path: []string{f.key}, Type: fv.Type().String()}
+			}
+
+			continue
+		}
+
+		if err := decode(src, fv, f.hex); err != nil {
+			return err.In(f.key)
+		}
+	}
+
+	return nil
+}
+
+// decodeDefault sets the field to the default value (a string in the tag)
+func decodeDefault(def string, dst reflect.Value) *ConversionError {
+	var src interface{}
+	var err error
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		src, err = strconv.ParseBool(def)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		src, err = strconv.ParseInt(def, 0, 64)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		src, err = strconv.ParseUint(def, 0, 64)
+
+	case reflect.Float32, reflect.Float64:
+		src, err = strconv.ParseFloat(def, 64)
+
+	case reflect.String:
+		src = def
+
+	default:
+		return &ConversionError{Value: def, Type: dst.Type().String()}
+	}
+
+	if err != nil {
+		return &ConversionError{Value: def, Type: dst.Type().String()}
+	}
+
+	return decode(src, dst, false)
+}
+
+func decode(src interface{}, dst reflect.Value, isHex bool) *ConversionError {
+	convError := &ConversionError{Value: src, Type: dst.Type().String()}
+
+	if src == Null {
+		src = nil
+	}
+
+	switch dst.Type() {
+	case typeOfUUID:
+		uuid, err := ToUUID(src)
+		if err != nil {
+			return convError
+		}
+
+		dst.Set(reflect.ValueOf(uuid))
+		return nil
+
+	case typeOfTime:
+		t, ok := src.(time.Time)
+		if !ok {
+			return convError
+		}
+
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	if src == nil {
+		switch dst.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+
+		return convError
+	}
+
+	sv := reflect.ValueOf(src)
+
+	switch dst.Kind() {
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+
+		return decode(src, dst.Elem(), isHex)
+
+	case reflect.Interface:
+		if !sv.Type().AssignableTo(dst.Type()) {
+			return convError
+		}
+
+		dst.Set(sv)
+
+	case reflect.Bool:
+		switch sv.Kind() {
+		case reflect.Bool:
+			dst.SetBool(sv.Bool())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			dst.SetBool(sv.Int() != 0)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			dst.SetBool(sv.Uint() != 0)
+		default:
+			return convError
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+
+		switch sv.Kind() {
+		case reflect.Bool:
+			if sv.Bool() {
+				n = 1
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = sv.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = int64(sv.Uint())
+		default:
+			return convError
+		}
+
+		if dst.OverflowInt(n) {
+			return convError
+		}
+
+		dst.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+
+		switch sv.Kind() {
+		case reflect.Bool:
+			if sv.Bool() {
+				n = 1
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if sv.Int() < 0 {
+				return convError
+			}
+			n = uint64(sv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = sv.Uint()
+		default:
+			return convError
+		}
+
+		if dst.OverflowUint(n) {
+			return convError
+		}
+
+		dst.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		switch sv.Kind() {
+		case reflect.Float32, reflect.Float64:
+			dst.SetFloat(sv.Float())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			dst.SetFloat(float64(sv.Int()))
+		default:
+			return convError
+		}
+
+	case reflect.String:
+		if isHex {
+			b, ok := src.([]byte)
+			if !ok {
+				return convError
+			}
+
+			dst.SetString(hex.EncodeToString(b))
+		} else if sv.Kind() == reflect.String {
+			dst.SetString(sv.String())
+		} else {
+			return convError
+		}
+
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte or Shmem
+			if sv.Kind() != reflect.Slice || sv.Type().Elem().Kind() != reflect.Uint8 {
+				return convError
+			}
+
+			b := make([]byte, sv.Len())
+			reflect.Copy(reflect.ValueOf(b), sv)
+			dst.Set(reflect.ValueOf(b).Convert(dst.Type()))
+			return nil
+		}
+
+		a, ok := src.(Array)
+		if !ok {
+			return convError
+		}
+
+		sl := reflect.MakeSlice(dst.Type(), len(a), len(a))
+		for i, v := range a {
+			if err := decode(v, sl.Index(i), isHex); err != nil {
+				return err.In(strconv.Itoa(i))
+			}
+		}
+
+		dst.Set(sl)
+
+	case reflect.Map:
+		if dst.Type() != typeOfDict {
+			return convError
+		}
+
+		d, ok := src.(Dict)
+		if !ok {
+			return convError
+		}
+
+		dst.Set(reflect.ValueOf(d))
+
+	case reflect.Struct:
+		d, ok := src.(Dict)
+		if !ok {
+			return convError
+		}
+
+		return decodeStruct(d, dst)
+
+	default:
+		return &ConversionError{Value: src}
+	}
+
+	return nil
+}
+
+// Marshal encodes a struct (or a pointer to a struct) as a Dict, that can be sent via XPC.
+//
+// Signed (and small unsigned) integers are encoded as int64, uint64 as uint64,
+// floats as float64, structs as Dict and slices as Array.
+func Marshal(v interface{}) (Dict, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("xpc: Marshal expects a struct, got %T", v)
+	}
+
+	d, err := encodeStruct(rv)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func encodeStruct(sv reflect.Value) (Dict, *ConversionError) {
+	d := Dict{}
+
+	for _, f := range fields(sv.Type()) {
+		fv := sv.Field(f.index)
+
+		if f.omitempty && isEmptyValue(fv) {
+			continue
+		}
+
+		v, err := encode(fv, f.hex)
+		if err != nil {
+			return nil, err.In(f.key)
+		}
+
+		d[f.key] = v
+	}
+
+	return d, nil
+}
+
+func encode(sv reflect.Value, isHex bool) (interface{}, *ConversionError) {
+	switch sv.Type() {
+	case typeOfUUID, typeOfTime, typeOfNull, typeOfDict, typeOfArray:
+		return sv.Interface(), nil
+	}
+
+	switch sv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if sv.IsNil() {
+			return Null, nil
+		}
+
+		return encode(sv.Elem(), isHex)
+
+	case reflect.Bool:
+		return sv.Bool(), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return sv.Int(), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(sv.Uint()), nil
+
+	case reflect.Uint64:
+		return sv.Uint(), nil
+
+	case reflect.Float32, reflect.Float64:
+		return sv.Float(), nil
+
+	case reflect.String:
+		if isHex {
+			b, err := hex.DecodeString(sv.String())
+			if err != nil {
+				return nil, &ConversionError{Value: sv.String(), Type: "hex []byte"}
+			}
+
+			return b, nil
+		}
+
+		return sv.String(), nil
+
+	case reflect.Slice:
+		if sv.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte or Shmem (keep the type)
+			return sv.Interface(), nil
+		}
+
+		a := make(Array, sv.Len())
+		for i := range a {
+			v, err := encode(sv.Index(i), isHex)
+			if err != nil {
+				return nil, err.In(strconv.Itoa(i))
+			}
+
+			a[i] = v
+		}
+
+		return a, nil
+
+	case reflect.Struct:
+		return encodeStruct(sv)
+	}
+
+	return nil, &ConversionError{Value: sv.Interface()}
+}
+
+// isEmptyValue returns true for the zero value of v (for omitempty)
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array:
+		return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+	case reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		if v.Type() == typeOfTime {
+			return v.Interface().(time.Time).IsZero()
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,159 @@
+package xpc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testDescriptor struct {
+	Uuid   string `xpc:"kCBMsgArgUUID,hex"`
+	Handle int    `xpc:"kCBMsgArgDescriptorHandle"`
+}
+
+type testCharacteristic struct {
+	Uuid        string            `xpc:"kCBMsgArgUUID,hex"`
+	Handle      uint16            `xpc:"kCBMsgArgCharacteristicHandle"`
+	Properties  int               `xpc:"kCBMsgArgCharacteristicProperties,default=0x02"`
+	Descriptors []*testDescriptor `xpc:"kCBMsgArgDescriptors,omitempty"`
+}
+
+type testEvent struct {
+	DeviceUUID      UUID                 `xpc:"kCBMsgArgDeviceUUID"`
+	Result          int                  `xpc:"kCBMsgArgResult,omitempty"`
+	Notification    bool                 `xpc:"kCBMsgArgIsNotification,omitempty"`
+	Data            []byte               `xpc:"kCBMsgArgData,omitempty"`
+	Rssi            int8                 `xpc:"kCBMsgArgRssi,default=-127"`
+	Name            string               `xpc:"kCBMsgArgName,omitempty"`
+	Characteristics []testCharacteristic `xpc:"kCBMsgArgCharacteristics,omitempty"`
+	Options         Dict                 `xpc:"kCBMsgArgOptions,omitempty"`
+	Time            time.Time            `xpc:",omitempty"`
+	Ignored         int                  `xpc:"-"`
+	unexported      int
+}
+
+var testUUID = MustUUID("00112233-4455-6677-8899-aabbccddeeff")
+
+func TestUnmarshal(t *testing.T) {
+	d := Dict{
+		"kCBMsgArgDeviceUUID":     testUUID,
+		"kCBMsgArgIsNotification": int64(1),
+		"kCBMsgArgData":           []byte{1, 2, 3},
+		"kCBMsgArgCharacteristics": Array{
+			Dict{"kCBMsgArgUUID": []byte{0x2a, 0x37}, "kCBMsgArgCharacteristicHandle": int64(12),
+				"kCBMsgArgDescriptors": Array{Dict{"kCBMsgArgUUID": []byte{0x29, 0x02}, "kCBMsgArgDescriptorHandle": int64(14)}}},
+			Dict{"kCBMsgArgUUID": []byte{0x2a, 0x38}, "kCBMsgArgCharacteristicHandle": uint64(15), "kCBMsgArgCharacteristicProperties": true},
+		},
+		"kCBMsgArgOptions": Dict{"kCBConnectOptionNotifyOnDisconnection": int64(1)},
+		"Ignored":          int64(42),
+	}
+
+	var ev testEvent
+	if err := Unmarshal(d, &ev); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := testEvent{
+		DeviceUUID:   testUUID,
+		Notification: true,
+		Data:         []byte{1, 2, 3},
+		Rssi:         -127,
+		Characteristics: []testCharacteristic{
+			{Uuid: "2a37", Handle: 12, Properties: 2, Descriptors: []*testDescriptor{{Uuid: "2902", Handle: 14}}},
+			{Uuid: "2a38", Handle: 15, Properties: 1},
+		},
+		Options: Dict{"kCBConnectOptionNotifyOnDisconnection": int64(1)},
+	}
+
+	if !reflect.DeepEqual(ev, expected) {
+		t.Errorf("expected %#v got %#v\n", expected, ev)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		d    Dict
+		path string
+	}{
+		{Dict{}, "kCBMsgArgDeviceUUID"},
+		{Dict{"kCBMsgArgDeviceUUID": "not a uuid"}, "kCBMsgArgDeviceUUID"},
+		{Dict{"kCBMsgArgDeviceUUID": testUUID, "kCBMsgArgRssi": int64(300)}, "kCBMsgArgRssi"},
+		{Dict{"kCBMsgArgDeviceUUID": testUUID, "kCBMsgArgData": "text"}, "kCBMsgArgData"},
+		{Dict{"kCBMsgArgDeviceUUID": testUUID, "kCBMsgArgCharacteristics": Array{
+			Dict{"kCBMsgArgUUID": []byte{0x2a, 0x37}, "kCBMsgArgCharacteristicHandle": int64(12)},
+			Dict{"kCBMsgArgUUID": "2a38", "kCBMsgArgCharacteristicHandle": int64(15)},
+		}}, "kCBMsgArgCharacteristics.1.kCBMsgArgUUID"},
+		{Dict{"kCBMsgArgDeviceUUID": testUUID, "kCBMsgArgCharacteristics": Array{
+			Dict{"kCBMsgArgUUID": []byte{0x2a, 0x37}},
+		}}, "kCBMsgArgCharacteristics.0.kCBMsgArgCharacteristicHandle"},
+	}
+
+	for _, test := range tests {
+		var ev testEvent
+
+		err := Unmarshal(test.d, &ev)
+		if cerr, ok := err.(*ConversionError); !ok {
+			t.Errorf("expected ConversionError got %#v\n", err)
+		} else if path := strings.Join(cerr.Path, "."); path != test.path {
+			t.Errorf("expected %#v got %#v (%v)\n", test.path, path, err)
+		}
+	}
+
+	var ev testEvent
+	if err := Unmarshal(Dict{}, ev); err == nil {
+		t.Error("expected error for non-pointer")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	ev := &testEvent{
+		DeviceUUID: testUUID,
+		Data:       []byte{1},
+		Rssi:       -60,
+		Characteristics: []testCharacteristic{
+			{Uuid: "2a37", Handle: 12, Properties: 0x10, Descriptors: []*testDescriptor{{Uuid: "2902", Handle: 14}}},
+		},
+		Ignored: 42,
+	}
+
+	d, err := Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Dict{
+		"kCBMsgArgDeviceUUID": testUUID,
+		"kCBMsgArgData":       []byte{1},
+		"kCBMsgArgRssi":       int64(-60),
+		"kCBMsgArgCharacteristics": Array{
+			Dict{"kCBMsgArgUUID": []byte{0x2a, 0x37}, "kCBMsgArgCharacteristicHandle": int64(12), "kCBMsgArgCharacteristicProperties": int64(0x10),
+				"kCBMsgArgDescriptors": Array{Dict{"kCBMsgArgUUID": []byte{0x29, 0x02}, "kCBMsgArgDescriptorHandle": int64(14)}}},
+		},
+	}
+
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("expected %#v got %#v\n", expected, d)
+	}
+
+	// round trip
+	var ev2 testEvent
+	if err := Unmarshal(d, &ev2); err != nil {
+		t.Fatal(err)
+	}
+
+	ev.Ignored = 0
+	if !reflect.DeepEqual(*ev, ev2) {
+		t.Errorf("expected %#v got %#v\n", *ev, ev2)
+	}
+
+	if _, err := Marshal(testCharacteristic{Uuid: "not hex"}); err == nil {
+		t.Error("expected hex error")
+	} else if path := strings.Join(err.(*ConversionError).Path, "."); path != "kCBMsgArgUUID" {
+		t.Errorf("expected %#v got %#v\n", "kCBMsgArgUUID", path)
+	}
+
+	if _, err := Marshal(42); err == nil {
+		t.Error("expected error for non-struct")
+	}
+}
@@ -0,0 +1,376 @@
+package xpc
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//
+// minimal XPC support required for BLE
+//
+
+// a dictionary of things
+type Dict map[string]interface{}
+
+// NullType is the type of Null
+type NullType struct{}
+
+// Null is the Go value of the XPC null object
+var Null = NullType{}
+
+// Shmem is the Go value of an XPC shared memory object (the data is copied when converting from/to XPC)
+type Shmem []byte
+
+func (d Dict) Contains(k string) bool {
+	_, ok := d[k]
+	return ok
+}
+
+// ConversionError is returned when a value has an unexpected (or unsupported) type.
+// Path is the list of keys (or array indices) to the value.
+type ConversionError struct {
+	Path  []string
+	Value interface{}
+	Type  string // the expected type
+}
+
+func (e *ConversionError) Error() string {
+	path := strings.Join(e.Path, ".")
+	if path == "" {
+		path = "value"
+	}
+
+	if e.Type == "" {
+		return fmt.Sprintf("xpc: %v: unsupported type %T", path, e.Value)
+	}
+
+	if e.Value == nil {
+		return fmt.Sprintf("xpc: %v: missing %v", path, e.Type)
+	}
+
+	return fmt.Sprintf("xpc: %v: cannot convert %T to %v", path, e.Value, e.Type)
+}
+
+// In returns the error with the specified key prepended to the path
+func (e *ConversionError) In(key string) *ConversionError {
+	return &ConversionError{Path: append([]string{key}, e.Path...), Value: e.Value, Type: e.Type}
+}
+
+// convError returns the ConversionError for d[k]
+func (d Dict) convError(k string, v interface{}, t string) error {
+	return &ConversionError{Path: []string{k}, Value: v, Type: t}
+}
+
+// Dict returns the dictionary value for the key
+func (d Dict) Dict(k string) (Dict, error) {
+	if v, ok := d[k].(Dict); ok {
+		return v, nil
+	}
+
+	return nil, d.convError(k, d[k], "Dict")
+}
+
+// Array returns the array value for the key
+func (d Dict) Array(k string) (Array, error) {
+	if v, ok := d[k].(Array); ok {
+		return v, nil
+	}
+
+	return nil, d.convError(k, d[k], "Array")
+}
+
+// Bytes returns the data value for the key
+func (d Dict) Bytes(k string) ([]byte, error) {
+	if v, ok := d[k].([]byte); ok {
+		return v, nil
+	}
+
+	return nil, d.convError(k, d[k], "[]byte")
+}
+
+// Int returns the int value for the key (uint64 and bool values are also converted)
+func (d Dict) Int(k string) (int, error) {
+	switch v := d[k].(type) {
+	case int64:
+		return int(v), nil
+
+	case uint64:
+		return int(v), nil
+
+	case bool:
+		if v {
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+
+	return 0, d.convError(k, d[k], "int")
+}
+
+// Bool returns the bool value for the key (int values are also converted)
+func (d Dict) Bool(k string) (bool, error) {
+	switch v := d[k].(type) {
+	case bool:
+		return v, nil
+
+	case int64:
+		return v != 0, nil
+
+	case uint64:
+		return v != 0, nil
+	}
+
+	return false, d.convError(k, d[k], "bool")
+}
+
+// UUID returns the UUID value for the key (see ToUUID)
+func (d Dict) UUID(k string) (UUID, error) {
+	uuid, err := ToUUID(d[k])
+	if err != nil {
+		return uuid, err.(*ConversionError).In(k)
+	}
+
+	return uuid, nil
+}
+
+// The MustGetXxx methods panic with a *ConversionError if the value has the wrong type
+
+func (d Dict) MustGetDict(k string) Dict {
+	if _, ok := d[k]; !ok {
+		return nil
+	}
+
+	v, err := d.Dict(k)
+	if err != nil {
+		panic(err)
+	}
+
+	return v
+}
+
+func (d Dict) MustGetArray(k string) Array {
+	if _, ok := d[k]; !ok {
+		return nil
+	}
+
+	v, err := d.Array(k)
+	if err != nil {
+		panic(err)
+	}
+
+	return v
+}
+
+func (d Dict) MustGetBytes(k string) []byte {
+	v, err := d.Bytes(k)
+	if err != nil {
+		panic(err)
+	}
+
+	return v
+}
+
+func (d Dict) MustGetHexBytes(k string) string {
+	return fmt.Sprintf("%x", d.MustGetBytes(k))
+}
+
+func (d Dict) MustGetInt(k string) int {
+	v, err := d.Int(k)
+	if err != nil {
+		panic(err)
+	}
+
+	return v
+}
+
+func (d Dict) MustGetUUID(k string) UUID {
+	if v, ok := d[k].(UUID); ok {
+		return v
+	}
+
+	panic(d.convError(k, d[k], "UUID"))
+}
+
+// The GetXxx methods return the default value if the key is missing,
+// and panic with a *ConversionError if the value has the wrong type
+
+func (d Dict) GetString(k, defv string) string {
+	if v := d[k]; v != nil {
+		//log.Printf("GetString %s %#v\n", k, v)
+		if s, ok := v.(string); ok {
+			return s
+		}
+
+		panic(d.convError(k, v, "string"))
+	} else {
+		//log.Printf("GetString %s default %#v\n", k, defv)
+		return defv
+	}
+}
+
+func (d Dict) GetBytes(k string, defv []byte) []byte {
+	if v := d[k]; v != nil {
+		//log.Printf("GetBytes %s %#v\n", k, v)
+		return d.MustGetBytes(k)
+	} else {
+		//log.Printf("GetBytes %s default %#v\n", k, defv)
+		return defv
+	}
+}
+
+func (d Dict) GetInt(k string, defv int) int {
+	if v := d[k]; v != nil {
+		//log.Printf("GetString %s %#v\n", k, v)
+		return d.MustGetInt(k)
+	} else {
+		//log.Printf("GetString %s default %#v\n", k, defv)
+		return defv
+	}
+}
+
+func (d Dict) GetUUID(k string) UUID {
+	uuid, err := d.UUID(k)
+	if err != nil {
+		panic(err)
+	}
+
+	return uuid
+}
+
+// an Array of things
+type Array []interface{}
+
+func (a Array) GetUUID(k int) UUID {
+	uuid, err := ToUUID(a[k])
+	if err != nil {
+		panic(err.(*ConversionError).In(fmt.Sprint(k)))
+	}
+
+	return uuid
+}
+
+// a UUID
+type UUID [16]byte
+
+func MakeUUID(s string) UUID {
+	var sl []byte
+
+	s = strings.Replace(s, "-", "", -1)
+	fmt.Sscanf(s, "%32x", &sl)
+
+	var uuid [16]byte
+	copy(uuid[:], sl)
+	return UUID(uuid)
+}
+
+// ParseUUID parses a 128 bit UUID, in the "00112233-4455-6677-8899-aabbccddeeff" format (dashes are optional)
+func ParseUUID(s string) (UUID, error) {
+	s = strings.Replace(s, "-", "", -1)
+	if len(s) != 32 {
+		return UUID{}, fmt.Errorf("invalid UUID %q", s)
+	}
+
+	sl, err := hex.DecodeString(s)
+	if err != nil {
+		return UUID{}, fmt.Errorf("invalid UUID %q: %v", s, err)
+	}
+
+	var uuid [16]byte
+	copy(uuid[:], sl)
+	return UUID(uuid), nil
+}
+
+// MustUUID is like ParseUUID but panics if the UUID is invalid
+func MustUUID(s string) UUID {
+	uuid, err := ParseUUID(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return uuid
+}
+
+func (uuid UUID) String() string {
+	return fmt.Sprintf("%x", [16]byte(uuid))
+}
+
+// ToUUID converts a UUID or a slice of (up to 16) bytes to a UUID. A nil value returns the zero UUID.
+func ToUUID(v interface{}) (UUID, error) {
+	if v == nil {
+		return UUID{}, nil
+	}
+
+	if uuid, ok := v.(UUID); ok {
+		return uuid, nil
+	}
+
+	if bytes, ok := v.([]byte); ok && len(bytes) <= 16 {
+		uuid := UUID{}
+		copy(uuid[:], bytes)
+		return uuid, nil
+	}
+
+	return UUID{}, &ConversionError{Value: v, Type: "UUID"}
+}
+
+// GetUUID is like ToUUID but panics with a *ConversionError if the value cannot be converted
+func GetUUID(v interface{}) UUID {
+	uuid, err := ToUUID(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return uuid
+}
+
+var (
+	CONNECTION_INVALID     = errors.New("connection invalid")
+	CONNECTION_INTERRUPTED = errors.New("connection interrupted")
+	CONNECTION_TERMINATED  = errors.New("connection terminated")
+)
+
+type XpcEventHandler interface {
+	HandleXpcEvent(event Dict, err error)
+}
+
+// the OS version (see Uname)
+type Utsname struct {
+	Sysname  string
+	Nodename string
+	Release  string
+	Version  string
+	Machine  string
+}
+
+// CompareReleases compares two OS releases (i.e. "19.6.0" and "19.4") numerically,
+// returning -1, 0 or 1 if a is older, the same or newer than b.
+// Missing (or invalid) components are considered 0.
+func CompareReleases(a, b string) int {
+	pa := strings.Split(a, ".")
+	pb := strings.Split(b, ".")
+
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+
+		if i < len(pa) {
+			na, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			nb, _ = strconv.Atoi(pb[i])
+		}
+
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	return 0
+}
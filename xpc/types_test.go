@@ -0,0 +1,111 @@
+package xpc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUUID(t *testing.T) {
+	tests := []struct {
+		s     string
+		valid bool
+	}{
+		{"00112233-4455-6677-8899-aabbccddeeff", true},
+		{"00112233445566778899AABBCCDDEEFF", true},
+		{"00112233445566778899aabbccddee", false},
+		{"00112233445566778899aabbccddeeXX", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		uuid, err := ParseUUID(test.s)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", test.s, err)
+			} else if uuid.String() != "00112233445566778899aabbccddeeff" {
+				t.Errorf("expected %#v got %#v\n", "00112233445566778899aabbccddeeff", uuid.String())
+			}
+		} else if err == nil {
+			t.Errorf("%v: expected error", test.s)
+		}
+	}
+}
+
+func TestDictConversions(t *testing.T) {
+	d := Dict{
+		"int":   int64(42),
+		"bytes": []byte{1, 2},
+		"uuid":  []byte{0x18, 0x0d},
+		"text":  "hello",
+		"dict":  Dict{"n": "not a number"},
+	}
+
+	if v, err := d.Int("int"); err != nil || v != 42 {
+		t.Errorf("expected 42 got %v %v", v, err)
+	}
+	if v, err := d.Bytes("bytes"); err != nil || len(v) != 2 {
+		t.Errorf("expected bytes got %v %v", v, err)
+	}
+	if v, err := d.UUID("uuid"); err != nil || v != (UUID{0x18, 0x0d}) {
+		t.Errorf("expected uuid got %v %v", v, err)
+	}
+
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{second(d.Int("text")), "xpc: text: cannot convert string to int"},
+		{second(d.Int("missing")), "xpc: missing: missing int"},
+		{second(d.Bytes("int")), "xpc: int: cannot convert int64 to []byte"},
+		{second(d.UUID("text")), "xpc: text: cannot convert string to UUID"},
+		{second(d.Array("dict")), "xpc: dict: cannot convert xpc.Dict to Array"},
+	}
+
+	for _, test := range tests {
+		if _, ok := test.err.(*ConversionError); !ok {
+			t.Errorf("expected ConversionError got %#v\n", test.err)
+		} else if test.err.Error() != test.expected {
+			t.Errorf("expected %#v got %#v\n", test.expected, test.err.Error())
+		}
+	}
+
+	inner := d.MustGetDict("dict")
+	_, err := inner.Int("n")
+	if path := strings.Join(err.(*ConversionError).In("dict").Path, "."); path != "dict.n" {
+		t.Errorf("expected %#v got %#v\n", "dict.n", path)
+	}
+}
+
+func TestMustGetPanics(t *testing.T) {
+	defer func() {
+		if _, ok := recover().(*ConversionError); !ok {
+			t.Error("expected ConversionError panic")
+		}
+	}()
+
+	Dict{"n": "text"}.MustGetInt("n")
+}
+
+func second(_ interface{}, err error) error {
+	return err
+}
+
+func TestDictFlags(t *testing.T) {
+	d := Dict{"true": true, "false": false, "one": int64(1), "big": uint64(7)}
+
+	if v := d.GetInt("true", 0); v != 1 {
+		t.Errorf("expected 1 got %#v\n", v)
+	}
+	if v := d.GetInt("false", 1); v != 0 {
+		t.Errorf("expected 0 got %#v\n", v)
+	}
+	if v := d.MustGetInt("big"); v != 7 {
+		t.Errorf("expected 7 got %#v\n", v)
+	}
+	if v, err := d.Bool("one"); err != nil || !v {
+		t.Errorf("expected true got %#v %v\n", v, err)
+	}
+	if _, err := (Dict{"s": "x"}).Bool("s"); err == nil {
+		t.Error("expected error")
+	}
+}
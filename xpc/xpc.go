@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 package xpc
 
 /*
@@ -8,196 +11,60 @@ import "C"
 import (
 	"errors"
 	"fmt"
-	"log"
 	r "reflect"
-	"strings"
+	"sync"
+	"time"
 	"unsafe"
 )
 
 type XPC struct {
 	conn C.xpc_connection_t
+	ctx  uintptr
 }
 
-func (x *XPC) Send(msg interface{}, verbose bool) {
-	C.XpcSendMessage(x.conn, goToXpc(msg), C.bool(true), C.bool(verbose))
-}
-
-//
-// minimal XPC support required for BLE
-//
-
-// a dictionary of things
-type Dict map[string]interface{}
-
-func (d Dict) Contains(k string) bool {
-	_, ok := d[k]
-	return ok
-}
-
-func (d Dict) MustGetDict(k string) Dict {
-	if v, ok := d[k]; ok {
-		return v.(Dict)
-	}
-
-	return nil
-}
-
-func (d Dict) MustGetArray(k string) Array {
-	if v, ok := d[k]; ok {
-		return v.(Array)
+// Send converts the message to an xpc object and sends it.
+// It returns a *ConversionError if the message contains unsupported types.
+func (x *XPC) Send(msg interface{}, verbose bool) error {
+	xv, err := goToXpc(msg)
+	if err != nil {
+		return err
 	}
 
+	C.XpcSendMessage(x.conn, xv, C.bool(true), C.bool(verbose))
 	return nil
 }
 
-func (d Dict) MustGetBytes(k string) []byte {
-	return d[k].([]byte)
-}
-
-func (d Dict) MustGetHexBytes(k string) string {
-	return fmt.Sprintf("%x", d[k].([]byte))
-}
-
-func (d Dict) MustGetInt(k string) int {
-	return int(d[k].(int64))
-}
-
-func (d Dict) MustGetUUID(k string) UUID {
-	return d[k].(UUID)
-}
-
-func (d Dict) GetString(k, defv string) string {
-	if v := d[k]; v != nil {
-		//log.Printf("GetString %s %#v\n", k, v)
-		return v.(string)
-	} else {
-		//log.Printf("GetString %s default %#v\n", k, defv)
-		return defv
-	}
-}
-
-func (d Dict) GetBytes(k string, defv []byte) []byte {
-	if v := d[k]; v != nil {
-		//log.Printf("GetBytes %s %#v\n", k, v)
-		return v.([]byte)
-	} else {
-		//log.Printf("GetBytes %s default %#v\n", k, defv)
-		return defv
-	}
-}
-
-func (d Dict) GetInt(k string, defv int) int {
-	if v := d[k]; v != nil {
-		//log.Printf("GetString %s %#v\n", k, v)
-		return int(v.(int64))
-	} else {
-		//log.Printf("GetString %s default %#v\n", k, defv)
-		return defv
-	}
-}
-
-func (d Dict) GetUUID(k string) UUID {
-	return GetUUID(d[k])
-}
-
-// an Array of things
-type Array []interface{}
-
-func (a Array) GetUUID(k int) UUID {
-	return GetUUID(a[k])
-}
-
-// a UUID
-type UUID [16]byte
-
-func MakeUUID(s string) UUID {
-	var sl []byte
-
-	s = strings.Replace(s, "-", "", -1)
-	fmt.Sscanf(s, "%32x", &sl)
-
-	var uuid [16]byte
-	copy(uuid[:], sl)
-	return UUID(uuid)
-}
-
-func MustUUID(s string) UUID {
-	var sl []byte
-
-	s = strings.Replace(s, "-", "", -1)
-	if len(s) != 32 {
-		log.Fatal("invalid UUID")
-	}
-	if n, err := fmt.Sscanf(s, "%32x", &sl); err != nil || n != 1 {
-		log.Fatal("invalid UUID ", s, " len ", n, " error ", err)
-	}
-
-	var uuid [16]byte
-	copy(uuid[:], sl)
-	return UUID(uuid)
-}
-
-func (uuid UUID) String() string {
-	return fmt.Sprintf("%x", [16]byte(uuid))
-}
-
-func GetUUID(v interface{}) UUID {
-	if v == nil {
-		return UUID{}
-	}
-
-	if uuid, ok := v.(UUID); ok {
-		return uuid
-	}
-
-	if bytes, ok := v.([]byte); ok {
-		uuid := UUID{}
+// Close cancels the connection. The event handler is not called anymore.
+func (x *XPC) Close() {
+	handlersLock.Lock()
+	delete(handlers, x.ctx)
+	handlersLock.Unlock()
 
-		for i, b := range bytes {
-			uuid[i] = b
-		}
-
-		return uuid
-	}
-
-	if bytes, ok := v.([]uint8); ok {
-		uuid := UUID{}
-
-		for i, b := range bytes {
-			uuid[i] = b
-		}
-
-		return uuid
-	}
-
-	log.Fatalf("invalid type for UUID: %#v", v)
-	return UUID{}
+	C.XpcClose(x.conn)
 }
 
 var (
-	CONNECTION_INVALID     = errors.New("connection invalid")
-	CONNECTION_INTERRUPTED = errors.New("connection interrupted")
-	CONNECTION_TERMINATED  = errors.New("connection terminated")
-
 	TYPE_OF_UUID  = r.TypeOf(UUID{})
 	TYPE_OF_BYTES = r.TypeOf([]byte{})
+	TYPE_OF_SHMEM = r.TypeOf(Shmem{})
+	TYPE_OF_NULL  = r.TypeOf(Null)
+	TYPE_OF_TIME  = r.TypeOf(time.Time{})
 
-	handlers = map[uintptr]XpcEventHandler{}
+	handlers     = map[uintptr]XpcEventHandler{}
+	handlersLock sync.Mutex
 )
 
-type XpcEventHandler interface {
-	HandleXpcEvent(event Dict, err error)
-}
-
 func XpcConnect(service string, eh XpcEventHandler) XPC {
 	// func XpcConnect(service string, eh XpcEventHandler) C.xpc_connection_t {
 	ctx := uintptr(unsafe.Pointer(&eh))
+	handlersLock.Lock()
 	handlers[ctx] = eh
+	handlersLock.Unlock()
 
 	cservice := C.CString(service)
 	defer C.free(unsafe.Pointer(cservice))
 	// return C.XpcConnect(cservice, C.uintptr_t(ctx))
-	return XPC{conn: C.XpcConnect(cservice, C.uintptr_t(ctx))}
+	return XPC{conn: C.XpcConnect(cservice, C.uintptr_t(ctx)), ctx: ctx}
 }
 
 //export handleXpcEvent
@@ -206,7 +73,9 @@ func handleXpcEvent(event C.xpc_object_t, p C.ulong) {
 
 	t := C.xpc_get_type(event)
 
+	handlersLock.Lock()
 	eh := handlers[uintptr(p)]
+	handlersLock.Unlock()
 	if eh == nil {
 		//log.Println("no handler for", p)
 		return
@@ -232,40 +101,68 @@ func handleXpcEvent(event C.xpc_object_t, p C.ulong) {
 			//log.Println("got some error", event)
 			eh.HandleXpcEvent(nil, fmt.Errorf("%v", event))
 		}
+	} else if v, err := xpcToGo(event); err != nil {
+		eh.HandleXpcEvent(nil, err)
+	} else if d, ok := v.(Dict); ok {
+		eh.HandleXpcEvent(d, nil)
 	} else {
-		eh.HandleXpcEvent(xpcToGo(event).(Dict), nil)
+		eh.HandleXpcEvent(nil, &ConversionError{Value: v, Type: "Dict"})
 	}
 }
 
 // goToXpc converts a go object to an xpc object
-func goToXpc(o interface{}) C.xpc_object_t {
+func goToXpc(o interface{}) (C.xpc_object_t, error) {
 	return valueToXpc(r.ValueOf(o))
 }
 
 // valueToXpc converts a go Value to an xpc object
 //
 // note that not all the types are supported, but only the subset required for Blued
-func valueToXpc(val r.Value) C.xpc_object_t {
+// (a *ConversionError is returned for the others)
+func valueToXpc(val r.Value) (C.xpc_object_t, error) {
 	if !val.IsValid() {
-		return nil
+		return nil, nil
 	}
 
 	var xv C.xpc_object_t
 
+	switch val.Type() {
+	case TYPE_OF_NULL:
+		return C.xpc_null_create(), nil
+
+	case TYPE_OF_TIME:
+		t := val.Interface().(time.Time)
+		return C.xpc_date_create(C.int64_t(t.UnixNano())), nil
+	}
+
 	switch val.Kind() {
+	case r.Bool:
+		xv = C.xpc_bool_create(C.bool(val.Bool()))
+
 	case r.Int, r.Int8, r.Int16, r.Int32, r.Int64:
 		xv = C.xpc_int64_create(C.int64_t(val.Int()))
 
 	case r.Uint, r.Uint8, r.Uint16, r.Uint32:
 		xv = C.xpc_int64_create(C.int64_t(val.Uint()))
 
+	case r.Uint64:
+		xv = C.xpc_uint64_create(C.uint64_t(val.Uint()))
+
+	case r.Float32, r.Float64:
+		xv = C.xpc_double_create(C.double(val.Float()))
+
 	case r.String:
 		xv = C.xpc_string_create(C.CString(val.String()))
 
 	case r.Map:
 		xv = C.xpc_dictionary_create(nil, nil, 0)
 		for _, k := range val.MapKeys() {
-			v := valueToXpc(val.MapIndex(k))
+			v, err := valueToXpc(val.MapIndex(k))
+			if err != nil {
+				C.xpc_release(xv)
+				return nil, err.(*ConversionError).In(k.String())
+			}
+
 			C.xpc_dictionary_set_value(xv, C.CString(k.String()), v)
 			if v != nil {
 				C.xpc_release(v)
@@ -278,82 +175,157 @@ func valueToXpc(val r.Value) C.xpc_object_t {
 			var uuid [16]byte
 			r.Copy(r.ValueOf(uuid[:]), val)
 			xv = C.xpc_uuid_create(C.ptr_to_uuid(unsafe.Pointer(&uuid[0])))
-		} else if val.Type() == TYPE_OF_BYTES {
-			// slice of bytes
-			xv = C.xpc_data_create(unsafe.Pointer(val.Pointer()), C.size_t(val.Len()))
+		} else if val.Type().Elem().Kind() == r.Uint8 {
+			// slice (or array) of bytes
+			b := make([]byte, val.Len())
+			r.Copy(r.ValueOf(b), val)
+
+			if val.Type() != TYPE_OF_SHMEM {
+				var p unsafe.Pointer
+				if len(b) > 0 {
+					p = unsafe.Pointer(&b[0])
+				}
+
+				xv = C.xpc_data_create(p, C.size_t(len(b)))
+			} else if len(b) == 0 {
+				return nil, &ConversionError{Value: val.Interface(), Type: "non empty Shmem"}
+			} else if xv = C.XpcShmemCreate(unsafe.Pointer(&b[0]), C.size_t(len(b))); xv == nil {
+				return nil, &ConversionError{Value: val.Interface(), Type: "mapped Shmem"}
+			}
 		} else {
 			xv = C.xpc_array_create(nil, 0)
 			l := val.Len()
 
 			for i := 0; i < l; i++ {
-				v := valueToXpc(val.Index(i))
-				C.xpc_array_append_value(xv, v)
-				if v != nil {
-					C.xpc_release(v)
+				v, err := valueToXpc(val.Index(i))
+				if err != nil {
+					C.xpc_release(xv)
+					return nil, err.(*ConversionError).In(fmt.Sprint(i))
 				}
+
+				if v == nil {
+					// arrays cannot contain NULL
+					v = C.xpc_null_create()
+				}
+
+				C.xpc_array_append_value(xv, v)
+				C.xpc_release(v)
 			}
 		}
 
 	case r.Interface, r.Ptr:
-		xv = valueToXpc(val.Elem())
+		return valueToXpc(val.Elem())
 
 	default:
-		log.Fatalf("unsupported %#v", val.String())
+		return nil, &ConversionError{Value: val.Interface()}
 	}
 
-	return xv
+	return xv, nil
+}
+
+// arrayBuilder and dictBuilder collect the converted values (and the first error) in XpcArrayApply/XpcDictApply
+type arrayBuilder struct {
+	a   Array
+	err error
+}
+
+type dictBuilder struct {
+	d   Dict
+	err error
 }
 
 //export arraySet
 func arraySet(u C.uintptr_t, i C.int, v C.xpc_object_t) {
-	a := *(*Array)(unsafe.Pointer(uintptr(u)))
-	a[i] = xpcToGo(v)
+	b := (*arrayBuilder)(unsafe.Pointer(uintptr(u)))
+	if b.err != nil {
+		return
+	}
+
+	if gv, err := xpcToGo(v); err != nil {
+		b.err = err.(*ConversionError).In(fmt.Sprint(int(i)))
+	} else {
+		b.a[i] = gv
+	}
 }
 
 //export dictSet
 func dictSet(u C.uintptr_t, k *C.char, v C.xpc_object_t) {
-	d := *(*Dict)(unsafe.Pointer(uintptr(u)))
-	d[C.GoString(k)] = xpcToGo(v)
+	b := (*dictBuilder)(unsafe.Pointer(uintptr(u)))
+	if b.err != nil {
+		return
+	}
+
+	key := C.GoString(k)
+
+	if gv, err := xpcToGo(v); err != nil {
+		b.err = err.(*ConversionError).In(key)
+	} else {
+		b.d[key] = gv
+	}
 }
 
 // xpcToGo converts an xpc object to a go object
 //
 // note that not all the types are supported, but only the subset required for Blued
-func xpcToGo(v C.xpc_object_t) interface{} {
+// (a *ConversionError is returned for the others)
+func xpcToGo(v C.xpc_object_t) (interface{}, error) {
 	t := C.xpc_get_type(v)
 
 	switch t {
 	case C.TYPE_ARRAY:
-		a := make(Array, C.int(C.xpc_array_get_count(v)))
-		p := uintptr(unsafe.Pointer(&a))
+		b := arrayBuilder{a: make(Array, C.int(C.xpc_array_get_count(v)))}
+		p := uintptr(unsafe.Pointer(&b))
 		C.XpcArrayApply(C.uintptr_t(p), v)
-		return a
+		return b.a, b.err
 
 	case C.TYPE_DATA:
-		return C.GoBytes(C.xpc_data_get_bytes_ptr(v), C.int(C.xpc_data_get_length(v)))
+		return C.GoBytes(C.xpc_data_get_bytes_ptr(v), C.int(C.xpc_data_get_length(v))), nil
 
 	case C.TYPE_DICT:
-		d := make(Dict)
-		p := uintptr(unsafe.Pointer(&d))
+		b := dictBuilder{d: make(Dict)}
+		p := uintptr(unsafe.Pointer(&b))
 		C.XpcDictApply(C.uintptr_t(p), v)
-		return d
+		return b.d, b.err
 
 	case C.TYPE_INT64:
-		return int64(C.xpc_int64_get_value(v))
+		return int64(C.xpc_int64_get_value(v)), nil
 
 	case C.TYPE_STRING:
-		return C.GoString(C.xpc_string_get_string_ptr(v))
+		return C.GoString(C.xpc_string_get_string_ptr(v)), nil
 
 	case C.TYPE_UUID:
 		a := [16]byte{}
 		C.XpcUUIDGetBytes(unsafe.Pointer(&a), v)
-		return UUID(a)
+		return UUID(a), nil
+
+	case C.TYPE_BOOL:
+		return bool(C.xpc_bool_get_value(v)), nil
+
+	case C.TYPE_UINT64:
+		return uint64(C.xpc_uint64_get_value(v)), nil
+
+	case C.TYPE_DOUBLE:
+		return float64(C.xpc_double_get_value(v)), nil
+
+	case C.TYPE_DATE:
+		return time.Unix(0, int64(C.xpc_date_get_value(v))), nil
+
+	case C.TYPE_NULL:
+		return Null, nil
+
+	case C.TYPE_SHMEM:
+		var size C.size_t
+		data := C.XpcShmemCopy(v, &size)
+		if data == nil {
+			return nil, &ConversionError{Value: v, Type: "mapped Shmem"}
+		}
+
+		defer C.free(data)
+		return Shmem(C.GoBytes(data, C.int(size))), nil
 
 	default:
-		log.Fatalf("unexpected type %#v, value %#v", t, v)
+		return nil, &ConversionError{Value: v}
 	}
-
-	return nil
 }
 
 // xpc_release is needed by tests, since they can't use CGO
@@ -363,14 +335,6 @@ func xpc_release(xv C.xpc_object_t) {
 
 // this is used to check the OS version
 
-type Utsname struct {
-	Sysname  string
-	Nodename string
-	Release  string
-	Version  string
-	Machine  string
-}
-
 func Uname(utsname *Utsname) error {
 	var cstruct C.struct_utsname
 	if err := C.uname(&cstruct); err != 0 {
@@ -1,7 +1,13 @@
+//go:build darwin
+// +build darwin
+
 package xpc
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func CheckUUID(t *testing.T, v interface{}) UUID {
@@ -16,8 +22,15 @@ func CheckUUID(t *testing.T, v interface{}) UUID {
 func TestConvertUUID(t *testing.T) {
 	uuid := MakeUUID("00112233445566778899aabbccddeeff")
 
-	xv := goToXpc(uuid)
-	v := xpcToGo(xv)
+	xv, err := goToXpc(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := xpcToGo(xv)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	xpc_release(xv)
 
@@ -31,8 +44,15 @@ func TestConvertUUID(t *testing.T) {
 func TestConvertSlice(t *testing.T) {
 	arr := []string{"one", "two", "three"}
 
-	xv := goToXpc(arr)
-	v := xpcToGo(xv)
+	xv, err := goToXpc(arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := xpcToGo(xv)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	xpc_release(xv)
 
@@ -52,8 +72,15 @@ func TestConvertSlice(t *testing.T) {
 func TestConvertSliceUUID(t *testing.T) {
 	arr := []UUID{MakeUUID("0000000000000000"), MakeUUID("1111111111111111"), MakeUUID("2222222222222222")}
 
-	xv := goToXpc(arr)
-	v := xpcToGo(xv)
+	xv, err := goToXpc(arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := xpcToGo(xv)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	xpc_release(xv)
 
@@ -80,8 +107,15 @@ func TestConvertMap(t *testing.T) {
 		"uuid":   MakeUUID("aabbccddeeff00112233445566778899"),
 	}
 
-	xv := goToXpc(d)
-	v := xpcToGo(xv)
+	xv, err := goToXpc(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := xpcToGo(xv)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	xpc_release(xv)
 
@@ -105,6 +139,96 @@ func TestConvertMap(t *testing.T) {
 	}
 }
 
+func TestConvertTypes(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{true, true},
+		{false, false},
+		{uint64(1<<63 + 1), uint64(1<<63 + 1)},
+		{3.25, 3.25},
+		{float32(0.5), 0.5},
+		{Null, Null},
+		{[]byte("data"), []byte("data")},
+		{[]byte{}, []byte{}},
+		{[6]byte{1, 2, 3, 4, 5, 6}, []byte{1, 2, 3, 4, 5, 6}},
+		{Shmem("shared data"), Shmem("shared data")},
+		{[]interface{}{[]byte{1, 2}, [][]byte{{3}, {4, 5}}, nil}, Array{[]byte{1, 2}, Array{[]byte{3}, []byte{4, 5}}, Null}},
+		{Dict{"flag": true, "data": []byte{1}}, Dict{"flag": true, "data": []byte{1}}},
+	}
+
+	for _, test := range tests {
+		xv, err := goToXpc(test.value)
+		if err != nil {
+			t.Errorf("%#v: %v", test.value, err)
+			continue
+		}
+
+		v, err := xpcToGo(xv)
+		xpc_release(xv)
+
+		if err != nil {
+			t.Errorf("%#v: %v", test.value, err)
+		} else if !reflect.DeepEqual(v, test.expected) {
+			t.Errorf("expected %#v got %#v\n", test.expected, v)
+		}
+	}
+}
+
+func TestConvertDate(t *testing.T) {
+	now := time.Unix(1600000000, 123456789)
+
+	xv, err := goToXpc(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := xpcToGo(xv)
+	xpc_release(xv)
+
+	if err != nil {
+		t.Fatal(err)
+	} else if date, ok := v.(time.Time); !ok || !date.Equal(now) {
+		t.Errorf("expected %#v got %#v\n", now, v)
+	}
+}
+
+func TestConvertBoolFlags(t *testing.T) {
+	xv, err := goToXpc(Dict{"kCBAdvDataIsConnectable": true, "kCBMsgArgState": uint64(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := xpcToGo(xv)
+	xpc_release(xv)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := v.(Dict)
+	if connectable := d.GetInt("kCBAdvDataIsConnectable", 0); connectable != 1 {
+		t.Errorf("expected 1 got %#v\n", connectable)
+	}
+	if state := d.MustGetInt("kCBMsgArgState"); state != 5 {
+		t.Errorf("expected 5 got %#v\n", state)
+	}
+}
+
+func TestConvertUnsupported(t *testing.T) {
+	d := Dict{
+		"list": []interface{}{"one", make(chan int)},
+	}
+
+	_, err := goToXpc(d)
+	if cerr, ok := err.(*ConversionError); !ok {
+		t.Errorf("expected ConversionError got %#v\n", err)
+	} else if path := strings.Join(cerr.Path, "."); path != "list.1" {
+		t.Errorf("expected %#v got %#v\n", "list.1", path)
+	}
+}
+
 func TestUname(t *testing.T) {
 	var uname Utsname
 
@@ -1,9 +1,14 @@
+//go:build darwin
+// +build darwin
+
 #include <dispatch/dispatch.h>
 #include <xpc/xpc.h>
 #include <xpc/connection.h>
 #include <Block.h>
 #include <stdlib.h>
 #include <stdio.h>
+#include <string.h>
+#include <sys/mman.h>
 
 #include "_cgo_export.h"
 
@@ -19,6 +24,12 @@ xpc_type_t TYPE_DICT = XPC_TYPE_DICTIONARY;
 xpc_type_t TYPE_INT64 = XPC_TYPE_INT64;
 xpc_type_t TYPE_STRING = XPC_TYPE_STRING;
 xpc_type_t TYPE_UUID = XPC_TYPE_UUID;
+xpc_type_t TYPE_BOOL = XPC_TYPE_BOOL;
+xpc_type_t TYPE_UINT64 = XPC_TYPE_UINT64;
+xpc_type_t TYPE_DOUBLE = XPC_TYPE_DOUBLE;
+xpc_type_t TYPE_DATE = XPC_TYPE_DATE;
+xpc_type_t TYPE_NULL = XPC_TYPE_NULL;
+xpc_type_t TYPE_SHMEM = XPC_TYPE_SHMEM;
 
 xpc_object_t ERROR_CONNECTION_INVALID = (xpc_object_t) XPC_ERROR_CONNECTION_INVALID;
 xpc_object_t ERROR_CONNECTION_INTERRUPTED = (xpc_object_t) XPC_ERROR_CONNECTION_INTERRUPTED;
@@ -61,6 +72,11 @@ void XpcSendMessage(xpc_connection_t conn, xpc_object_t message, bool release, b
     }
 }
 
+void XpcClose(xpc_connection_t conn) {
+    xpc_connection_cancel(conn);
+    xpc_release(conn);
+}
+
 void XpcArrayApply(uintptr_t v, xpc_object_t arr) {
   xpc_array_apply(arr, ^bool(size_t index, xpc_object_t value) {
     arraySet(v, index, value);
@@ -83,3 +99,42 @@ void XpcUUIDGetBytes(void *v, xpc_object_t uuid) {
      dest[i] = src[i];
    }
 }
+
+//
+// create a shared memory object with a copy of the data
+// (the region is unmapped, since the xpc object keeps its own reference to the memory)
+//
+xpc_object_t XpcShmemCreate(void *data, size_t len) {
+    void *region = mmap(NULL, len, PROT_READ | PROT_WRITE, MAP_ANON | MAP_SHARED, -1, 0);
+    if (region == MAP_FAILED) {
+        return NULL;
+    }
+
+    memcpy(region, data, len);
+
+    xpc_object_t xv = xpc_shmem_create(region, len);
+    munmap(region, len);
+    return xv;
+}
+
+//
+// map a shared memory object and return a (malloc'ed) copy of the data
+//
+void *XpcShmemCopy(xpc_object_t xv, size_t *len) {
+    void *region = NULL;
+    size_t size = xpc_shmem_map(xv, &region);
+
+    *len = 0;
+    if (size == 0 || region == NULL) {
+        return NULL;
+    }
+
+    void *data = malloc(size);
+    if (data != NULL) {
+        memcpy(data, region, size);
+        *len = size;
+    }
+
+    munmap(region, size);
+    return data;
+}
@@ -14,6 +14,12 @@ extern xpc_type_t TYPE_DICT;
 extern xpc_type_t TYPE_INT64;
 extern xpc_type_t TYPE_STRING;
 extern xpc_type_t TYPE_UUID;
+extern xpc_type_t TYPE_BOOL;
+extern xpc_type_t TYPE_UINT64;
+extern xpc_type_t TYPE_DOUBLE;
+extern xpc_type_t TYPE_DATE;
+extern xpc_type_t TYPE_NULL;
+extern xpc_type_t TYPE_SHMEM;
 
 extern xpc_object_t ERROR_CONNECTION_INVALID;
 extern xpc_object_t ERROR_CONNECTION_INTERRUPTED;
@@ -21,9 +27,12 @@ extern xpc_object_t ERROR_CONNECTION_TERMINATED;
 
 extern xpc_connection_t XpcConnect(char *, uintptr_t);
 extern void XpcSendMessage(xpc_connection_t, xpc_object_t, bool, bool);
+extern void XpcClose(xpc_connection_t);
 extern void XpcArrayApply(uintptr_t, xpc_object_t);
 extern void XpcDictApply(uintptr_t, xpc_object_t);
 extern void XpcUUIDGetBytes(void *, xpc_object_t);
+extern xpc_object_t XpcShmemCreate(void *, size_t);
+extern void *XpcShmemCopy(xpc_object_t, size_t *);
 
 // the input type for xpc_uuid_create should be uuid_t but CGO instists on unsigned char *
 // typedef uuid_t * ptr_to_uuid_t;